@@ -0,0 +1,82 @@
+// The tokens of the session are kept in localStorage. Access tokens are short
+// lived, a request answered with a 401 gets a new one with the refresh token
+// and is sent again.
+
+export function saveTokens(access, refresh) {
+  localStorage.setItem("jwt", access)
+  if (refresh) {
+    localStorage.setItem("refresh_token", refresh)
+  }
+}
+
+export function clearTokens() {
+  localStorage.removeItem("jwt")
+  localStorage.removeItem("refresh_token")
+}
+
+export function loggedIn() {
+  const jwt = localStorage.getItem("jwt")
+  return jwt != null && jwt != ""
+}
+
+// a refresh token only works once, so requests failing together share a
+// single refresh
+let refreshing = null
+
+function refresh() {
+  if (refreshing == null) {
+    refreshing = refreshTokens().finally(() => {
+      refreshing = null
+    })
+  }
+  return refreshing
+}
+
+async function refreshTokens() {
+  const token = localStorage.getItem("refresh_token")
+  if (token == null || token == "") {
+    return false
+  }
+
+  const res = await fetch(process.env.BASE_URL + "refresh", {
+    method: "POST",
+    headers: {
+      "Content-Type": "application/x-www-form-urlencoded",
+    },
+    body: "refresh_token=" + encodeURIComponent(token),
+  })
+  if (res.status != 200) {
+    clearTokens()
+    return false
+  }
+
+  saveTokens(await res.text(), res.headers.get("X-Refresh-Token"))
+  return true
+}
+
+// authFetch sends a request with the access token, refreshing it once when
+// it expired
+export async function authFetch(path, options = {}) {
+  const send = () => fetch(process.env.BASE_URL + path, {
+    ...options,
+    headers: {
+      ...options.headers,
+      "Authorization": "Bearer " + localStorage.getItem("jwt"),
+    },
+  })
+
+  const res = await send()
+  if (res.status == 401 && await refresh()) {
+    return send()
+  }
+  return res
+}
+
+// logout revokes the session on the server before forgetting its tokens
+export async function logout() {
+  try {
+    await authFetch("logout", { method: "POST" })
+  } finally {
+    clearTokens()
+  }
+}
@@ -2,6 +2,7 @@ import Vue from 'vue'
 import Router from 'vue-router'
 import Home from './views/Home.vue'
 import Login from './views/Login.vue'
+import ResetPassword from './views/ResetPassword.vue'
 import NotFound from './views/NotFound.vue'
 
 Vue.use(Router)
@@ -20,6 +21,11 @@ export default new Router({
       name: 'login',
       component: Login,
     },
+    {
+      path: '/reset-password',
+      name: 'reset password',
+      component: ResetPassword,
+    },
     {
       path: '*',
       name: 'not found',
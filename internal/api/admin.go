@@ -0,0 +1,215 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/jinzhu/gorm"
+)
+
+// AdminMiddleware only lets admins through. It must run after
+// AuthMiddleware.
+func (routes *Routes) AdminMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !currentUser(r).Admin {
+			writeErrorMessage(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// BootstrapAdmin makes sure the user with email exists and is an enabled
+// admin, so there is always a way in to a fresh server. A missing user is
+// created with the given password, the password of an existing user is left
+// alone.
+func (routes *Routes) BootstrapAdmin(email string, password string) error {
+	u := User{}
+	routes.db.Where("email = ?", email).First(&u)
+
+	if u.ID != 0 {
+		return routes.db.Model(&u).Updates(map[string]interface{}{"admin": true, "disabled": false}).Error
+	}
+
+	if password == "" {
+		return errors.New("A password is required to create the admin user " + email)
+	}
+	if err := checkPassword(password); err != nil {
+		return err
+	}
+
+	h, err := createPasswordHash(password)
+	if err != nil {
+		return err
+	}
+
+	u = User{
+		Email: email,
+		Name:  "Admin",
+		Hash:  h,
+		Admin: true,
+	}
+	return routes.db.Create(&u).Error
+}
+
+// ListUsers returns every user, including disabled ones
+func (routes *Routes) ListUsers(w http.ResponseWriter, r *http.Request) {
+	users := []User{}
+	routes.db.Order("id asc").Find(&users)
+
+	b, err := json.Marshal(users)
+	if err != nil {
+		writeErrorMessage(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Write(b)
+}
+
+// CreateUser creates a user from the email, password and name form values,
+// whether or not registration is open. Setting admin makes the new user an
+// admin.
+func (routes *Routes) CreateUser(w http.ResponseWriter, r *http.Request) {
+	u, err := routes.userFromForm(r)
+	if err != nil {
+		writeErrorMessage(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if v := r.FormValue("admin"); v != "" {
+		if u.Admin, err = strconv.ParseBool(v); err != nil {
+			writeErrorMessage(w, "Invalid admin. Must be true or false", http.StatusBadRequest)
+			return
+		}
+	}
+
+	if err := routes.db.Create(&u).Error; err != nil {
+		writeErrorMessage(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	b, err := json.Marshal(u)
+	if err != nil {
+		writeErrorMessage(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	w.Write(b)
+}
+
+// DisableUser stops a user from logging in and revokes their sessions
+func (routes *Routes) DisableUser(w http.ResponseWriter, r *http.Request) {
+	u, ok := routes.otherUser(w, r)
+	if !ok {
+		return
+	}
+
+	routes.db.Model(&u).Update("disabled", true)
+	routes.revokeSessions(u.ID)
+}
+
+// EnableUser lets a disabled user log in again
+func (routes *Routes) EnableUser(w http.ResponseWriter, r *http.Request) {
+	u, ok := routes.otherUser(w, r)
+	if !ok {
+		return
+	}
+
+	routes.db.Model(&u).Update("disabled", false)
+}
+
+// DeleteUser deletes a user along with their own schedules and their team
+// memberships. Team schedules they created stay with the team.
+func (routes *Routes) DeleteUser(w http.ResponseWriter, r *http.Request) {
+	u, ok := routes.otherUser(w, r)
+	if !ok {
+		return
+	}
+
+	schedules := []Schedule{}
+	routes.db.Where("(team_id = 0 OR team_id IS NULL) AND user_id = ?", u.ID).Find(&schedules)
+
+	err := transaction(routes.db, func(tx *gorm.DB) error {
+		for _, s := range schedules {
+			if err := tx.Delete(&s).Error; err != nil {
+				return err
+			}
+		}
+		if err := tx.Unscoped().Where("user_id = ?", u.ID).Delete(&Membership{}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&u).Error
+	})
+	if err != nil {
+		writeErrorMessage(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	for _, s := range schedules {
+		routes.timers.remove(s.ID)
+	}
+	routes.revokeSessions(u.ID)
+}
+
+// ResetPassword sets the password of a user to the password form value and
+// logs them out everywhere
+func (routes *Routes) ResetPassword(w http.ResponseWriter, r *http.Request) {
+	u, ok := routes.findUser(w, r)
+	if !ok {
+		return
+	}
+
+	password := r.FormValue("password")
+	if err := checkPassword(password); err != nil {
+		writeErrorMessage(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	h, err := createPasswordHash(password)
+	if err != nil {
+		writeErrorMessage(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	routes.db.Model(&u).Update("hash", h)
+	routes.revokeSessions(u.ID)
+}
+
+// findUser finds the user named by the id route var, writing a 404 when
+// there is none
+func (routes *Routes) findUser(w http.ResponseWriter, r *http.Request) (User, bool) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	u := User{}
+	routes.db.Where("id = ?", id).First(&u)
+
+	if u.ID == 0 {
+		writeErrorMessage(w, "Not Found", http.StatusNotFound)
+		return u, false
+	}
+
+	return u, true
+}
+
+// otherUser is findUser for changes admins can not make to themselves, so
+// they can not lock themselves out. It writes a 400 when the user named by
+// the id route var is the current user.
+func (routes *Routes) otherUser(w http.ResponseWriter, r *http.Request) (User, bool) {
+	u, ok := routes.findUser(w, r)
+	if !ok {
+		return u, false
+	}
+
+	if u.ID == currentUser(r).ID {
+		writeErrorMessage(w, "Admins can not disable or delete themselves", http.StatusBadRequest)
+		return u, false
+	}
+
+	return u, true
+}
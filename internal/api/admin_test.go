@@ -0,0 +1,233 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/jinzhu/gorm"
+)
+
+func TestAdminUsers(t *testing.T) {
+	// create dummy db
+	db, cleanup := openTestDB(t)
+	defer cleanup()
+
+	routes := NewRoutes(db, []byte{}, &HTTPClient{})
+	routes.MigrateDB()
+
+	if err := routes.BootstrapAdmin("admin@email.com", "s3cure_pw"); err != nil {
+		t.Fatal("Error creating admin: ", err.Error())
+	}
+	admin := User{}
+	db.Where("email = ?", "admin@email.com").First(&admin)
+
+	user := User{Email: "user@email.com", Name: "user", Hash: hashPassword("pw")}
+	db.Create(&user)
+
+	router := mux.NewRouter()
+	a := router.PathPrefix("/admin").Subrouter()
+	a.Use(routes.AdminMiddleware)
+	a.HandleFunc("/users", routes.ListUsers).Methods("GET")
+	a.HandleFunc("/users", routes.CreateUser).Methods("POST")
+	a.HandleFunc("/users/{id}", routes.DeleteUser).Methods("DELETE")
+	a.HandleFunc("/users/{id}/disable", routes.DisableUser).Methods("POST")
+	a.HandleFunc("/users/{id}/enable", routes.EnableUser).Methods("POST")
+	a.HandleFunc("/users/{id}/password", routes.ResetPassword).Methods("POST")
+
+	t.Run("bootstrap admin", func(t *testing.T) {
+		if !admin.Admin || !verifyPassword("s3cure_pw", admin.Hash) {
+			t.Errorf("Admin not created correctly: %+v\n", admin)
+		}
+
+		if err := routes.BootstrapAdmin("nopassword@email.com", ""); err == nil {
+			t.Error("Admin created without a password")
+		}
+
+		// an existing user is promoted and keeps their password
+		promoted := User{Email: "promoted@email.com", Hash: hashPassword("pw"), Disabled: true}
+		db.Create(&promoted)
+		if err := routes.BootstrapAdmin(promoted.Email, "other"); err != nil {
+			t.Fatal("Error promoting admin: ", err.Error())
+		}
+		db.First(&promoted, promoted.ID)
+		if !promoted.Admin || promoted.Disabled || !verifyPassword("pw", promoted.Hash) {
+			t.Errorf("Admin not promoted correctly: %+v\n", promoted)
+		}
+		db.Unscoped().Delete(&promoted)
+	})
+
+	t.Run("only admins get through", func(t *testing.T) {
+		if rr := serveAs(router, user, "GET", "/admin/users", ""); rr.Code != http.StatusForbidden {
+			t.Errorf("Incorrect status. Expected: %d, Got: %d\n", http.StatusForbidden, rr.Code)
+		}
+
+		rr := serveAs(router, admin, "GET", "/admin/users", "")
+		if rr.Code != http.StatusOK {
+			t.Fatalf("Incorrect status. Expected: %d, Got: %d\n", http.StatusOK, rr.Code)
+		}
+
+		users := []User{}
+		json.NewDecoder(rr.Body).Decode(&users)
+		if len(users) != 2 {
+			t.Errorf("Incorrect number of users. Expected: %d, Got: %d\n", 2, len(users))
+		}
+	})
+
+	testHarness := []struct {
+		testName string
+		method   string
+		path     string
+		payload  string
+		status   int
+	}{
+		{testName: "create user", method: "POST", path: "/admin/users", payload: "email=new@email.com&password=pw&name=new&admin=true", status: http.StatusCreated},
+		{testName: "create existing user", method: "POST", path: "/admin/users", payload: "email=new@email.com&password=pw&name=new", status: http.StatusBadRequest},
+		{testName: "create user without password", method: "POST", path: "/admin/users", payload: "email=other@email.com&name=new", status: http.StatusBadRequest},
+		{testName: "create user with bad admin", method: "POST", path: "/admin/users", payload: "email=other@email.com&password=pw&name=new&admin=maybe", status: http.StatusBadRequest},
+		{testName: "disable unknown user", method: "POST", path: "/admin/users/9999/disable", status: http.StatusNotFound},
+		{testName: "disable self", method: "POST", path: fmt.Sprintf("/admin/users/%d/disable", admin.ID), status: http.StatusBadRequest},
+		{testName: "delete self", method: "DELETE", path: fmt.Sprintf("/admin/users/%d", admin.ID), status: http.StatusBadRequest},
+		{testName: "reset password without password", method: "POST", path: fmt.Sprintf("/admin/users/%d/password", user.ID), status: http.StatusBadRequest},
+	}
+
+	for _, th := range testHarness {
+		t.Run(th.testName, func(t *testing.T) {
+			rr := serveAs(router, admin, th.method, th.path, th.payload)
+			if status := rr.Code; status != th.status {
+				t.Errorf("Incorrect status. Expected: %d, Got: %d\n", th.status, status)
+			}
+		})
+	}
+
+	t.Run("created user", func(t *testing.T) {
+		u := User{}
+		db.Where("email = ?", "new@email.com").First(&u)
+		if u.ID == 0 || !u.Admin || !verifyPassword("pw", u.Hash) {
+			t.Errorf("User not created correctly: %+v\n", u)
+		}
+	})
+
+	t.Run("failed create", func(t *testing.T) {
+		db.Callback().Create().Before("gorm:create").Register("test:fail", func(scope *gorm.Scope) {
+			scope.Err(errors.New("db down"))
+		})
+		defer db.Callback().Create().Remove("test:fail")
+
+		rr := serveAs(router, admin, "POST", "/admin/users", "email=lost@email.com&password=pw&name=lost")
+		if status := rr.Code; status != http.StatusInternalServerError {
+			t.Errorf("Incorrect status. Expected: %d, Got: %d\n", http.StatusInternalServerError, status)
+		}
+	})
+
+	t.Run("disable and enable", func(t *testing.T) {
+		rr := serveAs(router, admin, "POST", fmt.Sprintf("/admin/users/%d/disable", user.ID), "")
+		if rr.Code != http.StatusOK {
+			t.Fatalf("Incorrect status. Expected: %d, Got: %d\n", http.StatusOK, rr.Code)
+		}
+
+		u := User{}
+		db.First(&u, user.ID)
+		if !u.Disabled {
+			t.Error("User not disabled")
+		}
+
+		serveAs(router, admin, "POST", fmt.Sprintf("/admin/users/%d/enable", user.ID), "")
+		db.First(&u, user.ID)
+		if u.Disabled {
+			t.Error("User not enabled")
+		}
+	})
+
+	t.Run("reset password", func(t *testing.T) {
+		rr := serveAs(router, admin, "POST", fmt.Sprintf("/admin/users/%d/password", user.ID), "password=n3w_pw")
+		if rr.Code != http.StatusOK {
+			t.Fatalf("Incorrect status. Expected: %d, Got: %d\n", http.StatusOK, rr.Code)
+		}
+
+		u := User{}
+		db.First(&u, user.ID)
+		if !verifyPassword("n3w_pw", u.Hash) {
+			t.Error("Password not reset")
+		}
+	})
+
+	t.Run("delete user", func(t *testing.T) {
+		team := Team{Name: "team"}
+		db.Create(&team)
+		db.Create(&Membership{TeamID: team.ID, UserID: user.ID, Role: RoleOwner})
+
+		own := Schedule{Time: time.Now(), Status: "PENDING", UserID: user.ID}
+		db.Create(&own)
+		shared := Schedule{Time: time.Now(), Status: "PENDING", UserID: user.ID, TeamID: team.ID}
+		db.Create(&shared)
+
+		rr := serveAs(router, admin, "DELETE", fmt.Sprintf("/admin/users/%d", user.ID), "")
+		if rr.Code != http.StatusOK {
+			t.Fatalf("Incorrect status. Expected: %d, Got: %d\n", http.StatusOK, rr.Code)
+		}
+
+		count := -1
+		db.Model(&User{}).Where("id = ?", user.ID).Count(&count)
+		if count != 0 {
+			t.Error("User not deleted")
+		}
+
+		db.Model(&Membership{}).Where("user_id = ?", user.ID).Count(&count)
+		if count != 0 {
+			t.Error("Memberships not deleted")
+		}
+
+		schedules := []Schedule{}
+		db.Find(&schedules)
+		if len(schedules) != 1 || schedules[0].ID != shared.ID {
+			t.Errorf("Incorrect schedules left: %+v\n", schedules)
+		}
+	})
+}
+
+func TestRegistrationAndDisabledUsers(t *testing.T) {
+	// create dummy db
+	db, cleanup := openTestDB(t)
+	defer cleanup()
+
+	routes := NewRoutes(db, []byte{}, &HTTPClient{})
+	routes.MigrateDB()
+
+	disabled := User{Email: "disabled@email.com", Hash: hashPassword("pw"), Disabled: true}
+	db.Create(&disabled)
+
+	t.Run("closed registration", func(t *testing.T) {
+		routes.SetRegistration(RegistrationClosed)
+
+		rr := serveAs(http.HandlerFunc(routes.RegisterFunc), User{}, "POST", "/register", "email=me@email.com&password=pw&name=me")
+		if status := rr.Code; status != http.StatusForbidden {
+			t.Errorf("Incorrect status. Expected: %d, Got: %d\n", http.StatusForbidden, status)
+		}
+	})
+
+	t.Run("disabled user can not log in", func(t *testing.T) {
+		rr := serveAs(http.HandlerFunc(routes.LoginFunc), User{}, "POST", "/login", "email=disabled@email.com&password=pw")
+		if status := rr.Code; status != http.StatusForbidden {
+			t.Errorf("Incorrect status. Expected: %d, Got: %d\n", http.StatusForbidden, status)
+		}
+	})
+
+	t.Run("disabled user tokens are refused", func(t *testing.T) {
+		jwt, _, _ := routes.startSession(disabled, AllScopes)
+		handler := routes.AuthMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+		req, _ := http.NewRequest("GET", "/me", nil)
+		req.Header.Set("Authorization", "Bearer "+jwt)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		if status := rr.Code; status != http.StatusUnauthorized {
+			t.Errorf("Incorrect status. Expected: %d, Got: %d\n", http.StatusUnauthorized, status)
+		}
+	})
+}
@@ -3,8 +3,12 @@ package api
 import (
 	"crypto/rand"
 	"encoding/json"
+	"errors"
 	"net/http"
+	"net/url"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/gorilla/mux"
@@ -17,6 +21,21 @@ type Routes struct {
 	db         *gorm.DB
 	jwtSecret  []byte
 	httpClient *HTTPClient
+	timers     *timerQueue
+	instanceID string
+
+	registration string
+	accessTTL    time.Duration
+	refreshTTL   time.Duration
+	limiter      *loginLimiter
+	keys         *keyring
+	oidc         *oidcProvider
+	notifier     Notifier
+	resetURL     string
+	issuer       string
+
+	// password resets being sent in the background
+	resets sync.WaitGroup
 }
 
 // NewRoutes constructs a new Routes object with the require deps. If jwtSecret is empty
@@ -31,57 +50,146 @@ func NewRoutes(db *gorm.DB, jwtSecret []byte, httpClient *HTTPClient) *Routes {
 	}
 
 	return &Routes{
-		db:         db,
-		jwtSecret:  secret,
-		httpClient: httpClient,
+		db:           db,
+		jwtSecret:    secret,
+		httpClient:   httpClient,
+		timers:       newTimerQueue(),
+		instanceID:   newInstanceID(),
+		registration: RegistrationOpen,
+		accessTTL:    defaultAccessTTL,
+		refreshTTL:   defaultRefreshTTL,
+		limiter:      newLoginLimiter(DefaultLoginLimits),
+		notifier:     LogNotifier{},
+		resetURL:     "/reset-password",
+		issuer:       defaultIssuer,
 	}
 }
 
-// Me returns the currently authenticated user
-func (routes *Routes) Me(w http.ResponseWriter, r *http.Request) {
-	email := r.Context().Value(emailContextKey).(string)
+// The registration modes. Open lets anyone register, invite requires an
+// Invite and closed leaves creating users to admins.
+const (
+	RegistrationOpen   = "open"
+	RegistrationInvite = "invite"
+	RegistrationClosed = "closed"
+)
 
-	u := User{}
-	routes.db.Where("email = ?", email).First(&u)
+// SetRegistration sets the registration mode to one of RegistrationOpen,
+// RegistrationInvite or RegistrationClosed
+func (routes *Routes) SetRegistration(mode string) error {
+	switch mode {
+	case RegistrationOpen, RegistrationInvite, RegistrationClosed:
+		routes.registration = mode
+		return nil
+	}
+	return errors.New("Invalid registration mode. Must be one of open, invite or closed")
+}
 
-	b, _ := json.Marshal(u)
+// Me returns the currently authenticated user
+func (routes *Routes) Me(w http.ResponseWriter, r *http.Request) {
+	b, _ := json.Marshal(currentUser(r))
 
 	w.Write(b)
 }
 
-// CreateSchedule creates a schedule. Uses the user's name as the Source
+// CreateSchedule creates a schedule owned by the current user, or by the
+// team with the given team_id when the user is an editor of it. Uses the
+// user's name as the Source. The optional url, method, header and body
+// values describe the request sent when the schedule fires. Headers are
+// given as repeated "Name: value" pairs.
+//
+// A schedule with a cron expression (and optional timezone) recurs, firing
+// first at the next match after time, or after now when no time is given.
+// The max_attempts, retry_delay, backoff, jitter and retryable_codes values
+// set the retry policy. Setting coalesce lets due schedules with the same
+// target share one call. An enabled value of false creates it paused.
 func (routes *Routes) CreateSchedule(w http.ResponseWriter, r *http.Request) {
-	email := r.Context().Value(emailContextKey).(string)
+	user := currentUser(r)
 
-	timeString := r.FormValue("time")
-	if strings.TrimSpace(timeString) == "" {
+	if strings.TrimSpace(r.FormValue("time")) == "" && strings.TrimSpace(r.FormValue("cron")) == "" {
 		writeErrorMessage(w, "Time is required", http.StatusBadRequest)
 		return
 	}
 
-	time, err := time.Parse(time.RFC3339, timeString)
+	sched := Schedule{
+		Source:  user.Name,
+		Status:  "PENDING",
+		UserID:  user.ID,
+		Version: 1,
+	}
+
+	if v := strings.TrimSpace(r.FormValue("team_id")); v != "" {
+		teamID, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			writeErrorMessage(w, "Invalid team_id", http.StatusBadRequest)
+			return
+		}
+		sched.TeamID = uint(teamID)
+
+		if !roleAllows(routes.teamRole(user.ID, sched.TeamID), RoleEditor) {
+			writeErrorMessage(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+	}
+
+	if err := setScheduleTime(&sched, r); err != nil {
+		writeErrorMessage(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	paused, err := formPaused(r, false)
 	if err != nil {
-		writeErrorMessage(w, "Invalid time format. Must be format RFC3339", http.StatusBadRequest)
+		writeErrorMessage(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	if paused {
+		sched.Status = "PAUSED"
+	}
 
-	user := User{}
-	routes.db.First(&user, "email = ?", email)
+	if err := setScheduleTarget(&sched, r); err != nil {
+		writeErrorMessage(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
-	sched := Schedule{
-		Time:   time,
-		Source: user.Name,
-		Status: "PENDING",
+	if err := setRetryPolicy(&sched.RetryPolicy, r); err != nil {
+		writeErrorMessage(w, err.Error(), http.StatusBadRequest)
+		return
 	}
 
 	routes.db.Create(&sched)
+	if !paused {
+		routes.timers.set(sched.ID, sched.Time)
+	}
 	w.WriteHeader(http.StatusCreated)
 }
 
-// ListSchedules returns a list of schedules
+// ListSchedules returns the schedules of the current user and of their
+// teams. The team_id query value limits the list to a single team.
 func (routes *Routes) ListSchedules(w http.ResponseWriter, r *http.Request) {
+	user := currentUser(r)
+
+	teamIDs := []uint{}
+	routes.db.Model(&Membership{}).Where("user_id = ?", user.ID).Pluck("team_id", &teamIDs)
+
+	query := routes.db.Where("(team_id = 0 OR team_id IS NULL) AND user_id = ?", user.ID)
+	if len(teamIDs) > 0 {
+		query = query.Or("team_id IN (?)", teamIDs)
+	}
+
+	if v := r.FormValue("team_id"); v != "" {
+		teamID, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			writeErrorMessage(w, "Invalid team_id", http.StatusBadRequest)
+			return
+		}
+		if routes.teamRole(user.ID, uint(teamID)) == "" {
+			writeErrorMessage(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		query = routes.db.Where("team_id = ?", teamID)
+	}
+
 	var schedules []Schedule
-	routes.db.Find(&schedules)
+	query.Find(&schedules)
 
 	b, err := json.Marshal(schedules)
 	if err != nil {
@@ -92,8 +200,259 @@ func (routes *Routes) ListSchedules(w http.ResponseWriter, r *http.Request) {
 	w.Write(b)
 }
 
-// DeleteSchedule deletes the schedule from the db
+// ListExecutions returns a page of the executions of a schedule, newest
+// first. The page and per_page query values select the page and the total
+// number of executions is set in the X-Total-Count header.
+func (routes *Routes) ListExecutions(w http.ResponseWriter, r *http.Request) {
+	s, ok := routes.authorizedSchedule(w, r, RoleViewer)
+	if !ok {
+		return
+	}
+
+	page, perPage := pagination(r)
+
+	var total int
+	routes.db.Model(&Execution{}).Where("schedule_id = ?", s.ID).Count(&total)
+
+	executions := []Execution{}
+	err := routes.db.Where("schedule_id = ?", s.ID).
+		Order("id desc").
+		Offset((page - 1) * perPage).
+		Limit(perPage).
+		Find(&executions).Error
+	if err != nil {
+		writeErrorMessage(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	b, err := json.Marshal(executions)
+	if err != nil {
+		writeErrorMessage(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("X-Total-Count", strconv.Itoa(total))
+	w.Write(b)
+}
+
+// DeleteSchedule deletes the schedule from the db. Team schedules may be
+// deleted by the editors of the team.
 func (routes *Routes) DeleteSchedule(w http.ResponseWriter, r *http.Request) {
+	s, ok := routes.authorizedSchedule(w, r, RoleEditor)
+	if !ok {
+		return
+	}
+
+	routes.db.Delete(&s)
+	routes.timers.remove(s.ID)
+}
+
+// GetSchedule returns a schedule with its version as the ETag header, see
+// UpdateSchedule
+func (routes *Routes) GetSchedule(w http.ResponseWriter, r *http.Request) {
+	s, ok := routes.authorizedSchedule(w, r, RoleViewer)
+	if !ok {
+		return
+	}
+
+	writeSchedule(w, s)
+}
+
+// UpdateSchedule edits the time, target, retry policy and enabled state of a
+// schedule, taking the same values as CreateSchedule. A PATCH only changes
+// the values given while a PUT replaces the schedule, resetting the values
+// left out. The team of a schedule can't be changed.
+//
+// Edits are made to a version of the schedule, given as the If-Match header
+// or the version value, and fail with a 412 when the schedule changed since,
+// whether by another edit or by a run. Schedules that are RUNNING or were
+// SENT can't be edited. Moving the time of a schedule, or resuming it, starts
+// its attempts over.
+func (routes *Routes) UpdateSchedule(w http.ResponseWriter, r *http.Request) {
+	s, ok := routes.authorizedSchedule(w, r, RoleEditor)
+	if !ok {
+		return
+	}
+
+	version, err := requestedVersion(r)
+	if err != nil {
+		writeErrorMessage(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if version != 0 && version != s.Version {
+		writeErrorMessage(w, errScheduleChanged.Error(), http.StatusPreconditionFailed)
+		return
+	}
+
+	switch s.Status {
+	case "RUNNING":
+		writeErrorMessage(w, "Schedule is running", http.StatusConflict)
+		return
+	case "SENT":
+		writeErrorMessage(w, "Schedule was already sent", http.StatusConflict)
+		return
+	}
+
+	if v := strings.TrimSpace(r.FormValue("team_id")); v != "" && v != strconv.FormatUint(uint64(s.TeamID), 10) {
+		writeErrorMessage(w, "The team of a schedule can't be changed", http.StatusBadRequest)
+		return
+	}
+
+	before := s
+	replace := r.Method == "PUT"
+	if replace {
+		if strings.TrimSpace(r.FormValue("time")) == "" && strings.TrimSpace(r.FormValue("cron")) == "" {
+			writeErrorMessage(w, "Time is required", http.StatusBadRequest)
+			return
+		}
+		s.Cron, s.TimeZone, s.Coalesce = "", "", false
+		s.URL, s.Method, s.Headers, s.Body = "", "", nil, ""
+		s.RetryPolicy = RetryPolicy{}
+	}
+
+	if err := setScheduleTime(&s, r); err != nil {
+		writeErrorMessage(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	moved := !s.Time.Equal(before.Time) || s.Cron != before.Cron
+
+	paused, err := formPaused(r, before.Status == "PAUSED" && !replace)
+	if err != nil {
+		writeErrorMessage(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	switch {
+	case paused:
+		s.Status = "PAUSED"
+	case moved || before.Status == "PAUSED":
+		s.Status = "PENDING"
+	}
+
+	// resumed recurring schedules skip the runs missed while paused
+	if before.Status == "PAUSED" && s.Status == "PENDING" && s.Cron != "" && s.Time.Before(time.Now()) {
+		next, err := s.nextRun(time.Now())
+		if err != nil {
+			writeErrorMessage(w, "Invalid cron expression: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.Time = next.UTC()
+	}
+
+	if moved || s.Status != before.Status {
+		s.Attempts = 0
+	}
+
+	if err := setScheduleTarget(&s, r); err != nil {
+		writeErrorMessage(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := setRetryPolicy(&s.RetryPolicy, r); err != nil {
+		writeErrorMessage(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// the version only matches while nobody else changed the schedule,
+	// including the dispatcher claiming it
+	result := routes.db.Model(&Schedule{}).
+		Where("id = ? AND version = ?", s.ID, before.Version).
+		Updates(map[string]interface{}{
+			"time":            s.Time,
+			"status":          s.Status,
+			"attempts":        s.Attempts,
+			"cron":            s.Cron,
+			"time_zone":       s.TimeZone,
+			"url":             s.URL,
+			"method":          s.Method,
+			"headers":         s.Headers,
+			"body":            s.Body,
+			"coalesce":        s.Coalesce,
+			"max_attempts":    s.MaxAttempts,
+			"retry_delay":     s.RetryDelay,
+			"backoff":         s.Backoff,
+			"jitter":          s.Jitter,
+			"retryable_codes": s.RetryableCodes,
+			"version":         before.Version + 1,
+		})
+	if result.Error != nil {
+		writeErrorMessage(w, result.Error.Error(), http.StatusInternalServerError)
+		return
+	}
+	if result.RowsAffected != 1 {
+		writeErrorMessage(w, errScheduleChanged.Error(), http.StatusPreconditionFailed)
+		return
+	}
+
+	if s.Status == "PENDING" || s.Status == "RETRYING" {
+		routes.timers.set(s.ID, s.Time)
+	} else {
+		routes.timers.remove(s.ID)
+	}
+
+	updated := Schedule{}
+	routes.db.Where("id = ?", s.ID).First(&updated)
+	writeSchedule(w, updated)
+}
+
+// errScheduleChanged is returned for edits made to an old version of a
+// schedule
+var errScheduleChanged = errors.New("Schedule was changed. Reload it and try again")
+
+// writeSchedule writes s with its version as the ETag header
+func writeSchedule(w http.ResponseWriter, s Schedule) {
+	b, err := json.Marshal(s)
+	if err != nil {
+		writeErrorMessage(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("ETag", `"`+strconv.Itoa(s.Version)+`"`)
+	w.Write(b)
+}
+
+// requestedVersion returns the version of a schedule an edit was made to,
+// read from the If-Match header or the version form value. It returns 0 when
+// neither names a version.
+func requestedVersion(r *http.Request) (int, error) {
+	if v := strings.TrimSpace(r.Header.Get("If-Match")); v != "" && v != "*" {
+		version, err := strconv.Atoi(strings.Trim(strings.TrimPrefix(v, "W/"), `"`))
+		if err != nil || version < 1 {
+			return 0, errors.New("Invalid If-Match. Must be the ETag of the schedule")
+		}
+		return version, nil
+	}
+
+	if v := strings.TrimSpace(r.FormValue("version")); v != "" {
+		version, err := strconv.Atoi(v)
+		if err != nil || version < 1 {
+			return 0, errors.New("Invalid version. Must be a positive integer")
+		}
+		return version, nil
+	}
+
+	return 0, nil
+}
+
+// formPaused reads the enabled form value of r, returning whether the
+// schedule is paused. Without a value it returns paused.
+func formPaused(r *http.Request, paused bool) (bool, error) {
+	v := strings.TrimSpace(r.FormValue("enabled"))
+	if v == "" {
+		return paused, nil
+	}
+
+	enabled, err := strconv.ParseBool(v)
+	if err != nil {
+		return paused, errors.New("Invalid enabled. Must be true or false")
+	}
+	return !enabled, nil
+}
+
+// authorizedSchedule finds the schedule named by the id route var. It writes
+// a 404 when there is no such schedule and a 403 when the role of the current
+// user for the schedule does not allow need, returning false in both cases.
+func (routes *Routes) authorizedSchedule(w http.ResponseWriter, r *http.Request, need string) (Schedule, bool) {
 	vars := mux.Vars(r)
 	id := vars["id"]
 
@@ -102,10 +461,141 @@ func (routes *Routes) DeleteSchedule(w http.ResponseWriter, r *http.Request) {
 
 	if s.ID == 0 {
 		writeErrorMessage(w, "Not Found", http.StatusNotFound)
-		return
+		return s, false
 	}
 
-	routes.db.Delete(&s)
+	if !roleAllows(routes.scheduleRole(currentUser(r), s), need) {
+		writeErrorMessage(w, "Forbidden", http.StatusForbidden)
+		return s, false
+	}
+
+	return s, true
+}
+
+const (
+	defaultPerPage = 20
+	maxPerPage     = 100
+)
+
+// pagination reads the page and per_page query values of r, falling back to
+// the first page of defaultPerPage
+func pagination(r *http.Request) (int, int) {
+	page, err := strconv.Atoi(r.FormValue("page"))
+	if err != nil || page < 1 {
+		page = 1
+	}
+
+	perPage, err := strconv.Atoi(r.FormValue("per_page"))
+	if err != nil || perPage < 1 {
+		perPage = defaultPerPage
+	}
+	if perPage > maxPerPage {
+		perPage = maxPerPage
+	}
+
+	return page, perPage
+}
+
+// setScheduleTime reads the time, cron and timezone form values of r in to s,
+// leaving s as is when none are given. Recurring schedules are set to fire at
+// the next match after time, or after now when no time is given. Returned
+// errors are safe to show to the caller.
+func setScheduleTime(s *Schedule, r *http.Request) error {
+	timeString := strings.TrimSpace(r.FormValue("time"))
+	_, cronSet := r.Form["cron"]
+	_, zoneSet := r.Form["timezone"]
+	if timeString == "" && !cronSet && !zoneSet {
+		return nil
+	}
+
+	if cronSet {
+		s.Cron = strings.TrimSpace(r.FormValue("cron"))
+	}
+	if zoneSet {
+		s.TimeZone = strings.TrimSpace(r.FormValue("timezone"))
+	}
+
+	t := time.Now()
+	if timeString != "" {
+		var err error
+		t, err = time.Parse(time.RFC3339, timeString)
+		if err != nil {
+			return errors.New("Invalid time format. Must be format RFC3339")
+		}
+	}
+
+	if s.Cron == "" {
+		if timeString == "" {
+			return errors.New("Time is required")
+		}
+		s.TimeZone = ""
+		s.Time = t.UTC()
+		return nil
+	}
+
+	if _, err := time.LoadLocation(s.TimeZone); err != nil {
+		return errors.New("Invalid timezone")
+	}
+
+	next, err := s.nextRun(t)
+	if err != nil {
+		return errors.New("Invalid cron expression: " + err.Error())
+	}
+	s.Time = next.UTC()
+	return nil
+}
+
+var allowedMethods = []string{"GET", "POST", "PUT", "PATCH", "DELETE", "HEAD"}
+
+// setScheduleTarget reads the request target of a schedule from the form
+// values of r. Returned errors are safe to show to the caller.
+func setScheduleTarget(s *Schedule, r *http.Request) error {
+	if u := strings.TrimSpace(r.FormValue("url")); u != "" {
+		parsed, err := url.Parse(u)
+		if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			return errors.New("Invalid url. Must be an absolute http or https url")
+		}
+		s.URL = u
+	}
+
+	if m := strings.ToUpper(strings.TrimSpace(r.FormValue("method"))); m != "" {
+		valid := false
+		for _, allowed := range allowedMethods {
+			if m == allowed {
+				valid = true
+				break
+			}
+		}
+		if !valid {
+			return errors.New("Invalid method. Must be one of " + strings.Join(allowedMethods, ", "))
+		}
+		s.Method = m
+	}
+
+	if r.Form["header"] != nil {
+		s.Headers = Headers{}
+		for _, h := range r.Form["header"] {
+			parts := strings.SplitN(h, ":", 2)
+			if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+				return errors.New("Invalid header. Must be format 'Name: value'")
+			}
+			s.Headers[http.CanonicalHeaderKey(strings.TrimSpace(parts[0]))] = strings.TrimSpace(parts[1])
+		}
+	}
+
+	if _, ok := r.Form["body"]; ok {
+		s.Body = r.FormValue("body")
+	}
+
+	if v := strings.TrimSpace(r.FormValue("coalesce")); v != "" {
+		coalesce, err := strconv.ParseBool(v)
+		if err != nil {
+			return errors.New("Invalid coalesce. Must be true or false")
+		}
+		s.Coalesce = coalesce
+	}
+
+	return nil
 }
 
 type message struct {
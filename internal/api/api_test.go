@@ -5,28 +5,18 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
-	"os"
 	"testing"
 	"time"
 
 	"github.com/gorilla/mux"
-	"github.com/jinzhu/gorm"
-	_ "github.com/jinzhu/gorm/dialects/sqlite"
 )
 
 func TestCreateSchedule(t *testing.T) {
 	// create dummy db
-	f, _ := ioutil.TempFile("", "")
-	db, err := gorm.Open("sqlite3", f.Name())
-	defer os.Remove(f.Name())
-	defer db.Close()
-
-	if err != nil {
-		t.Fatal("Error initializing test sqlite db")
-	}
+	db, cleanup := openTestDB(t)
+	defer cleanup()
 
 	routes := NewRoutes(db, []byte{}, &HTTPClient{})
 	routes.MigrateDB()
@@ -40,7 +30,7 @@ func TestCreateSchedule(t *testing.T) {
 		req, _ := http.NewRequest("POST", "/schedules", bytes.NewBuffer([]byte(payload)))
 		req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
 		rr := httptest.NewRecorder()
-		c := context.WithValue(req.Context(), emailContextKey, u.Email)
+		c := context.WithValue(req.Context(), userContextKey, u)
 		req = req.WithContext(c)
 
 		http.HandlerFunc(routes.CreateSchedule).ServeHTTP(rr, req)
@@ -60,7 +50,7 @@ func TestCreateSchedule(t *testing.T) {
 		req, _ := http.NewRequest("POST", "/schedules", bytes.NewBuffer([]byte(payload)))
 		req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
 		rr := httptest.NewRecorder()
-		c := context.WithValue(req.Context(), emailContextKey, u.Email)
+		c := context.WithValue(req.Context(), userContextKey, u)
 		req = req.WithContext(c)
 
 		http.HandlerFunc(routes.CreateSchedule).ServeHTTP(rr, req)
@@ -76,58 +66,309 @@ func TestCreateSchedule(t *testing.T) {
 			t.Error("Schedule not saved in db correctly")
 		}
 	})
+
+	t.Run("target given", func(t *testing.T) {
+		payload := "time=" + time.Now().Format(time.RFC3339) +
+			"&url=https://example.com/hook&method=post&body=hi" +
+			"&header=X-Token:%20abc&header=Content-Type:%20text/plain&coalesce=true"
+
+		req, _ := http.NewRequest("POST", "/schedules", bytes.NewBuffer([]byte(payload)))
+		req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+		rr := httptest.NewRecorder()
+		c := context.WithValue(req.Context(), userContextKey, u)
+		req = req.WithContext(c)
+
+		http.HandlerFunc(routes.CreateSchedule).ServeHTTP(rr, req)
+
+		if status := rr.Code; status != http.StatusCreated {
+			t.Fatalf("Incorrect status, expected: 201, got: %d\n", status)
+		}
+
+		sched := Schedule{}
+		routes.db.Last(&sched)
+
+		if sched.URL != "https://example.com/hook" || sched.Method != "POST" || sched.Body != "hi" || !sched.Coalesce {
+			t.Errorf("Target not saved correctly: %+v\n", sched)
+		}
+
+		if sched.Headers["X-Token"] != "abc" || sched.Headers["Content-Type"] != "text/plain" {
+			t.Errorf("Headers not saved correctly: %v\n", sched.Headers)
+		}
+	})
+
+	t.Run("cron given", func(t *testing.T) {
+		payload := "cron=0%209%20*%20*%20*&timezone=America/Chicago"
+
+		req, _ := http.NewRequest("POST", "/schedules", bytes.NewBuffer([]byte(payload)))
+		req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+		rr := httptest.NewRecorder()
+		c := context.WithValue(req.Context(), userContextKey, u)
+		req = req.WithContext(c)
+
+		http.HandlerFunc(routes.CreateSchedule).ServeHTTP(rr, req)
+
+		if status := rr.Code; status != http.StatusCreated {
+			t.Fatalf("Incorrect status, expected: 201, got: %d\n", status)
+		}
+
+		sched := Schedule{}
+		routes.db.Last(&sched)
+
+		loc, _ := time.LoadLocation("America/Chicago")
+		next := sched.Time.In(loc)
+		if sched.Cron != "0 9 * * *" || next.Hour() != 9 || next.Minute() != 0 || !next.After(time.Now()) {
+			t.Errorf("Recurring schedule not saved correctly: %+v\n", sched)
+		}
+	})
+
+	t.Run("invalid cron", func(t *testing.T) {
+		for _, payload := range []string{"cron=61%20*%20*%20*%20*", "cron=@daily&timezone=Not/AZone"} {
+			req, _ := http.NewRequest("POST", "/schedules", bytes.NewBuffer([]byte(payload)))
+			req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+			rr := httptest.NewRecorder()
+			c := context.WithValue(req.Context(), userContextKey, u)
+			req = req.WithContext(c)
+
+			http.HandlerFunc(routes.CreateSchedule).ServeHTTP(rr, req)
+
+			if status := rr.Code; status != http.StatusBadRequest {
+				t.Errorf("Incorrect status for %s, expected: 400, got: %d\n", payload, status)
+			}
+		}
+	})
+
+	t.Run("invalid target", func(t *testing.T) {
+		timeString := time.Now().Format(time.RFC3339)
+
+		testHarness := []struct {
+			testName string
+			payload  string
+		}{
+			{testName: "relative url", payload: "url=/hook"},
+			{testName: "bad scheme", payload: "url=ftp://example.com"},
+			{testName: "bad method", payload: "method=BREW"},
+			{testName: "bad header", payload: "header=nocolon"},
+			{testName: "bad coalesce", payload: "coalesce=sometimes"},
+		}
+
+		for _, th := range testHarness {
+			t.Run(th.testName, func(t *testing.T) {
+				payload := "time=" + timeString + "&" + th.payload
+				req, _ := http.NewRequest("POST", "/schedules", bytes.NewBuffer([]byte(payload)))
+				req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+				rr := httptest.NewRecorder()
+				c := context.WithValue(req.Context(), userContextKey, u)
+				req = req.WithContext(c)
+
+				http.HandlerFunc(routes.CreateSchedule).ServeHTTP(rr, req)
+
+				if status := rr.Code; status != http.StatusBadRequest {
+					t.Errorf("Incorrect status, expected: 400, got: %d\n", status)
+				}
+			})
+		}
+	})
 }
 
 func TestDeleteSchedule(t *testing.T) {
 	// create dummy db
-	f, _ := ioutil.TempFile("", "")
-	db, err := gorm.Open("sqlite3", f.Name())
-	defer os.Remove(f.Name())
-	defer db.Close()
-
-	if err != nil {
-		t.Fatal("Error initializing test sqlite db")
-	}
+	db, cleanup := openTestDB(t)
+	defer cleanup()
 
 	routes := NewRoutes(db, []byte{}, &HTTPClient{})
 	routes.MigrateDB()
 
+	owner := User{Email: "owner@email.com", Name: "me"}
+	db.Create(&owner)
+	other := User{Email: "other@email.com", Name: "someone else"}
+	db.Create(&other)
+
 	s := Schedule{
 		Source: "me",
 		Time:   time.Now(),
+		UserID: owner.ID,
 	}
 
 	db.Create(&s)
 
-	path := fmt.Sprintf("/schedules/%d", s.ID)
-	req, _ := http.NewRequest("DELETE", path, nil)
-	c := context.WithValue(req.Context(), emailContextKey, "fake@email.com")
-	req = req.WithContext(c)
-
-	rr := httptest.NewRecorder()
-
 	router := mux.NewRouter()
 	router.HandleFunc("/schedules/{id}", routes.DeleteSchedule).Methods("DELETE")
-	router.ServeHTTP(rr, req)
 
-	db.Unscoped().First(&s)
+	testHarness := []struct {
+		testName string
+		user     User
+		id       uint
+		status   int
+	}{
+		{testName: "unknown schedule", user: owner, id: 9999, status: http.StatusNotFound},
+		{testName: "not the owner", user: other, id: s.ID, status: http.StatusForbidden},
+		{testName: "owner", user: owner, id: s.ID, status: http.StatusOK},
+	}
 
-	if s.DeletedAt == nil {
-		t.Error("Did not delete the entry correctly")
+	for _, th := range testHarness {
+		t.Run(th.testName, func(t *testing.T) {
+			path := fmt.Sprintf("/schedules/%d", th.id)
+			req, _ := http.NewRequest("DELETE", path, nil)
+			c := context.WithValue(req.Context(), userContextKey, th.user)
+			req = req.WithContext(c)
+
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, req)
+
+			if status := rr.Code; status != th.status {
+				t.Errorf("Incorrect status. Expected: %d, Got: %d\n", th.status, status)
+			}
+
+			deleted := Schedule{}
+			db.Unscoped().First(&deleted, s.ID)
+			if (deleted.DeletedAt != nil) != (th.status == http.StatusOK) {
+				t.Error("Did not delete the entry correctly")
+			}
+		})
 	}
 }
 
-func TestListSchedules(t *testing.T) {
+func TestUpdateSchedule(t *testing.T) {
 	// create dummy db
-	f, _ := ioutil.TempFile("", "")
-	db, err := gorm.Open("sqlite3", f.Name())
-	defer os.Remove(f.Name())
-	defer db.Close()
+	db, cleanup := openTestDB(t)
+	defer cleanup()
 
-	if err != nil {
-		t.Fatal("Error initializing test sqlite db")
+	routes := NewRoutes(db, []byte{}, &HTTPClient{})
+	routes.MigrateDB()
+
+	owner := User{Email: "owner@email.com", Name: "me"}
+	db.Create(&owner)
+	other := User{Email: "other@email.com", Name: "someone else"}
+	db.Create(&other)
+
+	start := time.Now().UTC().Add(time.Hour).Truncate(time.Second)
+	s := Schedule{
+		Source:  "me",
+		Time:    start,
+		Status:  "PENDING",
+		URL:     "https://example.com/hook",
+		UserID:  owner.ID,
+		Version: 1,
+	}
+	db.Create(&s)
+
+	router := mux.NewRouter()
+	router.HandleFunc("/schedules/{id}", routes.GetSchedule).Methods("GET")
+	router.HandleFunc("/schedules/{id}", routes.UpdateSchedule).Methods("PATCH", "PUT")
+
+	path := fmt.Sprintf("/schedules/%d", s.ID)
+	load := func() Schedule {
+		loaded := Schedule{}
+		db.First(&loaded, s.ID)
+		return loaded
 	}
 
+	moved := start.Add(time.Hour).Format(time.RFC3339)
+
+	testHarness := []struct {
+		testName string
+		user     User
+		method   string
+		path     string
+		ifMatch  string
+		payload  string
+		status   int
+		etag     string
+	}{
+		{testName: "unknown schedule", user: owner, method: "PATCH", path: "/schedules/9999", status: http.StatusNotFound},
+		{testName: "not the owner", user: other, method: "PATCH", path: path, payload: "time=" + moved, status: http.StatusForbidden},
+		{testName: "invalid time", user: owner, method: "PATCH", path: path, payload: "time=tomorrow", status: http.StatusBadRequest},
+		{testName: "invalid version", user: owner, method: "PATCH", path: path, ifMatch: "abc", status: http.StatusBadRequest},
+		{testName: "stale version", user: owner, method: "PATCH", path: path, payload: "version=2&time=" + moved, status: http.StatusPreconditionFailed},
+		{testName: "move", user: owner, method: "PATCH", path: path, ifMatch: `"1"`, payload: "time=" + moved, status: http.StatusOK, etag: `"2"`},
+		{testName: "stale etag", user: owner, method: "PATCH", path: path, ifMatch: `"1"`, payload: "enabled=false", status: http.StatusPreconditionFailed},
+		{testName: "pause", user: owner, method: "PATCH", path: path, payload: "version=2&enabled=false", status: http.StatusOK, etag: `"3"`},
+		{testName: "team can't change", user: owner, method: "PATCH", path: path, payload: "team_id=5", status: http.StatusBadRequest},
+		{testName: "get", user: owner, method: "GET", path: path, status: http.StatusOK, etag: `"3"`},
+		{testName: "put requires a time", user: owner, method: "PUT", path: path, payload: "url=https://example.com/other", status: http.StatusBadRequest},
+		{testName: "put", user: owner, method: "PUT", path: path, ifMatch: `W/"3"`, payload: "cron=@daily", status: http.StatusOK, etag: `"4"`},
+	}
+
+	for _, th := range testHarness {
+		t.Run(th.testName, func(t *testing.T) {
+			req, _ := http.NewRequest(th.method, th.path, bytes.NewBuffer([]byte(th.payload)))
+			req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+			if th.ifMatch != "" {
+				req.Header.Set("If-Match", th.ifMatch)
+			}
+			req = req.WithContext(context.WithValue(req.Context(), userContextKey, th.user))
+
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, req)
+
+			if status := rr.Code; status != th.status {
+				t.Errorf("Incorrect status. Expected: %d, Got: %d\n", th.status, status)
+			}
+			if etag := rr.Header().Get("ETag"); etag != th.etag {
+				t.Errorf("Incorrect etag. Expected: %s, Got: %s\n", th.etag, etag)
+			}
+		})
+	}
+
+	t.Run("edits are saved", func(t *testing.T) {
+		updated := load()
+		if updated.ID != s.ID || updated.Version != 4 || updated.Cron != "@daily" {
+			t.Errorf("Schedule not updated: %+v\n", updated)
+		}
+
+		// put replaces the target and keeps the schedule paused only when
+		// asked to
+		if updated.URL != "" || updated.Status != "PENDING" {
+			t.Errorf("Schedule not replaced: %+v\n", updated)
+		}
+	})
+
+	t.Run("paused schedules are not due", func(t *testing.T) {
+		db.Model(&Schedule{}).Where("id = ?", s.ID).Updates(map[string]interface{}{"status": "PAUSED", "time": time.Now().UTC().Add(-time.Minute)})
+		jobs, _ := routes.dueJobs()
+		if len(jobs) != 0 {
+			t.Errorf("Incorrect number of jobs. Expected: %d, Got: %d\n", 0, len(jobs))
+		}
+
+		// resuming skips the runs missed while paused
+		rr := serveAs(router, owner, "PATCH", path, "enabled=true")
+		if rr.Code != http.StatusOK {
+			t.Fatalf("Incorrect status. Expected: %d, Got: %d\n", http.StatusOK, rr.Code)
+		}
+		if resumed := load(); resumed.Status != "PENDING" || !resumed.Time.After(time.Now()) {
+			t.Errorf("Schedule not resumed: %+v\n", resumed)
+		}
+	})
+
+	t.Run("runs change the version", func(t *testing.T) {
+		before := load()
+		db.Model(&Schedule{}).Where("id = ?", s.ID).Update("time", time.Now().UTC().Add(-time.Minute))
+		if claimed := routes.claim([]Schedule{before}); len(claimed) != 1 {
+			t.Fatalf("Schedule not claimed\n")
+		}
+
+		payload := fmt.Sprintf("version=%d&time=%s", before.Version, moved)
+		if rr := serveAs(router, owner, "PATCH", path, payload); rr.Code != http.StatusPreconditionFailed {
+			t.Errorf("Incorrect status. Expected: %d, Got: %d\n", http.StatusPreconditionFailed, rr.Code)
+		}
+		if rr := serveAs(router, owner, "PATCH", path, "time="+moved); rr.Code != http.StatusConflict {
+			t.Errorf("Incorrect status. Expected: %d, Got: %d\n", http.StatusConflict, rr.Code)
+		}
+	})
+
+	t.Run("sent schedules can't be edited", func(t *testing.T) {
+		db.Model(&Schedule{}).Where("id = ?", s.ID).Update("status", "SENT")
+		if rr := serveAs(router, owner, "PATCH", path, "time="+moved); rr.Code != http.StatusConflict {
+			t.Errorf("Incorrect status. Expected: %d, Got: %d\n", http.StatusConflict, rr.Code)
+		}
+	})
+}
+
+func TestListSchedules(t *testing.T) {
+	// create dummy db
+	db, cleanup := openTestDB(t)
+	defer cleanup()
+
 	routes := NewRoutes(db, []byte{}, &HTTPClient{})
 	routes.MigrateDB()
 
@@ -137,18 +378,28 @@ func TestListSchedules(t *testing.T) {
 	sched := Schedule{
 		Time:   time.Now(),
 		Source: "billybob",
+		UserID: u.ID,
 	}
 	routes.db.Create(&sched)
 
+	// someone else's schedule is not listed
+	routes.db.Create(&Schedule{
+		Time:   time.Now(),
+		Source: "jimbob",
+		UserID: u.ID + 1,
+	})
+
 	sched = Schedule{
 		Time:   time.Now(),
 		Source: "billybob",
+		Cron:   "@daily",
+		UserID: u.ID,
 	}
 	routes.db.Create(&sched)
 
 	req, _ := http.NewRequest("GET", "/schedules", nil)
 	rr := httptest.NewRecorder()
-	c := context.WithValue(req.Context(), emailContextKey, u.Email)
+	c := context.WithValue(req.Context(), userContextKey, u)
 	req = req.WithContext(c)
 
 	http.HandlerFunc(routes.ListSchedules).ServeHTTP(rr, req)
@@ -161,20 +412,108 @@ func TestListSchedules(t *testing.T) {
 	json.NewDecoder(rr.Body).Decode(&schedules)
 
 	if len(schedules) != 2 {
-		t.Errorf("Not the right number of schedules! expected %d got %d", 2, len(schedules))
+		t.Fatalf("Not the right number of schedules! expected %d got %d", 2, len(schedules))
+	}
+
+	if schedules[0].NextRun != nil {
+		t.Error("One off schedule should not have a next run")
+	}
+
+	if schedules[1].NextRun == nil || !schedules[1].NextRun.Equal(sched.Time) {
+		t.Error("Recurring schedule next run not exposed")
 	}
 }
 
-func TestMeRoute(t *testing.T) {
+func TestListExecutions(t *testing.T) {
 	// create dummy db
-	f, _ := ioutil.TempFile("", "")
-	db, err := gorm.Open("sqlite3", f.Name())
-	defer os.Remove(f.Name())
-	defer db.Close()
+	db, cleanup := openTestDB(t)
+	defer cleanup()
 
-	if err != nil {
-		t.Fatal("Error initializing test sqlite db")
+	routes := NewRoutes(db, []byte{}, &HTTPClient{})
+	routes.MigrateDB()
+
+	u := User{Email: "owner@email.com", Name: "me"}
+	db.Create(&u)
+
+	s := Schedule{
+		Source: "me",
+		Time:   time.Now(),
+		Cron:   "@hourly",
+		UserID: u.ID,
 	}
+	db.Create(&s)
+
+	for i := 1; i <= 25; i++ {
+		db.Create(&Execution{ScheduleID: s.ID, Attempt: i, Status: "SENT"})
+	}
+	db.Create(&Execution{ScheduleID: s.ID + 1, Status: "SENT"})
+
+	router := mux.NewRouter()
+	router.HandleFunc("/schedules/{id}/executions", routes.ListExecutions).Methods("GET")
+
+	// requests are made as the owner unless a user is set on the context
+	asOwner := func(req *http.Request) *http.Request {
+		return req.WithContext(context.WithValue(req.Context(), userContextKey, u))
+	}
+
+	t.Run("first page", func(t *testing.T) {
+		req, _ := http.NewRequest("GET", fmt.Sprintf("/schedules/%d/executions", s.ID), nil)
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, asOwner(req))
+
+		if status := rr.Code; status != http.StatusOK {
+			t.Fatalf("Status was not OK: %d\n", status)
+		}
+
+		if total := rr.Header().Get("X-Total-Count"); total != "25" {
+			t.Errorf("Incorrect total. Expected: 25, Got: %s\n", total)
+		}
+
+		executions := []Execution{}
+		json.NewDecoder(rr.Body).Decode(&executions)
+		if len(executions) != defaultPerPage || executions[0].Attempt != 25 {
+			t.Errorf("Incorrect first page. Length: %d\n", len(executions))
+		}
+	})
+
+	t.Run("second page", func(t *testing.T) {
+		req, _ := http.NewRequest("GET", fmt.Sprintf("/schedules/%d/executions?page=2&per_page=10", s.ID), nil)
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, asOwner(req))
+
+		executions := []Execution{}
+		json.NewDecoder(rr.Body).Decode(&executions)
+		if len(executions) != 10 || executions[0].Attempt != 15 {
+			t.Errorf("Incorrect second page: %+v\n", executions)
+		}
+	})
+
+	t.Run("unknown schedule", func(t *testing.T) {
+		req, _ := http.NewRequest("GET", "/schedules/9999/executions", nil)
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, asOwner(req))
+
+		if status := rr.Code; status != http.StatusNotFound {
+			t.Errorf("Status was not 404: %d\n", status)
+		}
+	})
+
+	t.Run("not the owner", func(t *testing.T) {
+		req, _ := http.NewRequest("GET", fmt.Sprintf("/schedules/%d/executions", s.ID), nil)
+		req = req.WithContext(context.WithValue(req.Context(), userContextKey, User{DBModel: DBModel{ID: u.ID + 1}}))
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+
+		if status := rr.Code; status != http.StatusForbidden {
+			t.Errorf("Status was not 403: %d\n", status)
+		}
+	})
+}
+
+func TestMeRoute(t *testing.T) {
+	// create dummy db
+	db, cleanup := openTestDB(t)
+	defer cleanup()
 
 	// initialize routes
 	routes := NewRoutes(db, []byte{}, &HTTPClient{})
@@ -184,14 +523,14 @@ func TestMeRoute(t *testing.T) {
 	// create dummy user
 	u := User{
 		Email: "dummyuser",
-		Hash:  createPasswordHash(password),
+		Hash:  hashPassword(password),
 	}
 
 	db.Create(&u)
 
 	t.Run("returns the user", func(t *testing.T) {
 		req, _ := http.NewRequest("GET", "/me", nil)
-		c := context.WithValue(req.Context(), emailContextKey, u.Email)
+		c := context.WithValue(req.Context(), userContextKey, u)
 		req = req.WithContext(c)
 		rr := httptest.NewRecorder()
 		handler := http.HandlerFunc(routes.Me)
@@ -0,0 +1,166 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// apiKeyPrefix starts every API key so AuthMiddleware can tell them from
+// access tokens
+const apiKeyPrefix = "sk_"
+
+// lastUsedInterval is how stale LastUsedAt may get before it is written
+// again, so busy keys don't write on every request
+const lastUsedInterval = time.Minute
+
+// currentAPIKey returns the API key set on the context by AuthMiddleware. It
+// is empty when the caller authenticated with an access token.
+func currentAPIKey(r *http.Request) APIKey {
+	k, _ := r.Context().Value(apiKeyContextKey).(APIKey)
+	return k
+}
+
+// CreateAPIKey creates an API key for the current user named by the name
+// form value. It has the scopes of the caller unless fewer are asked for
+// with the scope form value and never expires unless expires_in is set. The
+// key is only ever returned here. Keys are only managed from a login session,
+// so one key can't create, list or revoke others.
+func (routes *Routes) CreateAPIKey(w http.ResponseWriter, r *http.Request) {
+	if !requireSession(w, r) {
+		return
+	}
+
+	name := strings.TrimSpace(r.FormValue("name"))
+	if name == "" {
+		writeErrorMessage(w, "Name required", http.StatusBadRequest)
+		return
+	}
+
+	// keys can not do more than the token creating them
+	scopes, err := parseScopes(r.FormValue("scope"), currentScopes(r).without(ScopeAccount))
+	if err != nil {
+		writeErrorMessage(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if scopes.has(ScopeAccount) {
+		writeErrorMessage(w, "Keys can not have the "+ScopeAccount+" scope", http.StatusBadRequest)
+		return
+	}
+	if !scopes.within(currentScopes(r)) {
+		writeErrorMessage(w, "Keys can not have scopes the caller does not have", http.StatusForbidden)
+		return
+	}
+
+	k := APIKey{UserID: currentUser(r).ID, Name: name, Scopes: scopes}
+
+	if v := strings.TrimSpace(r.FormValue("expires_in")); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			writeErrorMessage(w, "Invalid expires_in. Must be a duration like 720h", http.StatusBadRequest)
+			return
+		}
+		expiresAt := time.Now().UTC().Add(d)
+		k.ExpiresAt = &expiresAt
+	}
+
+	token, err := randomToken()
+	if err != nil {
+		writeErrorMessage(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	k.Key = apiKeyPrefix + token
+	k.KeyHash = hashToken(k.Key)
+	k.Prefix = k.Key[:len(apiKeyPrefix)+8]
+
+	if err := routes.db.Create(&k).Error; err != nil {
+		writeErrorMessage(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	resp, err := json.Marshal(k)
+	if err != nil {
+		writeErrorMessage(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	w.Write(resp)
+}
+
+// ListAPIKeys returns the API keys of the current user, newest first
+func (routes *Routes) ListAPIKeys(w http.ResponseWriter, r *http.Request) {
+	if !requireSession(w, r) {
+		return
+	}
+
+	keys := []APIKey{}
+	routes.db.Where("user_id = ?", currentUser(r).ID).Order("id desc").Find(&keys)
+
+	b, err := json.Marshal(keys)
+	if err != nil {
+		writeErrorMessage(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Write(b)
+}
+
+// RevokeAPIKey deletes one of the current user's API keys so it can no
+// longer be used
+func (routes *Routes) RevokeAPIKey(w http.ResponseWriter, r *http.Request) {
+	if !requireSession(w, r) {
+		return
+	}
+
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	k := APIKey{}
+	routes.db.Where("id = ? AND user_id = ?", id, currentUser(r).ID).First(&k)
+
+	if k.ID == 0 {
+		writeErrorMessage(w, "Not Found", http.StatusNotFound)
+		return
+	}
+
+	routes.db.Delete(&k)
+}
+
+// revokeAPIKeys revokes every API key of the user
+func (routes *Routes) revokeAPIKeys(userID uint) {
+	err := routes.db.Where("user_id = ?", userID).Delete(&APIKey{}).Error
+	if err != nil {
+		log.Printf("Error revoking api keys of user %d: %s\n", userID, err.Error())
+	}
+}
+
+// authenticateAPIKey returns the user and the API key of token, recording
+// when the key was last used
+func (routes *Routes) authenticateAPIKey(token string) (User, APIKey, error) {
+	k := APIKey{}
+	routes.db.Where("key_hash = ?", hashToken(token)).First(&k)
+
+	now := time.Now().UTC()
+	if k.ID == 0 || (k.ExpiresAt != nil && !k.ExpiresAt.After(now)) {
+		return User{}, APIKey{}, errors.New("Unknown or expired api key")
+	}
+
+	u := User{}
+	routes.db.Where("id = ?", k.UserID).First(&u)
+	if u.ID == 0 || u.Disabled {
+		return User{}, APIKey{}, errors.New("Unknown or disabled user of api key")
+	}
+
+	if k.LastUsedAt == nil || now.Sub(*k.LastUsedAt) > lastUsedInterval {
+		routes.db.Model(&k).UpdateColumn("last_used_at", now)
+		k.LastUsedAt = &now
+	}
+
+	return u, k, nil
+}
@@ -0,0 +1,207 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func TestAPIKeys(t *testing.T) {
+	// create dummy db
+	db, cleanup := openTestDB(t)
+	defer cleanup()
+
+	routes := NewRoutes(db, []byte("secret"), &HTTPClient{})
+	routes.MigrateDB()
+
+	u := User{Email: "me@email.com", Name: "me"}
+	other := User{Email: "other@email.com", Name: "other"}
+	for _, user := range []*User{&u, &other} {
+		db.Create(user)
+	}
+
+	router := mux.NewRouter()
+	router.HandleFunc("/api-keys", routes.ListAPIKeys).Methods("GET")
+	router.HandleFunc("/api-keys", routes.CreateAPIKey).Methods("POST")
+	router.HandleFunc("/api-keys/{id}", routes.RevokeAPIKey).Methods("DELETE")
+	router.HandleFunc("/logout", routes.LogoutFunc).Methods("POST")
+
+	// keys are managed from a login session
+	serve := func(user User, method string, path string, payload string) *httptest.ResponseRecorder {
+		session := Session{UserID: user.ID, Scopes: AllScopes}
+		session.ID = user.ID
+		withSession := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			router.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), sessionContextKey, session)))
+		})
+		return serveAs(withSession, user, method, path, payload)
+	}
+
+	createKey := func(t *testing.T, payload string) APIKey {
+		rr := serve(u, "POST", "/api-keys", payload)
+		if status := rr.Code; status != http.StatusCreated {
+			t.Fatalf("Incorrect status. Expected: %d, Got: %d\n", http.StatusCreated, status)
+		}
+
+		k := APIKey{}
+		json.NewDecoder(rr.Body).Decode(&k)
+		return k
+	}
+
+	me := routes.AuthMiddleware(http.HandlerFunc(routes.Me))
+	authenticate := func(header string, value string) int {
+		req, _ := http.NewRequest("GET", "/me", nil)
+		req.Header.Set(header, value)
+		rr := httptest.NewRecorder()
+		me.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	t.Run("create", func(t *testing.T) {
+		testHarness := []struct {
+			testName string
+			payload  string
+			status   int
+		}{
+			{testName: "no name", payload: "", status: http.StatusBadRequest},
+			{testName: "bad expiry", payload: "name=ci&expires_in=never", status: http.StatusBadRequest},
+			{testName: "negative expiry", payload: "name=ci&expires_in=-1h", status: http.StatusBadRequest},
+			{testName: "valid key", payload: "name=ci&expires_in=720h", status: http.StatusCreated},
+		}
+
+		for _, th := range testHarness {
+			t.Run(th.testName, func(t *testing.T) {
+				rr := serve(u, "POST", "/api-keys", th.payload)
+				if status := rr.Code; status != th.status {
+					t.Errorf("Incorrect status. Expected: %d, Got: %d\n", th.status, status)
+				}
+			})
+		}
+	})
+
+	t.Run("keys are stored hashed", func(t *testing.T) {
+		k := createKey(t, "name=hashed")
+		if !strings.HasPrefix(k.Key, apiKeyPrefix) || !strings.HasPrefix(k.Key, k.Prefix) {
+			t.Fatalf("Key not returned: %+v\n", k)
+		}
+
+		stored := APIKey{}
+		db.First(&stored, k.ID)
+		if stored.KeyHash != hashToken(k.Key) || stored.UserID != u.ID || stored.ExpiresAt != nil {
+			t.Errorf("Key not stored correctly: %+v\n", stored)
+		}
+	})
+
+	t.Run("authenticate", func(t *testing.T) {
+		k := createKey(t, "name=ci")
+		expired := createKey(t, "name=expired&expires_in=1ns")
+		time.Sleep(time.Millisecond)
+
+		testHarness := []struct {
+			testName string
+			header   string
+			value    string
+			status   int
+		}{
+			{testName: "bearer", header: "Authorization", value: "Bearer " + k.Key, status: http.StatusOK},
+			{testName: "header", header: "X-API-Key", value: k.Key, status: http.StatusOK},
+			{testName: "unknown key", header: "X-API-Key", value: apiKeyPrefix + "abc", status: http.StatusUnauthorized},
+			{testName: "expired key", header: "Authorization", value: "Bearer " + expired.Key, status: http.StatusUnauthorized},
+		}
+
+		for _, th := range testHarness {
+			t.Run(th.testName, func(t *testing.T) {
+				if status := authenticate(th.header, th.value); status != th.status {
+					t.Errorf("Incorrect status. Expected: %d, Got: %d\n", th.status, status)
+				}
+			})
+		}
+
+		db.First(&k, k.ID)
+		if k.LastUsedAt == nil {
+			t.Error("Last use not recorded")
+		}
+	})
+
+	t.Run("keys of disabled users are refused", func(t *testing.T) {
+		k := createKey(t, "name=disabled")
+		db.Model(&u).Update("disabled", true)
+		defer db.Model(&u).Update("disabled", false)
+
+		if status := authenticate("X-API-Key", k.Key); status != http.StatusUnauthorized {
+			t.Errorf("Incorrect status. Expected: %d, Got: %d\n", http.StatusUnauthorized, status)
+		}
+	})
+
+	t.Run("list and revoke", func(t *testing.T) {
+		k := createKey(t, "name=revoked")
+
+		rr := serve(other, "GET", "/api-keys", "")
+		keys := []APIKey{}
+		json.NewDecoder(rr.Body).Decode(&keys)
+		if len(keys) != 0 {
+			t.Errorf("Incorrect number of keys. Expected: %d, Got: %d\n", 0, len(keys))
+		}
+
+		rr = serve(u, "GET", "/api-keys", "")
+		json.NewDecoder(rr.Body).Decode(&keys)
+		if len(keys) != 6 || keys[0].ID != k.ID || keys[0].Key != "" {
+			t.Errorf("Incorrect keys: %+v\n", keys)
+		}
+
+		path := fmt.Sprintf("/api-keys/%d", k.ID)
+		if rr := serve(other, "DELETE", path, ""); rr.Code != http.StatusNotFound {
+			t.Errorf("Incorrect status. Expected: %d, Got: %d\n", http.StatusNotFound, rr.Code)
+		}
+		if rr := serve(u, "DELETE", path, ""); rr.Code != http.StatusOK {
+			t.Errorf("Incorrect status. Expected: %d, Got: %d\n", http.StatusOK, rr.Code)
+		}
+
+		if status := authenticate("X-API-Key", k.Key); status != http.StatusUnauthorized {
+			t.Errorf("Incorrect status. Expected: %d, Got: %d\n", http.StatusUnauthorized, status)
+		}
+	})
+
+	t.Run("api keys can not log out or manage keys", func(t *testing.T) {
+		k := createKey(t, "name=dashboard&scope=schedules:read")
+		deploy := createKey(t, "name=deploy")
+
+		keyRouter := routes.AuthMiddleware(router)
+		testHarness := []struct {
+			testName string
+			method   string
+			path     string
+			payload  string
+		}{
+			{testName: "log out", method: "POST", path: "/logout", payload: ""},
+			{testName: "log out everywhere", method: "POST", path: "/logout", payload: "all=true"},
+			{testName: "list", method: "GET", path: "/api-keys", payload: ""},
+			{testName: "create", method: "POST", path: "/api-keys", payload: "name=more"},
+			{testName: "revoke", method: "DELETE", path: fmt.Sprintf("/api-keys/%d", deploy.ID), payload: ""},
+		}
+
+		for _, th := range testHarness {
+			t.Run(th.testName, func(t *testing.T) {
+				req, _ := http.NewRequest(th.method, th.path, bytes.NewBuffer([]byte(th.payload)))
+				req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+				req.Header.Set("X-API-Key", k.Key)
+				rr := httptest.NewRecorder()
+				keyRouter.ServeHTTP(rr, req)
+				if status := rr.Code; status != http.StatusBadRequest {
+					t.Errorf("Incorrect status. Expected: %d, Got: %d\n", http.StatusBadRequest, status)
+				}
+			})
+		}
+
+		if status := authenticate("X-API-Key", deploy.Key); status != http.StatusOK {
+			t.Errorf("Incorrect status. Expected: %d, Got: %d\n", http.StatusOK, status)
+		}
+	})
+}
@@ -0,0 +1,71 @@
+package api
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// The actions of audit entries
+const (
+	AuditLoginLockout        = "login.lockout"
+	AuditMFAEnabled          = "mfa.enabled"
+	AuditMFADisabled         = "mfa.disabled"
+	AuditMFARecoveryCodeUsed = "mfa.recovery_code_used"
+	AuditPasswordChanged     = "password.changed"
+	AuditPasswordReset       = "password.reset"
+)
+
+// audit records an AuditEntry. Failing is logged so the action being audited
+// goes ahead.
+func (routes *Routes) audit(entry AuditEntry) {
+	entry.OccurredAt = time.Now().UTC()
+	if err := routes.db.Create(&entry).Error; err != nil {
+		log.Printf("Error recording audit entry %s: %s\n", entry.Action, err.Error())
+	}
+}
+
+// ListAuditEntries returns a page of the audit entries, newest first. They
+// can be filtered with the action and user_id query values, the page and
+// per_page query values select the page and the total number of entries is
+// set in the X-Total-Count header.
+func (routes *Routes) ListAuditEntries(w http.ResponseWriter, r *http.Request) {
+	page, perPage := pagination(r)
+
+	query := routes.db.Model(&AuditEntry{})
+	if action := r.FormValue("action"); action != "" {
+		query = query.Where("action = ?", action)
+	}
+	if v := r.FormValue("user_id"); v != "" {
+		userID, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			writeErrorMessage(w, "Invalid user_id", http.StatusBadRequest)
+			return
+		}
+		query = query.Where("user_id = ?", userID)
+	}
+
+	var total int
+	query.Count(&total)
+
+	entries := []AuditEntry{}
+	err := query.Order("id desc").
+		Offset((page - 1) * perPage).
+		Limit(perPage).
+		Find(&entries).Error
+	if err != nil {
+		writeErrorMessage(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	b, err := json.Marshal(entries)
+	if err != nil {
+		writeErrorMessage(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("X-Total-Count", strconv.Itoa(total))
+	w.Write(b)
+}
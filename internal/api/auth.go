@@ -3,57 +3,111 @@ package api
 import (
 	"context"
 	"crypto/rand"
-	"crypto/sha1"
+	"crypto/sha256"
 	"encoding/hex"
 	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"strings"
+	"time"
 
 	jwt "github.com/dgrijalva/jwt-go"
-	"golang.org/x/crypto/pbkdf2"
 )
 
 type key int
 
-var emailContextKey key = 1
+var userContextKey key = 1
+var sessionContextKey key = 2
+var apiKeyContextKey key = 3
 
-// AuthMiddleware provides the http.Handler for authentication
+// AuthMiddleware provides the http.Handler for authentication. Callers
+// authenticate with an access token or an API key in the Authorization
+// header, or with an API key in the X-API-Key header. Expired tokens and
+// tokens of revoked sessions are refused. The user is looked up once and set
+// on the request context along with the session or API key, see currentUser.
 func (routes *Routes) AuthMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		authHeader := r.Header["Authorization"]
-		if len(authHeader) == 0 {
-			writeErrorMessage(w, "Unauthorized", http.StatusUnauthorized)
-			return
+		token := r.Header.Get("X-API-Key")
+		if token == "" {
+			authHeader := r.Header["Authorization"]
+			if len(authHeader) == 0 {
+				writeErrorMessage(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+			authString := authHeader[0]
+
+			authParts := strings.Split(authString, " ")
+			if len(authParts) != 2 {
+				writeErrorMessage(w, "Unauthorized", http.StatusUnauthorized)
+				log.Println("Unexpected auth header:", authString)
+				return
+			}
+
+			token = authParts[1]
 		}
-		authString := authHeader[0]
 
-		authParts := strings.Split(authString, " ")
-		if len(authParts) != 2 {
-			writeErrorMessage(w, "Unauthorized", http.StatusUnauthorized)
-			log.Println("Unexpected auth header:", authString)
-			return
+		c := r.Context()
+		if strings.HasPrefix(token, apiKeyPrefix) {
+			u, k, err := routes.authenticateAPIKey(token)
+			if err != nil {
+				writeErrorMessage(w, "Unauthorized", http.StatusUnauthorized)
+				log.Printf("Error authenticating api key: %s\n", err.Error())
+				return
+			}
+			c = context.WithValue(c, userContextKey, u)
+			c = context.WithValue(c, apiKeyContextKey, k)
+		} else {
+			u, s, err := routes.authenticateJWT(token)
+			if err != nil {
+				writeErrorMessage(w, "Unauthorized", http.StatusUnauthorized)
+				log.Printf("Error authenticating jwt: %s\n", err.Error())
+				return
+			}
+			c = context.WithValue(c, userContextKey, u)
+			c = context.WithValue(c, sessionContextKey, s)
 		}
 
-		token := authParts[1]
+		// set the user back on the context
+		next.ServeHTTP(w, r.WithContext(c))
+	})
+}
 
-		email, err := routes.extractEmailFromJWT(token)
-		if err != nil {
-			writeErrorMessage(w, "Unauthorized", http.StatusUnauthorized)
-			log.Printf("Error parsing jwt %s error: %s\n", token, err.Error())
-			return
-		}
+// authenticateJWT returns the user and the session of an access token
+func (routes *Routes) authenticateJWT(token string) (User, Session, error) {
+	claims, err := routes.parseJWT(token)
+	if err != nil {
+		return User{}, Session{}, err
+	}
 
-		// set the email back on the context
-		c := context.WithValue(r.Context(), emailContextKey, email)
-		r = r.WithContext(c)
+	u := User{}
+	routes.db.Where("email = ?", claims.Email).First(&u)
+	if u.ID == 0 || u.Disabled {
+		return User{}, Session{}, fmt.Errorf("Unknown or disabled user in jwt: %s", claims.Email)
+	}
 
-		next.ServeHTTP(w, r)
-	})
+	s := Session{}
+	routes.db.Where("id = ?", claims.SessionID).First(&s)
+	if !s.active() || s.UserID != u.ID {
+		return User{}, Session{}, fmt.Errorf("Session %d is not active", claims.SessionID)
+	}
+
+	return u, s, nil
 }
 
-// LoginFunc handles logins and assigns session tokens
+// currentUser returns the authenticated user set on the context by
+// AuthMiddleware
+func currentUser(r *http.Request) User {
+	return r.Context().Value(userContextKey).(User)
+}
+
+// LoginFunc handles logins and assigns session tokens. The tokens have
+// every scope unless fewer are asked for with the scope form value. Legacy
+// password hashes are upgraded on the way. Too many failed logins from an IP
+// or for an account are refused with a 429, see LoginLimits.
+//
+// Users with two-factor authentication get a 202 with an mfa_token instead
+// of session tokens, to be sent to LoginMFAFunc along with their code.
 func (routes *Routes) LoginFunc(w http.ResponseWriter, r *http.Request) {
 	email := r.FormValue("email")
 	if email == "" {
@@ -67,120 +121,301 @@ func (routes *Routes) LoginFunc(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	scopes, err := parseScopes(r.FormValue("scope"), AllScopes)
+	if err != nil {
+		writeErrorMessage(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ip := clientIP(r)
+	account := strings.ToLower(email)
+	if wait := routes.limiter.wait(ip, account); wait > 0 {
+		writeTooManyRequests(w, wait)
+		return
+	}
+
 	u := User{}
 	routes.db.Where("email = ?", email).First(&u)
 
 	if u.ID == 0 {
+		// as slow as a wrong password, so the time taken doesn't tell which
+		// emails have an account
+		verifyPassword(password, dummyPasswordHash())
+		routes.loginFailed(ip, account, u)
 		writeErrorMessage(w, "Incorrect username or password", http.StatusUnauthorized)
 		return
 	}
 
 	if verifyPassword(password, u.Hash) {
+		if u.Disabled {
+			writeErrorMessage(w, "Account disabled", http.StatusForbidden)
+			return
+		}
+
+		if needsRehash(u.Hash) {
+			routes.rehashPassword(u, password)
+		}
+
+		scopes = loginScopes(u, scopes)
+
+		// the login is not done until the code is checked
+		if u.TOTPEnabled {
+			routes.writeMFAToken(w, u, scopes)
+			return
+		}
+
+		routes.limiter.succeed(account)
+
 		// build a jwt and return it here
-		jwt, err := routes.createJWT(u)
+		access, refresh, err := routes.startSession(u, scopes)
 		if err != nil {
 			writeErrorMessage(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
-		w.WriteHeader(http.StatusOK)
-		w.Write([]byte(jwt))
+		writeTokens(w, access, refresh)
 	} else {
+		routes.loginFailed(ip, account, u)
 		writeErrorMessage(w, "Incorrect username or password", http.StatusUnauthorized)
 	}
 }
 
-// RegisterFunc handles registrations and assigns session tokens
+// loginFailed counts a failed login, auditing the lockout when it locks the
+// account. u is empty when there is no user with the email.
+func (routes *Routes) loginFailed(ip string, account string, u User) {
+	lockout := routes.limiter.fail(ip, account)
+	if lockout == 0 {
+		return
+	}
+
+	log.Printf("Locked out %s for %s after failed logins from %s\n", account, lockout, ip)
+	routes.audit(AuditEntry{
+		Action: AuditLoginLockout,
+		UserID: u.ID,
+		Email:  account,
+		IP:     ip,
+		Detail: "Locked for " + lockout.String(),
+	})
+}
+
+// RegisterFunc handles registrations and assigns session tokens. It is
+// refused when registration is closed and requires the token of an Invite
+// for the email in the invite form value when registration is invite only,
+// see SetRegistration. An invite to a team makes the new user a member.
 func (routes *Routes) RegisterFunc(w http.ResponseWriter, r *http.Request) {
+	if routes.registration == RegistrationClosed {
+		writeErrorMessage(w, "Registration is closed", http.StatusForbidden)
+		return
+	}
+
+	token := r.FormValue("invite")
+	if token == "" && routes.registration == RegistrationInvite {
+		writeErrorMessage(w, "Invite required", http.StatusForbidden)
+		return
+	}
+
+	u, err := routes.userFromForm(r)
+	if err != nil {
+		writeErrorMessage(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if token == "" {
+		routes.db.Create(&u)
+		w.WriteHeader(http.StatusCreated)
+		return
+	}
+
+	err = routes.redeemInvite(token, &u)
+	if err == errInvalidInvite {
+		writeErrorMessage(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		writeErrorMessage(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+}
+
+// userFromForm builds a new user from the email, password and name form
+// values of r. Returned errors are safe to show to the caller.
+func (routes *Routes) userFromForm(r *http.Request) (User, error) {
 	email := r.FormValue("email")
 	if email == "" {
-		writeErrorMessage(w, "Email required", http.StatusBadRequest)
-		return
+		return User{}, errors.New("Email required")
 	}
 
 	password := r.FormValue("password")
-	if password == "" {
-		writeErrorMessage(w, "Password required", http.StatusBadRequest)
-		return
+	if err := checkPassword(password); err != nil {
+		return User{}, err
 	}
 
 	name := r.FormValue("name")
 	if name == "" {
-		writeErrorMessage(w, "Name required", http.StatusBadRequest)
-		return
+		return User{}, errors.New("Name required")
 	}
 
 	u := User{}
 	routes.db.Where("email = ?", email).First(&u)
 	if u.ID != 0 {
-		writeErrorMessage(w, "Email previously registered", http.StatusBadRequest)
-		return
+		return User{}, errors.New("Email previously registered")
 	}
 
-	h := createPasswordHash(password)
+	h, err := createPasswordHash(password)
+	if err != nil {
+		return User{}, err
+	}
 
 	// might want to validate user here
 
-	u = User{
+	return User{
 		Email: email,
 		Hash:  h,
 		Name:  name,
+	}, nil
+}
+
+// The audiences of the tokens signed by signClaims. Only tokens for
+// accessAudience are access tokens, services verifying tokens with the JWKS
+// must check the aud claim along with the iss claim.
+const (
+	accessAudience = "scheduler:access"
+	mfaAudience    = "scheduler:mfa"
+)
+
+// defaultIssuer is the iss claim of tokens unless SetIssuer is called
+const defaultIssuer = "scheduler"
+
+// accessClaims are the claims of an access token. SessionID names the
+// Session the token was issued for, Scopes are the scopes of that session.
+// The same claims are used for the token of a login waiting for its second
+// factor, for the mfaAudience.
+type accessClaims struct {
+	Email     string `json:"email"`
+	SessionID uint   `json:"sid,omitempty"`
+	Scopes    Scopes `json:"scopes"`
+	jwt.StandardClaims
+}
+
+// SetIssuer sets the iss claim of tokens, usually the url of the server.
+// Tokens from another issuer are refused.
+func (routes *Routes) SetIssuer(issuer string) error {
+	if issuer == "" {
+		return errors.New("Issuer required")
 	}
+	routes.issuer = issuer
+	return nil
+}
 
-	routes.db.Create(&u)
-	w.WriteHeader(http.StatusCreated)
+func (routes *Routes) createJWT(user User, session Session) (string, error) {
+	return routes.signClaims(accessClaims{
+		Email:     user.Email,
+		SessionID: session.ID,
+		Scopes:    session.Scopes,
+	}, accessAudience, routes.accessTTL)
 }
 
-func (routes *Routes) createJWT(user User) (string, error) {
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-		"email": user.Email,
-	})
+// signClaims signs claims for audience that expire after ttl. Access tokens
+// are signed with the signing key when there is one and with the jwt secret
+// otherwise. Tokens for other audiences are only read by this server and
+// always use the jwt secret, so services trusting the JWKS can't accept them.
+func (routes *Routes) signClaims(claims accessClaims, audience string, ttl time.Duration) (string, error) {
+	jti, err := randomToken()
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	claims.StandardClaims = jwt.StandardClaims{
+		Id:        jti,
+		Issuer:    routes.issuer,
+		Audience:  audience,
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(ttl).Unix(),
+	}
+
+	if routes.keys == nil || audience != accessAudience {
+		token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+		return token.SignedString(routes.jwtSecret)
+	}
 
-	return token.SignedString(routes.jwtSecret)
+	k := routes.keys.signing
+	token := jwt.NewWithClaims(k.method, claims)
+	token.Header["kid"] = k.id
+	return token.SignedString(k.private)
 }
 
-func (routes *Routes) extractEmailFromJWT(tokenString string) (string, error) {
-	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-		// validate the alg
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("Unexpected signing method: %v", token.Header["alg"])
+// parseJWT verifies an access token and returns its claims. Tokens without
+// an expiry are refused.
+func (routes *Routes) parseJWT(tokenString string) (accessClaims, error) {
+	return routes.parseClaims(tokenString, accessAudience)
+}
+
+// parseClaims verifies a token signed by signClaims for audience and returns
+// its claims. With signing keys the kid header picks the key to verify access
+// tokens with.
+func (routes *Routes) parseClaims(tokenString string, audience string) (accessClaims, error) {
+	claims := accessClaims{}
+	token, err := jwt.ParseWithClaims(tokenString, &claims, func(token *jwt.Token) (interface{}, error) {
+		if routes.keys == nil || audience != accessAudience {
+			// validate the alg
+			if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+				return nil, fmt.Errorf("Unexpected signing method: %v", token.Header["alg"])
+			}
+			return routes.jwtSecret, nil
 		}
 
-		return routes.jwtSecret, nil
+		kid, _ := token.Header["kid"].(string)
+		k, ok := routes.keys.verify[kid]
+		if !ok {
+			return nil, fmt.Errorf("Unknown key id: %q", kid)
+		}
+		if token.Method.Alg() != k.method.Alg() {
+			return nil, fmt.Errorf("Unexpected signing method: %v", token.Header["alg"])
+		}
+		return k.public, nil
 	})
 
 	if err != nil {
-		return "", err
+		return claims, err
 	}
 
-	if claims, ok := token.Claims.(jwt.MapClaims); ok && token.Valid {
-		if claims["email"] != nil {
-			email := claims["email"].(string)
-			return email, nil
-		}
-		return "", errors.New("Email not present on claims")
+	if !token.Valid {
+		return claims, errors.New("Error parsing claims")
 	}
 
-	return "", errors.New("Error parsing claims")
-}
+	if claims.Email == "" {
+		return claims, errors.New("Email not present on claims")
+	}
 
-var iterations = 10000
-var keyLength = 32
+	if !claims.VerifyExpiresAt(time.Now().Unix(), true) {
+		return claims, errors.New("Expiry not present on claims")
+	}
+
+	if claims.Issuer != routes.issuer {
+		return claims, fmt.Errorf("Unexpected token issuer: %q", claims.Issuer)
+	}
 
-func createPasswordHash(password string) string {
-	salt := make([]byte, 16)
-	rand.Read(salt)
-	k := pbkdf2.Key([]byte(password), salt, iterations, keyLength, sha1.New)
-	return hex.EncodeToString(salt) + ":" + hex.EncodeToString(k)
+	if claims.Audience != audience {
+		return claims, fmt.Errorf("Unexpected token audience: %q", claims.Audience)
+	}
+
+	return claims, nil
 }
 
-func verifyPassword(password string, hash string) bool {
-	p := strings.Split(hash, ":")
-	salt, err := hex.DecodeString(p[0])
-	if err != nil {
-		fmt.Print("Error decoding salt from " + hash)
-		return false
+// randomToken returns 32 random bytes in hex
+func randomToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
 	}
-	key := p[1]
-	k := pbkdf2.Key([]byte(password), salt, iterations, keyLength, sha1.New)
-	return key == hex.EncodeToString(k)
+	return hex.EncodeToString(b), nil
+}
+
+// hashToken hashes tokens for storage. The tokens are random so a fast hash
+// is enough.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
 }
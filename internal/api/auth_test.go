@@ -2,27 +2,25 @@ package api
 
 import (
 	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
-	"os"
+	"strings"
 	"testing"
+	"time"
 
-	"github.com/jinzhu/gorm"
-	_ "github.com/jinzhu/gorm/dialects/sqlite"
+	jwtgo "github.com/dgrijalva/jwt-go"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/pbkdf2"
 )
 
 func TestLoginFunc(t *testing.T) {
 	// create dummy db
-	f, _ := ioutil.TempFile("", "")
-	db, err := gorm.Open("sqlite3", f.Name())
-	defer os.Remove(f.Name())
-	defer db.Close()
-
-	if err != nil {
-		t.Fatal("Error initializing test sqlite db: " + err.Error())
-	}
+	db, cleanup := openTestDB(t)
+	defer cleanup()
 
 	routes := NewRoutes(db, []byte{}, &HTTPClient{})
 	routes.MigrateDB()
@@ -31,7 +29,7 @@ func TestLoginFunc(t *testing.T) {
 	// create dummy user
 	u := User{
 		Email: "dummyuser",
-		Hash:  createPasswordHash(password),
+		Hash:  hashPassword(password),
 	}
 
 	db.Create(&u)
@@ -55,15 +53,19 @@ func TestLoginFunc(t *testing.T) {
 			t.Errorf("Status was not 200 for correct login: %d\n", status)
 		}
 
-		email, err := routes.extractEmailFromJWT(string(body))
+		claims, err := routes.parseJWT(string(body))
 		if err != nil {
 			t.Error(string(body))
 			t.Fatal("Error decoding jwt", err.Error())
 		}
 
-		if email != u.Email {
+		if claims.Email != u.Email {
 			t.Error("User email not encoded in jwt properly")
 		}
+
+		if rr.Header().Get("X-Refresh-Token") == "" {
+			t.Error("Refresh token not returned")
+		}
 	})
 
 	t.Run("incorrect password", func(t *testing.T) {
@@ -134,14 +136,8 @@ func TestLoginFunc(t *testing.T) {
 
 func TestRegisterFunc(t *testing.T) {
 	// create dummy db
-	f, _ := ioutil.TempFile("", "")
-	db, err := gorm.Open("sqlite3", f.Name())
-	defer os.Remove(f.Name())
-	defer db.Close()
-
-	if err != nil {
-		t.Fatal("Error initializing test sqlite db")
-	}
+	db, cleanup := openTestDB(t)
+	defer cleanup()
 
 	routes := NewRoutes(db, []byte{}, &HTTPClient{})
 	routes.MigrateDB()
@@ -212,14 +208,8 @@ func TestRegisterFunc(t *testing.T) {
 
 func TestAuthMiddleware(t *testing.T) {
 	// create dummy db
-	f, _ := ioutil.TempFile("", "")
-	db, err := gorm.Open("sqlite3", f.Name())
-	defer os.Remove(f.Name())
-	defer db.Close()
-
-	if err != nil {
-		t.Fatal("Error initializing test sqlite db")
-	}
+	db, cleanup := openTestDB(t)
+	defer cleanup()
 
 	routes := NewRoutes(db, []byte{}, &HTTPClient{})
 	routes.MigrateDB()
@@ -227,15 +217,16 @@ func TestAuthMiddleware(t *testing.T) {
 	u := User{
 		Email: "me@email.email",
 	}
+	db.Create(&u)
 
 	nextHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		i := r.Context().Value(emailContextKey)
+		i := r.Context().Value(userContextKey)
 		if i == nil {
-			t.Error("Email was not present on context")
+			t.Error("User was not present on context")
 		} else {
-			email := r.Context().Value(emailContextKey).(string)
-			if email != u.Email {
-				t.Errorf("Email not set on context correctly. Expected: %s, Got: %s\n", u.Email, email)
+			user := currentUser(r)
+			if user.ID != u.ID || user.Email != u.Email {
+				t.Errorf("User not set on context correctly. Expected: %s, Got: %s\n", u.Email, user.Email)
 			}
 			w.WriteHeader(http.StatusOK)
 		}
@@ -257,7 +248,7 @@ func TestAuthMiddleware(t *testing.T) {
 		req, _ := http.NewRequest("GET", "/api/me", nil)
 		rr := httptest.NewRecorder()
 
-		jwt, _ := routes.createJWT(u)
+		jwt, _, _ := routes.startSession(u, AllScopes)
 		req.Header["Authorization"] = []string{fmt.Sprintf("Bearer %s", jwt)}
 
 		handlerToTest.ServeHTTP(rr, req)
@@ -266,6 +257,20 @@ func TestAuthMiddleware(t *testing.T) {
 			t.Errorf("Status was not 200 with jwt present: %d\n", status)
 		}
 	})
+
+	t.Run("unknown user", func(t *testing.T) {
+		req, _ := http.NewRequest("GET", "/api/me", nil)
+		rr := httptest.NewRecorder()
+
+		jwt, _, _ := routes.startSession(User{Email: "nobody@email.email"}, AllScopes)
+		req.Header["Authorization"] = []string{fmt.Sprintf("Bearer %s", jwt)}
+
+		handlerToTest.ServeHTTP(rr, req)
+
+		if status := rr.Code; status != http.StatusUnauthorized {
+			t.Errorf("Status was not 401 for unknown user: %d\n", status)
+		}
+	})
 }
 
 func TestJWT(t *testing.T) {
@@ -276,7 +281,7 @@ func TestJWT(t *testing.T) {
 		Email: "billybob@thing.thing",
 	}
 
-	jwt, err := routes.createJWT(user)
+	jwt, err := routes.createJWT(user, Session{DBModel: DBModel{ID: 1}})
 	if err != nil {
 		t.Error("Error creating jwt: ", err.Error())
 	}
@@ -285,41 +290,135 @@ func TestJWT(t *testing.T) {
 		t.Error("Jwt not created")
 	}
 
-	email, err := routes.extractEmailFromJWT(jwt)
+	claims, err := routes.parseJWT(jwt)
 
 	if err != nil {
 		t.Error("Error extracting email", err.Error())
 	}
 
-	if email != user.Email {
-		t.Error("Email not correct")
+	if claims.Email != user.Email || claims.SessionID != 1 {
+		t.Error("Claims not correct")
 	}
+
+	t.Run("expired token", func(t *testing.T) {
+		routes.SetTokenTTLs(-time.Minute, time.Hour)
+		defer routes.SetTokenTTLs(defaultAccessTTL, defaultRefreshTTL)
+
+		jwt, _ := routes.createJWT(user, Session{DBModel: DBModel{ID: 1}})
+		if _, err := routes.parseJWT(jwt); err == nil {
+			t.Error("Expired token accepted")
+		}
+	})
+
+	t.Run("token without expiry", func(t *testing.T) {
+		token := jwtgo.NewWithClaims(jwtgo.SigningMethodHS256, accessClaims{Email: user.Email, SessionID: 1})
+		jwt, _ := token.SignedString(routes.jwtSecret)
+		if _, err := routes.parseJWT(jwt); err == nil {
+			t.Error("Token without expiry accepted")
+		}
+	})
 }
 
 func TestPasswordHashing(t *testing.T) {
 	pw := "im the d0pest password"
 
-	hash := createPasswordHash(pw)
+	hash, err := createPasswordHash(pw)
+	if err != nil {
+		t.Fatal("Error hashing password: ", err.Error())
+	}
+
+	if !strings.HasPrefix(hash, "$2a$") {
+		t.Fatalf("Password not hashed with bcrypt: %s\n", hash)
+	}
+
+	// made by the PBKDF2-SHA1 hashing used before bcrypt
+	salt := []byte("0123456789abcdef")
+	legacy := hex.EncodeToString(salt) + ":" + hex.EncodeToString(pbkdf2.Key([]byte(pw), salt, 10000, 32, sha1.New))
+
+	testHarness := []struct {
+		testName string
+		password string
+		hash     string
+		valid    bool
+	}{
+		{testName: "correct password", password: pw, hash: hash, valid: true},
+		{testName: "incorrect password", password: "not right", hash: hash, valid: false},
+		{testName: "correct legacy password", password: pw, hash: legacy, valid: true},
+		{testName: "incorrect legacy password", password: "not right", hash: legacy, valid: false},
+		{testName: "Malformed hash", password: pw, hash: "garbagesalt", valid: false},
+		{testName: "Malformed legacy key", password: pw, hash: hex.EncodeToString(salt) + ":abc", valid: false},
+		{testName: "Malformed bcrypt hash", password: pw, hash: "$2a$10$garbage", valid: false},
+		{testName: "Empty hash", password: "", hash: "", valid: false},
+	}
 
-	if len(hash) == 0 {
-		t.Fatal("Password hash was not populated")
+	for _, th := range testHarness {
+		t.Run(th.testName, func(t *testing.T) {
+			if valid := verifyPassword(th.password, th.hash); valid != th.valid {
+				t.Errorf("Incorrect result. Expected: %t, Got: %t\n", th.valid, valid)
+			}
+		})
 	}
 
-	t.Run("correct password", func(t *testing.T) {
-		if !verifyPassword(pw, hash) {
-			t.Error("Password was rejected incorrectly")
+	t.Run("too long", func(t *testing.T) {
+		if err := checkPassword(strings.Repeat("a", maxPasswordLength+1)); err == nil {
+			t.Error("Long password accepted")
 		}
 	})
 
-	t.Run("incorrect password", func(t *testing.T) {
-		if verifyPassword("not right", hash) {
-			t.Error("Password was accepted incorrectly")
+	t.Run("needs rehash", func(t *testing.T) {
+		if needsRehash(hash) || !needsRehash(legacy) {
+			t.Error("Incorrect rehash decision")
+		}
+
+		cost := passwordCost
+		defer SetPasswordCost(cost)
+		SetPasswordCost(cost + 1)
+		if !needsRehash(hash) {
+			t.Error("Hash of another cost not rehashed")
+		}
+	})
+
+	t.Run("dummy hash", func(t *testing.T) {
+		dummy := dummyPasswordHash()
+		if needsRehash(dummy) || verifyPassword("", dummy) || verifyPassword(pw, dummy) {
+			t.Errorf("Incorrect dummy hash: %s\n", dummy)
+		}
+
+		cost := passwordCost
+		defer SetPasswordCost(cost)
+		SetPasswordCost(cost + 1)
+		if needsRehash(dummyPasswordHash()) {
+			t.Error("Dummy hash not of the current cost")
 		}
 	})
 
-	t.Run("Malformed hash", func(t *testing.T) {
-		if verifyPassword(pw, "garbagesalt") {
-			t.Error("Garbage salt not rejected")
+	t.Run("invalid cost", func(t *testing.T) {
+		if err := SetPasswordCost(bcrypt.MaxCost + 1); err == nil {
+			t.Error("Invalid cost accepted")
 		}
 	})
 }
+
+func TestLegacyPasswordRehash(t *testing.T) {
+	// create dummy db
+	db, cleanup := openTestDB(t)
+	defer cleanup()
+
+	routes := NewRoutes(db, []byte{}, &HTTPClient{})
+	routes.MigrateDB()
+
+	salt := []byte("0123456789abcdef")
+	legacy := hex.EncodeToString(salt) + ":" + hex.EncodeToString(pbkdf2.Key([]byte("pw"), salt, 10000, 32, sha1.New))
+	u := User{Email: "legacy@email.com", Hash: legacy}
+	db.Create(&u)
+
+	rr := serveAs(http.HandlerFunc(routes.LoginFunc), User{}, "POST", "/login", "email=legacy@email.com&password=pw")
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("Incorrect status. Expected: %d, Got: %d\n", http.StatusOK, status)
+	}
+
+	db.First(&u, u.ID)
+	if u.Hash == legacy || needsRehash(u.Hash) || !verifyPassword("pw", u.Hash) {
+		t.Errorf("Password not rehashed: %s\n", u.Hash)
+	}
+}
@@ -0,0 +1,103 @@
+package api
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCron(t *testing.T) {
+	testHarness := []struct {
+		spec  string
+		valid bool
+	}{
+		{spec: "* * * * *", valid: true},
+		{spec: "*/15 9-17 * * mon-fri", valid: true},
+		{spec: "0 0 1,15 jan,jul *", valid: true},
+		{spec: "5/10 * * * 7", valid: true},
+		{spec: "@daily", valid: true},
+		{spec: "@HOURLY", valid: true},
+		{spec: "", valid: false},
+		{spec: "* * * *", valid: false},
+		{spec: "60 * * * *", valid: false},
+		{spec: "* 24 * * *", valid: false},
+		{spec: "* * 0 * *", valid: false},
+		{spec: "* * * 13 *", valid: false},
+		{spec: "*/0 * * * *", valid: false},
+		{spec: "5-1 * * * *", valid: false},
+		{spec: "@sometimes", valid: false},
+	}
+
+	for _, th := range testHarness {
+		t.Run(th.spec, func(t *testing.T) {
+			_, err := parseCron(th.spec)
+			if th.valid && err != nil {
+				t.Errorf("Expected valid cron expression, got error: %s\n", err.Error())
+			}
+			if !th.valid && err == nil {
+				t.Error("Expected invalid cron expression to be rejected")
+			}
+		})
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	// a wednesday
+	from := time.Date(2019, time.March, 13, 10, 30, 15, 0, time.UTC)
+
+	testHarness := []struct {
+		spec     string
+		expected time.Time
+	}{
+		{spec: "* * * * *", expected: time.Date(2019, time.March, 13, 10, 31, 0, 0, time.UTC)},
+		{spec: "@hourly", expected: time.Date(2019, time.March, 13, 11, 0, 0, 0, time.UTC)},
+		{spec: "@daily", expected: time.Date(2019, time.March, 14, 0, 0, 0, 0, time.UTC)},
+		{spec: "@weekly", expected: time.Date(2019, time.March, 17, 0, 0, 0, 0, time.UTC)},
+		{spec: "@yearly", expected: time.Date(2020, time.January, 1, 0, 0, 0, 0, time.UTC)},
+		{spec: "*/20 10 * * *", expected: time.Date(2019, time.March, 13, 10, 40, 0, 0, time.UTC)},
+		{spec: "0 9 * * mon-fri", expected: time.Date(2019, time.March, 14, 9, 0, 0, 0, time.UTC)},
+		{spec: "0 9 * * sat", expected: time.Date(2019, time.March, 16, 9, 0, 0, 0, time.UTC)},
+		{spec: "0 0 29 2 *", expected: time.Date(2020, time.February, 29, 0, 0, 0, 0, time.UTC)},
+		// day of month and day of week are or'd when both are restricted
+		{spec: "0 0 20 * 5", expected: time.Date(2019, time.March, 15, 0, 0, 0, 0, time.UTC)},
+	}
+
+	for _, th := range testHarness {
+		t.Run(th.spec, func(t *testing.T) {
+			c, err := parseCron(th.spec)
+			if err != nil {
+				t.Fatal("Error parsing cron expression: ", err.Error())
+			}
+
+			if next := c.next(from); !next.Equal(th.expected) {
+				t.Errorf("Incorrect next run. Expected: %s, Got: %s\n", th.expected, next)
+			}
+		})
+	}
+
+	t.Run("never matches", func(t *testing.T) {
+		c, _ := parseCron("0 0 30 2 *")
+		if next := c.next(from); !next.IsZero() {
+			t.Errorf("Expected zero time, Got: %s\n", next)
+		}
+	})
+}
+
+func TestScheduleNextRun(t *testing.T) {
+	s := Schedule{Cron: "0 9 * * *", TimeZone: "America/Chicago"}
+
+	next, err := s.nextRun(time.Date(2019, time.March, 13, 12, 0, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatal("Error calculating next run: ", err.Error())
+	}
+
+	// 9am in chicago during daylight time
+	expected := time.Date(2019, time.March, 13, 14, 0, 0, 0, time.UTC)
+	if !next.Equal(expected) {
+		t.Errorf("Incorrect next run. Expected: %s, Got: %s\n", expected, next)
+	}
+
+	s.TimeZone = "Not/AZone"
+	if _, err := s.nextRun(time.Now()); err == nil {
+		t.Error("Invalid timezone not rejected")
+	}
+}
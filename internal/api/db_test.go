@@ -0,0 +1,100 @@
+package api
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/jinzhu/gorm"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestMain(m *testing.M) {
+	// hashing at the default cost would slow every test creating a user
+	passwordCost = bcrypt.MinCost
+	os.Exit(m.Run())
+}
+
+// hashPassword hashes the password of a test user
+func hashPassword(password string) string {
+	h, err := createPasswordHash(password)
+	if err != nil {
+		panic(err)
+	}
+	return h
+}
+
+// openTestDB opens the db the tests run against. By default this is a fresh
+// sqlite file, set TEST_DATABASE_URL to run the tests against postgres or
+// mysql instead. Any tables left over from previous tests are dropped.
+func openTestDB(t *testing.T) (*gorm.DB, func()) {
+	databaseURL := os.Getenv("TEST_DATABASE_URL")
+	if databaseURL == "" {
+		f, err := ioutil.TempFile("", "")
+		if err != nil {
+			t.Fatal("Error creating test sqlite db: " + err.Error())
+		}
+		f.Close()
+
+		databaseURL = "sqlite3://" + f.Name()
+	}
+
+	db, err := OpenDB(databaseURL)
+	if err != nil {
+		t.Fatal("Error initializing test db: " + err.Error())
+	}
+
+	db.DropTableIfExists(testTables...)
+
+	return db, func() {
+		db.Close()
+		if dialect, path, _ := parseDatabaseURL(databaseURL); dialect == "sqlite3" {
+			os.Remove(path)
+		}
+	}
+}
+
+// testTables lists every table of the db, newest first so that foreign keys
+// do not get in the way of dropping them
+var testTables = []interface{}{&SchemaMigration{}, &PasswordReset{}, &OIDCState{}, &RecoveryCode{}, &AuditEntry{}, &APIKey{}, &Session{}, &Invite{}, &Membership{}, &Team{}, &LeaderLease{}, &Execution{}, &Schedule{}, &User{}}
+
+func TestParseDatabaseURL(t *testing.T) {
+	testHarness := []struct {
+		url     string
+		dialect string
+		args    string
+		valid   bool
+	}{
+		{url: "", dialect: "sqlite3", args: "sqlite.db", valid: true},
+		{url: "sqlite3:///var/lib/scheduler.db", dialect: "sqlite3", args: "/var/lib/scheduler.db", valid: true},
+		{url: "sqlite://data/scheduler.db", dialect: "sqlite3", args: "data/scheduler.db", valid: true},
+		{url: "postgres://me:pw@db:5432/scheduler?sslmode=disable", dialect: "postgres", args: "postgres://me:pw@db:5432/scheduler?sslmode=disable", valid: true},
+		{url: "postgresql://db/scheduler", dialect: "postgres", args: "postgresql://db/scheduler", valid: true},
+		{url: "mysql://me:pw@db/scheduler", dialect: "mysql", args: "me:pw@tcp(db:3306)/scheduler?charset=utf8mb4&parseTime=true", valid: true},
+		{url: "mysql://me@db:3307/scheduler?charset=latin1", dialect: "mysql", args: "me@tcp(db:3307)/scheduler?charset=latin1&parseTime=true", valid: true},
+		{url: "mysql://db", valid: false},
+		{url: "sqlite3://", valid: false},
+		{url: "mongodb://db/scheduler", valid: false},
+		{url: "sqlite.db", valid: false},
+	}
+
+	for _, th := range testHarness {
+		t.Run(th.url, func(t *testing.T) {
+			dialect, args, err := parseDatabaseURL(th.url)
+			if !th.valid {
+				if err == nil {
+					t.Error("Invalid url not rejected")
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal("Error parsing url: ", err.Error())
+			}
+
+			if dialect != th.dialect || args != th.args {
+				t.Errorf("Incorrect result. Expected: %s %s, Got: %s %s\n", th.dialect, th.args, dialect, args)
+			}
+		})
+	}
+}
@@ -0,0 +1,299 @@
+package api
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// Dispatcher hands due schedules to a fixed pool of workers so a slow
+// endpoint only ties up the worker calling it. At most hostLimit calls to
+// the same host are made at once, further jobs for that host wait in the
+// queue while jobs for other hosts go ahead.
+//
+// Run wakes the Dispatcher exactly when the next schedule is due, using the
+// timer queue kept up to date by Routes. With an Elector only the leader
+// dispatches, also checking the db for due schedules every dueCheck as its
+// timer queue misses schedules created on other replicas.
+type Dispatcher struct {
+	routes    *Routes
+	elector   *Elector
+	workers   int
+	hostLimit int
+	dueCheck  time.Duration
+
+	mu     sync.Mutex
+	cond   *sync.Cond
+	queue  []dispatchJob
+	hosts  map[string]int // calls in progress per host
+	queued map[uint]bool  // schedules that are queued or in progress
+	closed bool
+	stop   chan struct{}
+	wg     sync.WaitGroup
+
+	running   int
+	completed int
+	failed    int
+	skipped   int
+}
+
+// defaultDueCheck is how often the leader checks the db for due schedules
+const defaultDueCheck = 10 * time.Second
+
+type dispatchJob struct {
+	host      string
+	schedules []Schedule
+}
+
+// DispatcherStats is a snapshot of the state of a Dispatcher
+type DispatcherStats struct {
+	Workers    int `json:"workers"`
+	Scheduled  int `json:"scheduled"`
+	QueueDepth int `json:"queue_depth"`
+	Running    int `json:"running"`
+	Completed  int `json:"completed"`
+	Failed     int `json:"failed"`
+	Skipped    int `json:"skipped"`
+}
+
+// NewDispatcher creates a Dispatcher and starts its workers. A hostLimit of 0
+// means no limit on concurrent calls per host. A nil elector means this is
+// the only replica and it always dispatches.
+func NewDispatcher(routes *Routes, elector *Elector, workers int, hostLimit int) *Dispatcher {
+	if workers < 1 {
+		workers = 1
+	}
+
+	d := &Dispatcher{
+		routes:    routes,
+		elector:   elector,
+		workers:   workers,
+		hostLimit: hostLimit,
+		dueCheck:  defaultDueCheck,
+		hosts:     map[string]int{},
+		queued:    map[uint]bool{},
+		stop:      make(chan struct{}),
+	}
+	d.cond = sync.NewCond(&d.mu)
+
+	for i := 0; i < workers; i++ {
+		d.wg.Add(1)
+		go d.work()
+	}
+
+	return d
+}
+
+// Run loads the timer queue from the db and dispatches schedules as they
+// become due until the Dispatcher is stopped. Every scanInterval the timer
+// queue is reloaded from the db as a safety net for changes it missed, such
+// as schedules created on other replicas.
+func (d *Dispatcher) Run(scanInterval time.Duration) {
+	timers := d.routes.timers
+	if err := d.routes.loadTimers(); err != nil {
+		log.Printf("Error loading schedules: %s\n", err.Error())
+	}
+
+	scan := time.NewTicker(scanInterval)
+	defer scan.Stop()
+
+	var elected <-chan struct{}
+	var due <-chan time.Time
+	if d.elector != nil {
+		elected = d.elector.changed
+
+		// only asks for schedules that are due, unlike the full scan
+		dueCheck := time.NewTicker(d.dueCheck)
+		defer dueCheck.Stop()
+		due = dueCheck.C
+	}
+
+	for {
+		var timer *time.Timer
+		var wake <-chan time.Time
+		if next, ok := timers.next(); ok && d.isLeader() {
+			timer = time.NewTimer(time.Until(next))
+			wake = timer.C
+		}
+
+		stopped := false
+		select {
+		case <-wake:
+			if ids := timers.popDue(time.Now()); len(ids) > 0 {
+				d.Dispatch(ids...)
+			}
+		case <-timers.changed:
+		case <-elected:
+			// a new leader may have missed changes made on other replicas
+			if d.isLeader() {
+				if err := d.routes.loadTimers(); err != nil {
+					log.Printf("Error loading schedules: %s\n", err.Error())
+				}
+			}
+		case <-scan.C:
+			if err := d.routes.loadTimers(); err != nil {
+				log.Printf("Error loading schedules: %s\n", err.Error())
+			}
+		case <-due:
+			if d.isLeader() {
+				d.Dispatch()
+			}
+		case <-d.stop:
+			stopped = true
+		}
+
+		if timer != nil {
+			timer.Stop()
+		}
+		if stopped {
+			return
+		}
+	}
+}
+
+func (d *Dispatcher) isLeader() bool {
+	return d.elector == nil || d.elector.IsLeader()
+}
+
+// Dispatch queues the due schedules for the workers. When ids are given only
+// those schedules are considered. Schedules already queued or in progress
+// are skipped.
+func (d *Dispatcher) Dispatch(ids ...uint) {
+	jobs, err := d.routes.dueJobs(ids...)
+	if err != nil {
+		log.Printf("Error finding schedules: %s\n", err.Error())
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for _, job := range jobs {
+		schedules := []Schedule{}
+		for _, s := range job {
+			if !d.queued[s.ID] {
+				d.queued[s.ID] = true
+				schedules = append(schedules, s)
+			}
+		}
+		if len(schedules) == 0 {
+			continue
+		}
+
+		d.queue = append(d.queue, dispatchJob{
+			host:      d.host(schedules[0]),
+			schedules: schedules,
+		})
+	}
+
+	d.cond.Broadcast()
+}
+
+// Stop waits for the calls in progress to finish and stops the workers.
+// Queued jobs are dropped, they are picked up again on the next Dispatch
+// after a restart.
+func (d *Dispatcher) Stop() {
+	d.mu.Lock()
+	if !d.closed {
+		close(d.stop)
+	}
+	d.closed = true
+	d.cond.Broadcast()
+	d.mu.Unlock()
+
+	d.wg.Wait()
+}
+
+// Stats returns the current queue depth and counters of the Dispatcher
+func (d *Dispatcher) Stats() DispatcherStats {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return DispatcherStats{
+		Workers:    d.workers,
+		Scheduled:  d.routes.timers.len(),
+		QueueDepth: len(d.queue),
+		Running:    d.running,
+		Completed:  d.completed,
+		Failed:     d.failed,
+		Skipped:    d.skipped,
+	}
+}
+
+// Metrics writes the Stats of the Dispatcher as json
+func (d *Dispatcher) Metrics(w http.ResponseWriter, r *http.Request) {
+	b, err := json.Marshal(d.Stats())
+	if err != nil {
+		writeErrorMessage(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+func (d *Dispatcher) work() {
+	defer d.wg.Done()
+
+	for {
+		job, ok := d.next()
+		if !ok {
+			return
+		}
+
+		ran, err := d.routes.runJob(job.schedules)
+
+		d.mu.Lock()
+		d.hosts[job.host]--
+		if d.hosts[job.host] == 0 {
+			delete(d.hosts, job.host)
+		}
+		for _, s := range job.schedules {
+			delete(d.queued, s.ID)
+		}
+		d.running--
+		if !ran {
+			d.skipped++
+		} else if err != nil {
+			d.failed++
+		} else {
+			d.completed++
+		}
+		d.cond.Broadcast()
+		d.mu.Unlock()
+	}
+}
+
+// next blocks until there is a job whose host is below the limit and takes it
+// off the queue. It returns false once the Dispatcher is stopped.
+func (d *Dispatcher) next() (dispatchJob, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for !d.closed {
+		for i, job := range d.queue {
+			if d.hostLimit > 0 && d.hosts[job.host] >= d.hostLimit {
+				continue
+			}
+
+			d.queue = append(d.queue[:i], d.queue[i+1:]...)
+			d.hosts[job.host]++
+			d.running++
+			return job, true
+		}
+
+		d.cond.Wait()
+	}
+
+	return dispatchJob{}, false
+}
+
+func (d *Dispatcher) host(s Schedule) string {
+	u, err := url.Parse(d.routes.httpClient.targetURL(s))
+	if err != nil {
+		return ""
+	}
+	return u.Host
+}
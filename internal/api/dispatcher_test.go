@@ -0,0 +1,140 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestDispatcher(t *testing.T) {
+	// create dummy db
+	db, cleanup := openTestDB(t)
+	defer cleanup()
+
+	release := make(chan struct{})
+	slowServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		w.Write([]byte(`OK`))
+	}))
+	defer slowServer.Close()
+
+	fastServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`OK`))
+	}))
+	defer fastServer.Close()
+
+	routes := NewRoutes(db, []byte{}, NewHTTPClient("", time.Minute))
+	routes.MigrateDB()
+
+	due := time.Now().Add(-1 * time.Minute)
+	slow1 := Schedule{Time: due, Status: "PENDING", URL: slowServer.URL}
+	slow2 := Schedule{Time: due, Status: "PENDING", URL: slowServer.URL}
+	fast := Schedule{Time: due, Status: "PENDING", URL: fastServer.URL}
+	db.Create(&slow1)
+	db.Create(&slow2)
+	db.Create(&fast)
+
+	d := NewDispatcher(routes, nil, 3, 1)
+	defer d.Stop()
+
+	d.Dispatch()
+
+	t.Run("slow host does not block others", func(t *testing.T) {
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			s := Schedule{}
+			db.First(&s, fast.ID)
+			if s.Status == "SENT" {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatal("Fast schedule was not sent while slow host was hanging")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	})
+
+	t.Run("host limit holds back jobs", func(t *testing.T) {
+		stats := d.Stats()
+		if stats.Running != 1 || stats.QueueDepth != 1 || stats.Completed != 1 {
+			t.Errorf("Incorrect stats: %+v\n", stats)
+		}
+	})
+
+	t.Run("queued schedules are not dispatched twice", func(t *testing.T) {
+		d.Dispatch()
+
+		if stats := d.Stats(); stats.Running+stats.QueueDepth != 2 {
+			t.Errorf("Schedules queued twice: %+v\n", stats)
+		}
+	})
+
+	t.Run("slow jobs finish", func(t *testing.T) {
+		close(release)
+
+		deadline := time.Now().Add(5 * time.Second)
+		for d.Stats().Completed != 3 {
+			if time.Now().After(deadline) {
+				t.Fatalf("Slow schedules did not finish: %+v\n", d.Stats())
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		var sent int
+		db.Model(&Schedule{}).Where("status = ?", "SENT").Count(&sent)
+		if sent != 3 {
+			t.Errorf("Incorrect number of sent schedules. Expected: 3, Got: %d\n", sent)
+		}
+	})
+}
+
+func TestDispatcherRun(t *testing.T) {
+	// create dummy db
+	db, cleanup := openTestDB(t)
+	defer cleanup()
+
+	called := make(chan time.Time, 2)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called <- time.Now()
+		w.Write([]byte(`OK`))
+	}))
+	defer server.Close()
+
+	routes := NewRoutes(db, []byte{}, NewHTTPClient(server.URL, time.Minute))
+	routes.MigrateDB()
+
+	// already waiting when the dispatcher starts
+	early := Schedule{Time: time.Now().Add(100 * time.Millisecond), Status: "PENDING"}
+	db.Create(&early)
+
+	d := NewDispatcher(routes, nil, 1, 0)
+	defer d.Stop()
+
+	// the safety net scan never runs during the test
+	go d.Run(time.Hour)
+
+	select {
+	case <-called:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Schedule loaded at startup was not dispatched")
+	}
+
+	// added while the dispatcher is sleeping
+	due := time.Now().Add(300 * time.Millisecond)
+	late := Schedule{Time: due, Status: "PENDING"}
+	db.Create(&late)
+	routes.timers.set(late.ID, late.Time)
+
+	select {
+	case at := <-called:
+		if at.Before(due) {
+			t.Errorf("Schedule fired early at %s, due %s\n", at, due)
+		}
+		if at.After(due.Add(2 * time.Second)) {
+			t.Errorf("Schedule fired late at %s, due %s\n", at, due)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("New schedule was not dispatched")
+	}
+}
@@ -0,0 +1,181 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/jinzhu/gorm"
+)
+
+const defaultInviteTTL = 72 * time.Hour
+
+var errInvalidInvite = errors.New("Invalid or expired invite")
+
+// CreateInvite creates a single use invite for the email form value that
+// expires after expires_in (72h by default). Admins may invite anyone, team
+// owners may invite to their team with the team_id and role (viewer by
+// default) form values. The token is only ever returned here.
+func (routes *Routes) CreateInvite(w http.ResponseWriter, r *http.Request) {
+	user := currentUser(r)
+
+	email := strings.TrimSpace(r.FormValue("email"))
+	if email == "" {
+		writeErrorMessage(w, "Email required", http.StatusBadRequest)
+		return
+	}
+
+	invite := Invite{Email: email, CreatedByID: user.ID}
+
+	if v := strings.TrimSpace(r.FormValue("team_id")); v != "" {
+		teamID, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			writeErrorMessage(w, "Invalid team_id", http.StatusBadRequest)
+			return
+		}
+		invite.TeamID = uint(teamID)
+
+		role, ok := formRole(w, r, RoleViewer)
+		if !ok {
+			return
+		}
+		invite.Role = role
+	}
+
+	if !user.Admin && (invite.TeamID == 0 || routes.teamRole(user.ID, invite.TeamID) != RoleOwner) {
+		writeErrorMessage(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	ttl := defaultInviteTTL
+	if v := strings.TrimSpace(r.FormValue("expires_in")); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			writeErrorMessage(w, "Invalid expires_in. Must be a duration like 72h", http.StatusBadRequest)
+			return
+		}
+		ttl = d
+	}
+	invite.ExpiresAt = time.Now().UTC().Add(ttl)
+
+	token, err := randomToken()
+	if err != nil {
+		writeErrorMessage(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	invite.Token = token
+	invite.TokenHash = hashToken(token)
+
+	if err := routes.db.Create(&invite).Error; err != nil {
+		writeErrorMessage(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	resp, err := json.Marshal(invite)
+	if err != nil {
+		writeErrorMessage(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	w.Write(resp)
+}
+
+// ListInvites returns the invites that have not been revoked, newest first.
+// Admins see every invite, other users those they created and those to the
+// teams they own.
+func (routes *Routes) ListInvites(w http.ResponseWriter, r *http.Request) {
+	user := currentUser(r)
+
+	query := routes.db.Order("id desc")
+	if !user.Admin {
+		teamIDs := []uint{}
+		routes.db.Model(&Membership{}).
+			Where("user_id = ? AND role = ?", user.ID, RoleOwner).
+			Pluck("team_id", &teamIDs)
+
+		if len(teamIDs) > 0 {
+			query = query.Where("created_by_id = ? OR team_id IN (?)", user.ID, teamIDs)
+		} else {
+			query = query.Where("created_by_id = ?", user.ID)
+		}
+	}
+
+	invites := []Invite{}
+	query.Find(&invites)
+
+	b, err := json.Marshal(invites)
+	if err != nil {
+		writeErrorMessage(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Write(b)
+}
+
+// RevokeInvite deletes an invite so its token can no longer be used. Admins,
+// the creator of the invite and the owners of its team may revoke it.
+func (routes *Routes) RevokeInvite(w http.ResponseWriter, r *http.Request) {
+	user := currentUser(r)
+
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	invite := Invite{}
+	routes.db.Where("id = ?", id).First(&invite)
+
+	if invite.ID == 0 {
+		writeErrorMessage(w, "Not Found", http.StatusNotFound)
+		return
+	}
+
+	allowed := user.Admin || invite.CreatedByID == user.ID ||
+		(invite.TeamID != 0 && routes.teamRole(user.ID, invite.TeamID) == RoleOwner)
+	if !allowed {
+		writeErrorMessage(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	routes.db.Delete(&invite)
+}
+
+// redeemInvite creates the user with the invite token, marking the invite
+// used and adding the user to the team of the invite. It returns
+// errInvalidInvite when the token is unknown, used, expired or for another
+// email.
+func (routes *Routes) redeemInvite(token string, u *User) error {
+	invite := Invite{}
+	routes.db.Where("token_hash = ?", hashToken(token)).First(&invite)
+
+	now := time.Now().UTC()
+	if invite.ID == 0 || invite.UsedAt != nil || !invite.ExpiresAt.After(now) ||
+		!strings.EqualFold(invite.Email, u.Email) {
+		return errInvalidInvite
+	}
+
+	return transaction(routes.db, func(tx *gorm.DB) error {
+		// only one registration can use the invite
+		result := tx.Model(&Invite{}).
+			Where("id = ? AND used_at IS NULL", invite.ID).
+			Update("used_at", now)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected != 1 {
+			return errInvalidInvite
+		}
+
+		if err := tx.Create(u).Error; err != nil {
+			return err
+		}
+
+		if invite.TeamID == 0 {
+			return nil
+		}
+		return tx.Create(&Membership{TeamID: invite.TeamID, UserID: u.ID, Role: invite.Role}).Error
+	})
+}
@@ -0,0 +1,178 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func TestInvites(t *testing.T) {
+	// create dummy db
+	db, cleanup := openTestDB(t)
+	defer cleanup()
+
+	routes := NewRoutes(db, []byte{}, &HTTPClient{})
+	routes.MigrateDB()
+	routes.SetRegistration(RegistrationInvite)
+
+	admin := User{Email: "admin@email.com", Name: "admin", Admin: true}
+	owner := User{Email: "owner@email.com", Name: "owner"}
+	editor := User{Email: "editor@email.com", Name: "editor"}
+	for _, u := range []*User{&admin, &owner, &editor} {
+		db.Create(u)
+	}
+
+	team := Team{Name: "deployers"}
+	db.Create(&team)
+	db.Create(&Membership{TeamID: team.ID, UserID: owner.ID, Role: RoleOwner})
+	db.Create(&Membership{TeamID: team.ID, UserID: editor.ID, Role: RoleEditor})
+
+	router := mux.NewRouter()
+	router.HandleFunc("/invites", routes.ListInvites).Methods("GET")
+	router.HandleFunc("/invites", routes.CreateInvite).Methods("POST")
+	router.HandleFunc("/invites/{id}", routes.RevokeInvite).Methods("DELETE")
+	router.HandleFunc("/register", routes.RegisterFunc).Methods("POST")
+
+	createInvite := func(t *testing.T, user User, payload string) Invite {
+		rr := serveAs(router, user, "POST", "/invites", payload)
+		if status := rr.Code; status != http.StatusCreated {
+			t.Fatalf("Incorrect status. Expected: %d, Got: %d\n", http.StatusCreated, status)
+		}
+
+		invite := Invite{}
+		json.NewDecoder(rr.Body).Decode(&invite)
+		return invite
+	}
+
+	register := func(email string, token string) int {
+		payload := "email=" + email + "&password=pw&name=new&invite=" + token
+		return serveAs(router, User{}, "POST", "/register", payload).Code
+	}
+
+	t.Run("who may invite", func(t *testing.T) {
+		testHarness := []struct {
+			testName string
+			user     User
+			payload  string
+			status   int
+		}{
+			{testName: "admin", user: admin, payload: "email=a@email.com", status: http.StatusCreated},
+			{testName: "team owner", user: owner, payload: fmt.Sprintf("email=b@email.com&team_id=%d&role=editor", team.ID), status: http.StatusCreated},
+			{testName: "owner without team", user: owner, payload: "email=c@email.com", status: http.StatusForbidden},
+			{testName: "team editor", user: editor, payload: fmt.Sprintf("email=c@email.com&team_id=%d", team.ID), status: http.StatusForbidden},
+			{testName: "no email", user: admin, payload: "", status: http.StatusBadRequest},
+			{testName: "bad role", user: owner, payload: fmt.Sprintf("email=c@email.com&team_id=%d&role=boss", team.ID), status: http.StatusBadRequest},
+			{testName: "bad expiry", user: admin, payload: "email=c@email.com&expires_in=soon", status: http.StatusBadRequest},
+		}
+
+		for _, th := range testHarness {
+			t.Run(th.testName, func(t *testing.T) {
+				rr := serveAs(router, th.user, "POST", "/invites", th.payload)
+				if status := rr.Code; status != th.status {
+					t.Errorf("Incorrect status. Expected: %d, Got: %d\n", th.status, status)
+				}
+			})
+		}
+	})
+
+	t.Run("tokens are stored hashed", func(t *testing.T) {
+		invite := createInvite(t, admin, "email=hashed@email.com")
+		if invite.Token == "" {
+			t.Fatal("Token not returned")
+		}
+
+		stored := Invite{}
+		db.First(&stored, invite.ID)
+		if stored.TokenHash == "" || stored.TokenHash == invite.Token || stored.TokenHash != hashToken(invite.Token) {
+			t.Errorf("Token not hashed: %s\n", stored.TokenHash)
+		}
+	})
+
+	t.Run("registration requires a valid invite", func(t *testing.T) {
+		invite := createInvite(t, owner, fmt.Sprintf("email=Joiner@email.com&team_id=%d&role=editor", team.ID))
+		expired := createInvite(t, admin, "email=late@email.com&expires_in=1ns")
+		time.Sleep(time.Millisecond)
+
+		testHarness := []struct {
+			testName string
+			email    string
+			token    string
+			status   int
+		}{
+			{testName: "no invite", email: "joiner@email.com", status: http.StatusForbidden},
+			{testName: "unknown invite", email: "joiner@email.com", token: "abc", status: http.StatusForbidden},
+			{testName: "other email", email: "other@email.com", token: invite.Token, status: http.StatusForbidden},
+			{testName: "expired invite", email: "late@email.com", token: expired.Token, status: http.StatusForbidden},
+			{testName: "valid invite", email: "joiner@email.com", token: invite.Token, status: http.StatusCreated},
+			{testName: "used invite", email: "joiner@email.com", token: invite.Token, status: http.StatusBadRequest},
+		}
+
+		for _, th := range testHarness {
+			t.Run(th.testName, func(t *testing.T) {
+				if status := register(th.email, th.token); status != th.status {
+					t.Errorf("Incorrect status. Expected: %d, Got: %d\n", th.status, status)
+				}
+			})
+		}
+
+		u := User{}
+		db.Where("email = ?", "joiner@email.com").First(&u)
+		if role := routes.teamRole(u.ID, team.ID); u.ID == 0 || role != RoleEditor {
+			t.Errorf("Invited user not added to the team: %+v %s\n", u, role)
+		}
+
+		db.First(&invite, invite.ID)
+		if invite.UsedAt == nil {
+			t.Error("Invite not marked used")
+		}
+	})
+
+	t.Run("used invites can not be used again", func(t *testing.T) {
+		invite := createInvite(t, admin, "email=twice@email.com")
+		if status := register("twice@email.com", invite.Token); status != http.StatusCreated {
+			t.Fatalf("Incorrect status. Expected: %d, Got: %d\n", http.StatusCreated, status)
+		}
+
+		// the user is gone but the invite stays used
+		db.Unscoped().Where("email = ?", "twice@email.com").Delete(&User{})
+		if status := register("twice@email.com", invite.Token); status != http.StatusForbidden {
+			t.Errorf("Incorrect status. Expected: %d, Got: %d\n", http.StatusForbidden, status)
+		}
+	})
+
+	t.Run("list and revoke", func(t *testing.T) {
+		invite := createInvite(t, owner, fmt.Sprintf("email=revoked@email.com&team_id=%d", team.ID))
+
+		rr := serveAs(router, editor, "GET", "/invites", "")
+		invites := []Invite{}
+		json.NewDecoder(rr.Body).Decode(&invites)
+		if len(invites) != 0 {
+			t.Errorf("Incorrect number of invites. Expected: %d, Got: %d\n", 0, len(invites))
+		}
+
+		rr = serveAs(router, owner, "GET", "/invites", "")
+		json.NewDecoder(rr.Body).Decode(&invites)
+		if len(invites) != 3 || invites[0].ID != invite.ID || invites[0].Token != "" {
+			t.Errorf("Incorrect invites: %+v\n", invites)
+		}
+
+		path := fmt.Sprintf("/invites/%d", invite.ID)
+		if rr := serveAs(router, editor, "DELETE", path, ""); rr.Code != http.StatusForbidden {
+			t.Errorf("Incorrect status. Expected: %d, Got: %d\n", http.StatusForbidden, rr.Code)
+		}
+		if rr := serveAs(router, owner, "DELETE", path, ""); rr.Code != http.StatusOK {
+			t.Errorf("Incorrect status. Expected: %d, Got: %d\n", http.StatusOK, rr.Code)
+		}
+		if rr := serveAs(router, owner, "DELETE", path, ""); rr.Code != http.StatusNotFound {
+			t.Errorf("Incorrect status. Expected: %d, Got: %d\n", http.StatusNotFound, rr.Code)
+		}
+
+		if status := register("revoked@email.com", invite.Token); status != http.StatusForbidden {
+			t.Errorf("Incorrect status. Expected: %d, Got: %d\n", http.StatusForbidden, status)
+		}
+	})
+}
@@ -0,0 +1,273 @@
+package api
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"sort"
+
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+// signingKey is an RSA or EC key that access tokens are signed or verified
+// with. Verify only keys have no private key.
+type signingKey struct {
+	id      string
+	method  jwt.SigningMethod
+	private interface{}
+	public  interface{}
+}
+
+// keyring holds the key new tokens are signed with and every key tokens are
+// still accepted from, by key id
+type keyring struct {
+	signing *signingKey
+	verify  map[string]*signingKey
+}
+
+// SetSigningKeys signs access tokens with the PEM encoded RSA or EC private
+// key signing instead of the jwt secret, using RS256 or ES256 with the key id
+// in the kid header. Tokens signed with the verify keys, PEM encoded public or
+// private keys, are still accepted so keys can be rotated without logging
+// everyone out. Tokens signed with the jwt secret no longer are.
+func (routes *Routes) SetSigningKeys(signing []byte, verify ...[]byte) error {
+	k, err := parseSigningKey(signing)
+	if err != nil {
+		return fmt.Errorf("Error parsing signing key: %s", err.Error())
+	}
+	if k.private == nil {
+		return errors.New("Error parsing signing key: not a private key")
+	}
+
+	ring := &keyring{signing: k, verify: map[string]*signingKey{k.id: k}}
+	for i, b := range verify {
+		v, err := parseSigningKey(b)
+		if err != nil {
+			return fmt.Errorf("Error parsing verify key %d: %s", i+1, err.Error())
+		}
+		ring.verify[v.id] = v
+	}
+
+	routes.keys = ring
+	return nil
+}
+
+// JWKS publishes the public keys access tokens are verified with as a JSON
+// Web Key Set, for other services to verify our tokens. The set is empty
+// when tokens are signed with the jwt secret.
+func (routes *Routes) JWKS(w http.ResponseWriter, r *http.Request) {
+	set := jwkSet{Keys: []jwk{}}
+	if routes.keys != nil {
+		// the signing key first
+		set.Keys = append(set.Keys, newJWK(routes.keys.signing))
+
+		ids := []string{}
+		for id := range routes.keys.verify {
+			if id != routes.keys.signing.id {
+				ids = append(ids, id)
+			}
+		}
+		sort.Strings(ids)
+		for _, id := range ids {
+			set.Keys = append(set.Keys, newJWK(routes.keys.verify[id]))
+		}
+	}
+
+	b, err := json.Marshal(set)
+	if err != nil {
+		writeErrorMessage(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	w.Write(b)
+}
+
+// parseSigningKey parses a PEM encoded RSA or EC key. Private keys may be
+// PKCS #1, SEC 1 or PKCS #8, public keys PKIX.
+func parseSigningKey(b []byte) (*signingKey, error) {
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, errors.New("no PEM data")
+	}
+
+	var key interface{}
+	var err error
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "PUBLIC KEY":
+		key, err = x509.ParsePKIXPublicKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("unsupported PEM type %s", block.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	k := &signingKey{}
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		k.private, k.public = key, &key.PublicKey
+	case *ecdsa.PrivateKey:
+		k.private, k.public = key, &key.PublicKey
+	case *rsa.PublicKey, *ecdsa.PublicKey:
+		k.public = key
+	default:
+		return nil, errors.New("not an RSA or EC key")
+	}
+
+	switch public := k.public.(type) {
+	case *rsa.PublicKey:
+		if public.N.BitLen() < 2048 {
+			return nil, errors.New("RSA keys must be at least 2048 bits")
+		}
+		k.method = jwt.SigningMethodRS256
+	case *ecdsa.PublicKey:
+		switch public.Curve {
+		case elliptic.P256():
+			k.method = jwt.SigningMethodES256
+		case elliptic.P384():
+			k.method = jwt.SigningMethodES384
+		default:
+			return nil, errors.New("EC keys must be on P-256 or P-384")
+		}
+	}
+
+	k.id = newJWK(k).thumbprint()
+	return k, nil
+}
+
+// jwkSet is a JSON Web Key Set as described in RFC 7517
+type jwkSet struct {
+	Keys []jwk `json:"keys"`
+}
+
+// jwk is a public RSA or EC key of a jwkSet
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use,omitempty"`
+	Alg string `json:"alg,omitempty"`
+	// RSA
+	N string `json:"n,omitempty"`
+	E string `json:"e,omitempty"`
+	// EC
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+// newJWK returns the public jwk of k
+func newJWK(k *signingKey) jwk {
+	b64 := base64.RawURLEncoding.EncodeToString
+	j := jwk{Kid: k.id, Use: "sig", Alg: k.method.Alg()}
+
+	switch public := k.public.(type) {
+	case *rsa.PublicKey:
+		j.Kty = "RSA"
+		j.N = b64(public.N.Bytes())
+		j.E = b64(big.NewInt(int64(public.E)).Bytes())
+	case *ecdsa.PublicKey:
+		// coordinates are padded to the size of the curve, see RFC 7518
+		size := (public.Curve.Params().BitSize + 7) / 8
+		j.Kty = "EC"
+		j.Crv = public.Curve.Params().Name
+		j.X = b64(pad(public.X.Bytes(), size))
+		j.Y = b64(pad(public.Y.Bytes(), size))
+	}
+	return j
+}
+
+// pad left pads b with zeros to size bytes
+func pad(b []byte, size int) []byte {
+	if len(b) >= size {
+		return b
+	}
+	padded := make([]byte, size)
+	copy(padded[size-len(b):], b)
+	return padded
+}
+
+// thumbprint returns the JWK thumbprint of the key as described in RFC 7638,
+// used as its key id
+func (j jwk) thumbprint() string {
+	var canonical string
+	switch j.Kty {
+	case "RSA":
+		canonical = fmt.Sprintf(`{"e":%q,"kty":"RSA","n":%q}`, j.E, j.N)
+	case "EC":
+		canonical = fmt.Sprintf(`{"crv":%q,"kty":"EC","x":%q,"y":%q}`, j.Crv, j.X, j.Y)
+	}
+
+	sum := sha256.Sum256([]byte(canonical))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// publicKey returns the *rsa.PublicKey or *ecdsa.PublicKey of the jwk
+func (j jwk) publicKey() (interface{}, error) {
+	if j.Use != "" && j.Use != "sig" {
+		return nil, fmt.Errorf("Key is for %s", j.Use)
+	}
+
+	switch j.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(j.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(j.E)
+		if err != nil {
+			return nil, err
+		}
+		if len(n) == 0 || len(e) == 0 || len(e) > 4 {
+			return nil, errors.New("Invalid RSA key")
+		}
+		return &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}, nil
+
+	case "EC":
+		var curve elliptic.Curve
+		switch j.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("Unsupported curve: %s", j.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(j.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := base64.RawURLEncoding.DecodeString(j.Y)
+		if err != nil {
+			return nil, err
+		}
+		k := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !curve.IsOnCurve(k.X, k.Y) {
+			return nil, errors.New("Invalid EC key")
+		}
+		return k, nil
+	}
+
+	return nil, fmt.Errorf("Unsupported key type: %s", j.Kty)
+}
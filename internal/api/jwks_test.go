@@ -0,0 +1,266 @@
+package api
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/gorilla/mux"
+)
+
+// pemKey PEM encodes a private key, or only its public key
+func pemKey(t *testing.T, key interface{}, public bool) []byte {
+	if public {
+		var pub interface{}
+		switch key := key.(type) {
+		case *rsa.PrivateKey:
+			pub = &key.PublicKey
+		case *ecdsa.PrivateKey:
+			pub = &key.PublicKey
+		}
+		b, err := x509.MarshalPKIXPublicKey(pub)
+		if err != nil {
+			t.Fatalf("Error encoding key: %s\n", err.Error())
+		}
+		return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: b})
+	}
+
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		return pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	case *ecdsa.PrivateKey:
+		b, _ := x509.MarshalECPrivateKey(key)
+		return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: b})
+	}
+	return nil
+}
+
+func TestJWKThumbprint(t *testing.T) {
+	// the example of RFC 7638
+	j := jwk{
+		Kty: "RSA",
+		N:   "0vx7agoebGcQSuuPiLJXZptN9nndrQmbXEps2aiAFbWhM78LhWx4cbbfAAtVT86zwu1RK7aPFFxuhDR1L6tSoc_BJECPebWKRXjBZCiFV4n3oknjhMstn64tZ_2W-5JsGY4Hc5n9yBXArwl93lqt7_RN5w6Cf0h4QyQ5v-65YGjQR0_FDW2QvzqY368QQMicAtaSqzs8KJZgnYb9c7d0zgdAZHzu6qMQvRL5hajrn1n91CbOpbISD08qNLyrdkt-bFTWhAI4vMQFh6WeZu0fM4lFd2NcRwr3XPksINHaQ-G_xBniIqbw0Ls1jF44-csFCur-kEgU8awapJzKnqDKgw",
+		E:   "AQAB",
+	}
+
+	expected := "NzbLsXh8uDCcd-6MNwXF4W_7noWXFZAfHkxZsRGC9Xs"
+	if kid := j.thumbprint(); kid != expected {
+		t.Errorf("Incorrect thumbprint. Expected: %s, Got: %s\n", expected, kid)
+	}
+}
+
+func TestParseSigningKey(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	smallKey, _ := rsa.GenerateKey(rand.Reader, 1024)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	p521Key, _ := ecdsa.GenerateKey(elliptic.P521(), rand.Reader)
+	pkcs8, _ := x509.MarshalPKCS8PrivateKey(ecKey)
+
+	testHarness := []struct {
+		testName string
+		pem      []byte
+		alg      string
+		private  bool
+		valid    bool
+	}{
+		{testName: "rsa", pem: pemKey(t, rsaKey, false), alg: "RS256", private: true, valid: true},
+		{testName: "rsa public", pem: pemKey(t, rsaKey, true), alg: "RS256", valid: true},
+		{testName: "ec", pem: pemKey(t, ecKey, false), alg: "ES256", private: true, valid: true},
+		{testName: "ec public", pem: pemKey(t, ecKey, true), alg: "ES256", valid: true},
+		{testName: "pkcs8", pem: pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: pkcs8}), alg: "ES256", private: true, valid: true},
+		{testName: "small rsa", pem: pemKey(t, smallKey, false), valid: false},
+		{testName: "p521", pem: pemKey(t, p521Key, false), valid: false},
+		{testName: "not pem", pem: []byte("secret"), valid: false},
+		{testName: "certificate", pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: []byte{1}}), valid: false},
+	}
+
+	for _, th := range testHarness {
+		t.Run(th.testName, func(t *testing.T) {
+			k, err := parseSigningKey(th.pem)
+			if (err == nil) != th.valid {
+				t.Fatalf("Incorrect validity. Expected: %t, Got: %v\n", th.valid, err)
+			}
+			if !th.valid {
+				return
+			}
+			if k.method.Alg() != th.alg || (k.private != nil) != th.private {
+				t.Errorf("Incorrect key. Expected: %s %t, Got: %s %t\n", th.alg, th.private, k.method.Alg(), k.private != nil)
+			}
+		})
+	}
+}
+
+func TestSigningKeys(t *testing.T) {
+	// create dummy db
+	db, cleanup := openTestDB(t)
+	defer cleanup()
+
+	routes := NewRoutes(db, []byte("secret"), &HTTPClient{})
+	routes.MigrateDB()
+
+	u := User{Email: "me@email.com", Name: "me", Hash: hashPassword("pw")}
+	db.Create(&u)
+
+	router := mux.NewRouter()
+	router.HandleFunc("/login", routes.LoginFunc).Methods("POST")
+	router.HandleFunc("/.well-known/jwks.json", routes.JWKS).Methods("GET")
+	a := router.PathPrefix("/").Subrouter()
+	a.Use(routes.AuthMiddleware)
+	a.HandleFunc("/me", routes.Me).Methods("GET")
+
+	login := func(t *testing.T) string {
+		rr := serveAs(router, User{}, "POST", "/login", "email=me@email.com&password=pw")
+		if rr.Code != http.StatusOK {
+			t.Fatalf("Incorrect status. Expected: %d, Got: %d\n", http.StatusOK, rr.Code)
+		}
+		body, _ := ioutil.ReadAll(rr.Body)
+		return string(body)
+	}
+
+	me := func(token string) int {
+		req, _ := http.NewRequest("GET", "/me", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	jwks := func(t *testing.T) jwkSet {
+		rr := serveAs(router, User{}, "GET", "/.well-known/jwks.json", "")
+		set := jwkSet{}
+		if err := json.NewDecoder(rr.Body).Decode(&set); err != nil {
+			t.Fatalf("Error decoding jwks: %s\n", err.Error())
+		}
+		return set
+	}
+
+	hmacToken := login(t)
+	if set := jwks(t); len(set.Keys) != 0 {
+		t.Errorf("Incorrect number of keys. Expected: %d, Got: %d\n", 0, len(set.Keys))
+	}
+
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	if err := routes.SetSigningKeys(pemKey(t, rsaKey, false)); err != nil {
+		t.Fatalf("Error setting signing keys: %s\n", err.Error())
+	}
+	rsaToken := login(t)
+
+	t.Run("tokens are signed with the key", func(t *testing.T) {
+		token, _, _ := new(jwt.Parser).ParseUnverified(rsaToken, jwt.MapClaims{})
+		if token.Method.Alg() != "RS256" || token.Header["kid"] != routes.keys.signing.id {
+			t.Errorf("Incorrect header: %v\n", token.Header)
+		}
+		if status := me(rsaToken); status != http.StatusOK {
+			t.Errorf("Incorrect status. Expected: %d, Got: %d\n", http.StatusOK, status)
+		}
+		if status := me(hmacToken); status != http.StatusUnauthorized {
+			t.Errorf("Incorrect status. Expected: %d, Got: %d\n", http.StatusUnauthorized, status)
+		}
+	})
+
+	t.Run("other services verify tokens with the jwks", func(t *testing.T) {
+		set := jwks(t)
+		if len(set.Keys) != 1 || set.Keys[0].Alg != "RS256" || set.Keys[0].Use != "sig" {
+			t.Fatalf("Incorrect keys: %+v\n", set.Keys)
+		}
+
+		claims := accessClaims{}
+		_, err := jwt.ParseWithClaims(rsaToken, &claims, func(token *jwt.Token) (interface{}, error) {
+			for _, k := range set.Keys {
+				if k.Kid == token.Header["kid"] {
+					return k.publicKey()
+				}
+			}
+			return nil, nil
+		})
+		if err != nil || claims.Email != "me@email.com" {
+			t.Errorf("Error verifying token: %v %+v\n", err, claims)
+		}
+	})
+
+	t.Run("rotation", func(t *testing.T) {
+		// sign with the ec key, still accepting the rsa key
+		if err := routes.SetSigningKeys(pemKey(t, ecKey, false), pemKey(t, rsaKey, true)); err != nil {
+			t.Fatalf("Error setting signing keys: %s\n", err.Error())
+		}
+		ecToken := login(t)
+
+		token, _, _ := new(jwt.Parser).ParseUnverified(ecToken, jwt.MapClaims{})
+		if token.Method.Alg() != "ES256" {
+			t.Errorf("Incorrect alg. Expected: %s, Got: %s\n", "ES256", token.Method.Alg())
+		}
+		for _, token := range []string{ecToken, rsaToken} {
+			if status := me(token); status != http.StatusOK {
+				t.Errorf("Incorrect status. Expected: %d, Got: %d\n", http.StatusOK, status)
+			}
+		}
+
+		set := jwks(t)
+		if len(set.Keys) != 2 || set.Keys[0].Alg != "ES256" || set.Keys[1].Alg != "RS256" {
+			t.Errorf("Incorrect keys: %+v\n", set.Keys)
+		}
+
+		// dropping the rsa key drops its tokens
+		routes.SetSigningKeys(pemKey(t, ecKey, false))
+		if status := me(rsaToken); status != http.StatusUnauthorized {
+			t.Errorf("Incorrect status. Expected: %d, Got: %d\n", http.StatusUnauthorized, status)
+		}
+	})
+
+	t.Run("only access tokens are for other services", func(t *testing.T) {
+		token, _, _ := new(jwt.Parser).ParseUnverified(login(t), &accessClaims{})
+		claims := token.Claims.(*accessClaims)
+		if claims.Issuer != defaultIssuer || claims.Audience != accessAudience {
+			t.Errorf("Incorrect claims: %+v\n", claims)
+		}
+
+		// the token of a login waiting for its second factor is not published
+		mfa, _ := routes.signClaims(accessClaims{Email: "me@email.com"}, mfaAudience, time.Minute)
+		token, _, _ = new(jwt.Parser).ParseUnverified(mfa, &accessClaims{})
+		if token.Method.Alg() != "HS256" {
+			t.Errorf("Incorrect alg. Expected: %s, Got: %s\n", "HS256", token.Method.Alg())
+		}
+		if status := me(mfa); status != http.StatusUnauthorized {
+			t.Errorf("Incorrect status. Expected: %d, Got: %d\n", http.StatusUnauthorized, status)
+		}
+
+		routes.SetIssuer("https://other.example.com")
+		other := login(t)
+		routes.SetIssuer(defaultIssuer)
+		if status := me(other); status != http.StatusUnauthorized {
+			t.Errorf("Incorrect status. Expected: %d, Got: %d\n", http.StatusUnauthorized, status)
+		}
+	})
+
+	t.Run("algs must match the key", func(t *testing.T) {
+		// an hmac token using the public key as the secret
+		claims := accessClaims{Email: "me@email.com"}
+		claims.ExpiresAt = 4102444800
+		token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+		token.Header["kid"] = routes.keys.signing.id
+		forged, _ := token.SignedString(pemKey(t, ecKey, true))
+
+		if _, err := routes.parseJWT(forged); err == nil {
+			t.Errorf("Forged token accepted\n")
+		}
+	})
+
+	t.Run("public keys can not sign", func(t *testing.T) {
+		if err := routes.SetSigningKeys(pemKey(t, ecKey, true)); err == nil {
+			t.Errorf("Public signing key accepted\n")
+		}
+	})
+}
@@ -0,0 +1,184 @@
+package api
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+const leaderLeaseName = "scheduler"
+
+// Elector takes part in electing the replica that dispatches schedules. The
+// leader holds a LeaderLease row in the db and renews it on every heartbeat,
+// the other replicas keep trying to take the lease over once it expires.
+// Every replica serves the api regardless.
+type Elector struct {
+	db  *gorm.DB
+	id  string
+	ttl time.Duration
+
+	mu      sync.Mutex
+	leader  bool
+	holder  string
+	changed chan struct{}
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+type statusMessage struct {
+	Message  string `json:"message"`
+	Instance string `json:"instance"`
+	Leader   string `json:"leader"`
+	IsLeader bool   `json:"is_leader"`
+}
+
+// NewElector creates an Elector for the server of routes. The leader lease is
+// valid for ttl after each heartbeat.
+func NewElector(routes *Routes, ttl time.Duration) *Elector {
+	return &Elector{
+		db:      routes.db,
+		id:      routes.instanceID,
+		ttl:     ttl,
+		changed: make(chan struct{}, 1),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+}
+
+// Run sends a heartbeat every third of the ttl until the Elector is stopped
+func (e *Elector) Run() {
+	defer close(e.done)
+
+	ticker := time.NewTicker(e.ttl / 3)
+	defer ticker.Stop()
+
+	for {
+		if err := e.heartbeat(); err != nil {
+			log.Printf("Error renewing leader lease: %s\n", err.Error())
+			e.setLeader(false, "")
+		}
+
+		select {
+		case <-ticker.C:
+		case <-e.stop:
+			e.release()
+			return
+		}
+	}
+}
+
+// Stop ends the heartbeat and gives up the lease if this replica holds it,
+// so another replica can take over without waiting for it to expire
+func (e *Elector) Stop() {
+	close(e.stop)
+	<-e.done
+}
+
+// IsLeader reports whether this replica currently holds the leader lease
+func (e *Elector) IsLeader() bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	return e.leader
+}
+
+// Leader returns the instance id of the current leader as of the last
+// heartbeat
+func (e *Elector) Leader() string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	return e.holder
+}
+
+// Status reports that the server is up along with which replica is leader
+func (e *Elector) Status(w http.ResponseWriter, r *http.Request) {
+	e.mu.Lock()
+	s := statusMessage{
+		Message:  "We're up doc",
+		Instance: e.id,
+		Leader:   e.holder,
+		IsLeader: e.leader,
+	}
+	e.mu.Unlock()
+
+	b, err := json.Marshal(s)
+	if err != nil {
+		writeErrorMessage(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+// heartbeat renews the lease if this replica holds it, or takes it when it
+// is free or expired. The conditional update makes sure only one replica
+// can win.
+func (e *Elector) heartbeat() error {
+	now := time.Now().UTC()
+
+	result := e.db.Model(&LeaderLease{}).
+		Where("name = ? AND (holder = ? OR expires_at < ?)", leaderLeaseName, e.id, now).
+		Updates(map[string]interface{}{
+			"holder":     e.id,
+			"expires_at": now.Add(e.ttl),
+		})
+	if result.Error != nil {
+		return result.Error
+	}
+
+	lease := LeaderLease{}
+	err := e.db.Where("name = ?", leaderLeaseName).First(&lease).Error
+	if gorm.IsRecordNotFoundError(err) {
+		// first replica to start, losing the race to insert just means
+		// another replica is leader
+		lease = LeaderLease{Name: leaderLeaseName, Holder: e.id, ExpiresAt: now.Add(e.ttl)}
+		if err = e.db.Create(&lease).Error; err != nil {
+			err = e.db.Where("name = ?", leaderLeaseName).First(&lease).Error
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	e.setLeader(lease.Holder == e.id && lease.ExpiresAt.After(now), lease.Holder)
+	return nil
+}
+
+func (e *Elector) release() {
+	err := e.db.Model(&LeaderLease{}).
+		Where("name = ? AND holder = ?", leaderLeaseName, e.id).
+		Update("expires_at", time.Now().UTC()).Error
+	if err != nil {
+		log.Printf("Error releasing leader lease: %s\n", err.Error())
+	}
+	e.setLeader(false, "")
+}
+
+func (e *Elector) setLeader(leader bool, holder string) {
+	e.mu.Lock()
+	changed := e.leader != leader
+	e.leader = leader
+	e.holder = holder
+	e.mu.Unlock()
+
+	if !changed {
+		return
+	}
+
+	if leader {
+		log.Println("Elected leader, dispatching schedules")
+	} else {
+		log.Println("Not the leader, only serving the api")
+	}
+
+	select {
+	case e.changed <- struct{}{}:
+	default:
+	}
+}
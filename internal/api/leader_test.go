@@ -0,0 +1,159 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestElector(t *testing.T) {
+	// create dummy db
+	db, cleanup := openTestDB(t)
+	defer cleanup()
+
+	first := NewRoutes(db, []byte{}, &HTTPClient{})
+	second := NewRoutes(db, []byte{}, &HTTPClient{})
+	first.MigrateDB()
+
+	firstElector := NewElector(first, time.Minute)
+	secondElector := NewElector(second, time.Minute)
+
+	t.Run("first replica becomes leader", func(t *testing.T) {
+		if err := firstElector.heartbeat(); err != nil {
+			t.Fatal("Error sending heartbeat: ", err.Error())
+		}
+		if err := secondElector.heartbeat(); err != nil {
+			t.Fatal("Error sending heartbeat: ", err.Error())
+		}
+
+		if !firstElector.IsLeader() || secondElector.IsLeader() {
+			t.Errorf("Incorrect leaders. First: %t, Second: %t\n", firstElector.IsLeader(), secondElector.IsLeader())
+		}
+
+		if secondElector.Leader() != first.instanceID {
+			t.Errorf("Incorrect leader. Expected: %s, Got: %s\n", first.instanceID, secondElector.Leader())
+		}
+	})
+
+	t.Run("leader renews lease", func(t *testing.T) {
+		firstElector.heartbeat()
+		secondElector.heartbeat()
+
+		if !firstElector.IsLeader() || secondElector.IsLeader() {
+			t.Error("Leadership changed while lease was held")
+		}
+	})
+
+	t.Run("expired lease is taken over", func(t *testing.T) {
+		db.Model(&LeaderLease{}).Where("name = ?", leaderLeaseName).Update("expires_at", time.Now().Add(-1*time.Second))
+
+		secondElector.heartbeat()
+		firstElector.heartbeat()
+
+		if firstElector.IsLeader() || !secondElector.IsLeader() {
+			t.Errorf("Lease not taken over. First: %t, Second: %t\n", firstElector.IsLeader(), secondElector.IsLeader())
+		}
+	})
+
+	t.Run("status shows leader", func(t *testing.T) {
+		req, _ := http.NewRequest("GET", "/status", nil)
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(firstElector.Status).ServeHTTP(rr, req)
+
+		s := statusMessage{}
+		json.NewDecoder(rr.Body).Decode(&s)
+		if s.Leader != second.instanceID || s.Instance != first.instanceID || s.IsLeader {
+			t.Errorf("Incorrect status: %+v\n", s)
+		}
+	})
+
+	t.Run("stopping releases the lease", func(t *testing.T) {
+		go secondElector.Run()
+		// wait for the first heartbeat of the loop
+		time.Sleep(50 * time.Millisecond)
+		secondElector.Stop()
+
+		firstElector.heartbeat()
+		if !firstElector.IsLeader() {
+			t.Error("Lease was not released on stop")
+		}
+	})
+}
+
+func TestDispatcherFollower(t *testing.T) {
+	// create dummy db
+	db, cleanup := openTestDB(t)
+	defer cleanup()
+
+	called := make(chan struct{}, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called <- struct{}{}
+		w.Write([]byte(`OK`))
+	}))
+	defer server.Close()
+
+	routes := NewRoutes(db, []byte{}, NewHTTPClient(server.URL, time.Minute))
+	routes.MigrateDB()
+
+	db.Create(&LeaderLease{Name: leaderLeaseName, Holder: "other-replica", ExpiresAt: time.Now().Add(time.Hour)})
+	db.Create(&Schedule{Time: time.Now().Add(-1 * time.Minute), Status: "PENDING"})
+
+	elector := NewElector(routes, time.Minute)
+	elector.heartbeat()
+
+	d := NewDispatcher(routes, elector, 1, 0)
+	defer d.Stop()
+	go d.Run(time.Hour)
+
+	select {
+	case <-called:
+		t.Fatal("Follower dispatched a schedule")
+	case <-time.After(300 * time.Millisecond):
+	}
+
+	// the other replica goes away
+	db.Model(&LeaderLease{}).Where("name = ?", leaderLeaseName).Update("expires_at", time.Now().Add(-1*time.Second))
+	elector.heartbeat()
+
+	select {
+	case <-called:
+	case <-time.After(5 * time.Second):
+		t.Fatal("New leader did not dispatch the schedule")
+	}
+}
+
+func TestDispatcherDueCheck(t *testing.T) {
+	// create dummy db
+	db, cleanup := openTestDB(t)
+	defer cleanup()
+
+	called := make(chan struct{}, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called <- struct{}{}
+		w.Write([]byte(`OK`))
+	}))
+	defer server.Close()
+
+	routes := NewRoutes(db, []byte{}, NewHTTPClient(server.URL, time.Minute))
+	routes.MigrateDB()
+
+	elector := NewElector(routes, time.Minute)
+	elector.heartbeat()
+
+	d := NewDispatcher(routes, elector, 1, 0)
+	d.dueCheck = 50 * time.Millisecond
+	defer d.Stop()
+	go d.Run(time.Hour)
+
+	// created on another replica, so the timer queue of the leader misses it
+	time.Sleep(100 * time.Millisecond)
+	db.Create(&Schedule{Time: time.Now().Add(-1 * time.Second), Status: "PENDING"})
+
+	select {
+	case <-called:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Leader did not dispatch the schedule created elsewhere")
+	}
+}
@@ -0,0 +1,79 @@
+package api
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// leaseMargin is added to the request timeout so a lease outlives the call
+// it covers
+const leaseMargin = time.Minute
+
+// defaultLease is used when requests have no timeout
+const defaultLease = 10 * time.Minute
+
+// newInstanceID builds an id for this server, unique across restarts and
+// replicas, used as the owner of leases
+func newInstanceID() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+
+	b := make([]byte, 4)
+	rand.Read(b)
+	return fmt.Sprintf("%s-%d-%s", host, os.Getpid(), hex.EncodeToString(b))
+}
+
+// leaseDuration is how long a claimed schedule stays RUNNING before other
+// workers consider the claim stale and may take it over
+func (r *Routes) leaseDuration() time.Duration {
+	if r.httpClient == nil || r.httpClient.client == nil || r.httpClient.client.Timeout == 0 {
+		return defaultLease
+	}
+	return r.httpClient.client.Timeout + leaseMargin
+}
+
+// claim marks the schedules of a job as RUNNING under a lease owned by this
+// instance. The update only succeeds while a schedule is still due and not
+// leased by anyone else, or its lease expired, so each run is claimed by
+// exactly one worker even with several servers sharing the db. Only the
+// schedules that were claimed are returned.
+func (r *Routes) claim(job []Schedule) []Schedule {
+	now := time.Now().UTC()
+	expires := now.Add(r.leaseDuration())
+
+	claimed := []Schedule{}
+	for _, s := range job {
+		result := r.db.Model(&Schedule{}).
+			Where("id = ?", s.ID).
+			Where("(status IN (?) AND time <= ?) OR (status = ? AND lease_expires_at < ?)",
+				[]string{"PENDING", "RETRYING"}, now, "RUNNING", now).
+			Updates(map[string]interface{}{
+				"status":           "RUNNING",
+				"lease_owner":      r.instanceID,
+				"lease_expires_at": expires,
+				"version":          gorm.Expr("version + 1"),
+			})
+		if result.Error != nil {
+			log.Printf("Error claiming schedule %d: %s\n", s.ID, result.Error.Error())
+			continue
+		}
+		if result.RowsAffected != 1 {
+			continue
+		}
+
+		s.Status = "RUNNING"
+		s.LeaseOwner = r.instanceID
+		s.LeaseExpiresAt = &expires
+		claimed = append(claimed, s)
+	}
+
+	return claimed
+}
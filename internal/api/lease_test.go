@@ -0,0 +1,135 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestClaim(t *testing.T) {
+	// create dummy db
+	db, cleanup := openTestDB(t)
+	defer cleanup()
+
+	// two servers sharing the same db
+	first := NewRoutes(db, []byte{}, &HTTPClient{})
+	second := NewRoutes(db, []byte{}, &HTTPClient{})
+	first.MigrateDB()
+
+	t.Run("only one instance claims a schedule", func(t *testing.T) {
+		s := Schedule{Time: time.Now().Add(-1 * time.Minute), Status: "PENDING"}
+		db.Create(&s)
+
+		if claimed := first.claim([]Schedule{s}); len(claimed) != 1 {
+			t.Fatal("First claim failed")
+		}
+
+		if claimed := second.claim([]Schedule{s}); len(claimed) != 0 {
+			t.Error("Schedule claimed twice")
+		}
+
+		db.First(&s, s.ID)
+		if s.Status != "RUNNING" || s.LeaseOwner != first.instanceID || s.LeaseExpiresAt == nil {
+			t.Errorf("Lease not saved: %+v\n", s)
+		}
+	})
+
+	t.Run("schedules not due are not claimed", func(t *testing.T) {
+		s := Schedule{Time: time.Now().Add(time.Hour), Status: "PENDING"}
+		db.Create(&s)
+
+		if claimed := first.claim([]Schedule{s}); len(claimed) != 0 {
+			t.Error("Future schedule claimed")
+		}
+	})
+
+	t.Run("stale lease is reclaimed", func(t *testing.T) {
+		expired := time.Now().Add(-1 * time.Second)
+		s := Schedule{
+			Time:           time.Now().Add(-1 * time.Minute),
+			Status:         "RUNNING",
+			LeaseOwner:     "crashed-server",
+			LeaseExpiresAt: &expired,
+		}
+		db.Create(&s)
+
+		jobs, _ := second.dueJobs(s.ID)
+		if len(jobs) != 1 {
+			t.Fatal("Stale schedule not due")
+		}
+
+		if claimed := second.claim(jobs[0]); len(claimed) != 1 {
+			t.Fatal("Stale lease not reclaimed")
+		}
+
+		// the crashed server coming back can't save over the new lease
+		crashed := NewRoutes(db, []byte{}, &HTTPClient{})
+		crashed.instanceID = "crashed-server"
+		crashed.saveStatus([]Schedule{s}, Execution{}, nil)
+
+		db.First(&s, s.ID)
+		if s.Status != "RUNNING" || s.LeaseOwner != second.instanceID {
+			t.Errorf("Lease overwritten: %+v\n", s)
+		}
+
+		// nor record its run, the new owner records its own
+		count := -1
+		db.Model(&Execution{}).Where("schedule_id = ?", s.ID).Count(&count)
+		if count != 0 {
+			t.Errorf("Incorrect number of executions. Expected: %d, Got: %d\n", 0, count)
+		}
+
+		second.saveStatus([]Schedule{s}, Execution{}, nil)
+		db.Model(&Execution{}).Where("schedule_id = ?", s.ID).Count(&count)
+		if count != 1 {
+			t.Errorf("Incorrect number of executions. Expected: %d, Got: %d\n", 1, count)
+		}
+	})
+}
+
+func TestConcurrentCheckSchedules(t *testing.T) {
+	// create dummy db
+	db, cleanup := openTestDB(t)
+	defer cleanup()
+
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		time.Sleep(10 * time.Millisecond)
+		w.Write([]byte(`OK`))
+	}))
+	defer server.Close()
+
+	instances := []*Routes{}
+	for i := 0; i < 4; i++ {
+		instances = append(instances, NewRoutes(db, []byte{}, NewHTTPClient(server.URL, time.Minute)))
+	}
+	instances[0].MigrateDB()
+
+	for i := 0; i < 10; i++ {
+		db.Create(&Schedule{Time: time.Now().Add(-1 * time.Minute), Status: "PENDING"})
+	}
+
+	var wg sync.WaitGroup
+	for _, routes := range instances {
+		wg.Add(1)
+		go func(routes *Routes) {
+			defer wg.Done()
+			routes.CheckSchedules()
+		}(routes)
+	}
+	wg.Wait()
+
+	if calls != 10 {
+		t.Errorf("Schedules fired more than once. Expected: 10 calls, Got: %d\n", calls)
+	}
+
+	var sent int
+	db.Model(&Schedule{}).Where("status = ?", "SENT").Count(&sent)
+	if sent != 10 {
+		t.Errorf("Incorrect number of sent schedules. Expected: 10, Got: %d\n", sent)
+	}
+}
@@ -0,0 +1,206 @@
+package api
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// LoginLimits configure how failed logins are limited, see SetLoginLimits. A
+// count of 0 turns that limit off.
+type LoginLimits struct {
+	// Window is how far back failed logins are counted
+	Window time.Duration
+	// IPFailures is how many failed logins an IP may make in Window
+	IPFailures int
+	// AccountFailures is how many failed logins an account may have in
+	// Window before it is locked
+	AccountFailures int
+	// Lockout is how long the first lockout lasts. Every further lockout
+	// without a successful login in between lasts twice as long, up to
+	// MaxLockout.
+	Lockout    time.Duration
+	MaxLockout time.Duration
+}
+
+// DefaultLoginLimits are the LoginLimits of NewRoutes
+var DefaultLoginLimits = LoginLimits{
+	Window:          15 * time.Minute,
+	IPFailures:      50,
+	AccountFailures: 5,
+	Lockout:         time.Minute,
+	MaxLockout:      time.Hour,
+}
+
+// SetLoginLimits replaces the login limits, forgetting past failures
+func (routes *Routes) SetLoginLimits(limits LoginLimits) {
+	routes.limiter = newLoginLimiter(limits)
+}
+
+// loginLimiter counts failed logins per IP and per account in a sliding
+// window. It is kept in memory, so every replica limits on its own.
+type loginLimiter struct {
+	mu       sync.Mutex
+	limits   LoginLimits
+	now      func() time.Time
+	ips      map[string][]time.Time
+	accounts map[string]*accountFailures
+	swept    time.Time
+}
+
+type accountFailures struct {
+	failures    []time.Time
+	lockouts    int // in a row, without a successful login in between
+	lockedUntil time.Time
+}
+
+func newLoginLimiter(limits LoginLimits) *loginLimiter {
+	return &loginLimiter{
+		limits:   limits,
+		now:      time.Now,
+		ips:      map[string][]time.Time{},
+		accounts: map[string]*accountFailures{},
+	}
+}
+
+// wait returns how long the ip or account has to wait before trying to log in
+// again, 0 when they may try now
+func (l *loginLimiter) wait(ip string, account string) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	l.sweep(now)
+
+	var wait time.Duration
+	if a, ok := l.accounts[account]; ok && a.lockedUntil.After(now) {
+		wait = a.lockedUntil.Sub(now)
+	}
+
+	if l.limits.IPFailures > 0 {
+		failures := l.recent(l.ips[ip], now)
+		l.ips[ip] = failures
+		if len(failures) >= l.limits.IPFailures {
+			// wait until enough failures have left the window
+			oldest := failures[len(failures)-l.limits.IPFailures]
+			if d := oldest.Add(l.limits.Window).Sub(now); d > wait {
+				wait = d
+			}
+		}
+	}
+
+	return wait
+}
+
+// fail records a failed login. It returns how long the account is locked for
+// when this failure locked it, 0 otherwise.
+func (l *loginLimiter) fail(ip string, account string) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+
+	if l.limits.IPFailures > 0 {
+		l.ips[ip] = append(l.recent(l.ips[ip], now), now)
+	}
+
+	if l.limits.AccountFailures == 0 {
+		return 0
+	}
+
+	a, ok := l.accounts[account]
+	if !ok {
+		a = &accountFailures{}
+		l.accounts[account] = a
+	}
+	a.failures = append(l.recent(a.failures, now), now)
+	if len(a.failures) < l.limits.AccountFailures {
+		return 0
+	}
+
+	lockout := l.lockout(a.lockouts)
+	a.failures = nil
+	a.lockouts++
+	a.lockedUntil = now.Add(lockout)
+	return lockout
+}
+
+// hit counts a request from the ip like a failed login without touching any
+// account, for routes that are not logins but shouldn't be called without
+// limit either
+func (l *loginLimiter) hit(ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.limits.IPFailures > 0 {
+		now := l.now()
+		l.ips[ip] = append(l.recent(l.ips[ip], now), now)
+	}
+}
+
+// succeed forgets the failed logins and lockouts of the account
+func (l *loginLimiter) succeed(account string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	delete(l.accounts, account)
+}
+
+// lockout returns the length of a lockout after previous lockouts in a row
+func (l *loginLimiter) lockout(previous int) time.Duration {
+	d := float64(l.limits.Lockout) * math.Pow(2, float64(previous))
+	if l.limits.MaxLockout > 0 && d > float64(l.limits.MaxLockout) {
+		return l.limits.MaxLockout
+	}
+	return time.Duration(d)
+}
+
+// recent drops the failures that are out of the window
+func (l *loginLimiter) recent(failures []time.Time, now time.Time) []time.Time {
+	start := now.Add(-l.limits.Window)
+	for len(failures) > 0 && !failures[0].After(start) {
+		failures = failures[1:]
+	}
+	return failures
+}
+
+// sweep forgets IPs without recent failures and accounts that have been left
+// alone for MaxLockout since their last lockout. It runs at most once per
+// window.
+func (l *loginLimiter) sweep(now time.Time) {
+	if now.Sub(l.swept) < l.limits.Window {
+		return
+	}
+	l.swept = now
+
+	for ip, failures := range l.ips {
+		if len(l.recent(failures, now)) == 0 {
+			delete(l.ips, ip)
+		}
+	}
+
+	for account, a := range l.accounts {
+		if len(l.recent(a.failures, now)) == 0 && now.After(a.lockedUntil.Add(l.limits.MaxLockout)) {
+			delete(l.accounts, account)
+		}
+	}
+}
+
+// clientIP returns the IP of the caller, without the port
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// writeTooManyRequests writes a 429 telling the caller to retry after wait
+func writeTooManyRequests(w http.ResponseWriter, wait time.Duration) {
+	seconds := int(math.Ceil(wait.Seconds()))
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	writeErrorMessage(w, "Too many failed logins. Try again in "+strconv.Itoa(seconds)+"s", http.StatusTooManyRequests)
+}
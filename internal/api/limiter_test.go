@@ -0,0 +1,217 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testClock is a clock for the limiter that only moves when told to
+type testClock struct {
+	now time.Time
+}
+
+func (c *testClock) Now() time.Time {
+	return c.now
+}
+
+func (c *testClock) Add(d time.Duration) {
+	c.now = c.now.Add(d)
+}
+
+func TestLoginLimiter(t *testing.T) {
+	limits := LoginLimits{
+		Window:          time.Minute,
+		IPFailures:      5,
+		AccountFailures: 3,
+		Lockout:         time.Minute,
+		MaxLockout:      3 * time.Minute,
+	}
+
+	newLimiter := func() (*loginLimiter, *testClock) {
+		clock := &testClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+		l := newLoginLimiter(limits)
+		l.now = clock.Now
+		return l, clock
+	}
+
+	t.Run("lockouts back off exponentially", func(t *testing.T) {
+		l, clock := newLimiter()
+
+		testHarness := []struct {
+			testName string
+			lockout  time.Duration
+		}{
+			{testName: "first lockout", lockout: time.Minute},
+			{testName: "second lockout", lockout: 2 * time.Minute},
+			{testName: "capped lockout", lockout: 3 * time.Minute},
+		}
+
+		for i, th := range testHarness {
+			t.Run(th.testName, func(t *testing.T) {
+				ip := fmt.Sprintf("10.0.0.%d", i)
+				l.fail(ip, "me")
+				l.fail(ip, "me")
+				if lockout := l.fail(ip, "me"); lockout != th.lockout {
+					t.Fatalf("Incorrect lockout. Expected: %s, Got: %s\n", th.lockout, lockout)
+				}
+
+				clock.Add(th.lockout - time.Second)
+				if wait := l.wait(ip, "me"); wait != time.Second {
+					t.Errorf("Incorrect wait. Expected: %s, Got: %s\n", time.Second, wait)
+				}
+
+				clock.Add(time.Second)
+				if wait := l.wait(ip, "me"); wait != 0 {
+					t.Errorf("Incorrect wait. Expected: %s, Got: %s\n", time.Duration(0), wait)
+				}
+			})
+		}
+	})
+
+	t.Run("failures slide out of the window", func(t *testing.T) {
+		l, clock := newLimiter()
+
+		l.fail("10.0.0.1", "me")
+		l.fail("10.0.0.1", "me")
+		clock.Add(time.Minute)
+		if lockout := l.fail("10.0.0.1", "me"); lockout != 0 {
+			t.Errorf("Incorrect lockout. Expected: %s, Got: %s\n", time.Duration(0), lockout)
+		}
+	})
+
+	t.Run("success forgets failures", func(t *testing.T) {
+		l, _ := newLimiter()
+
+		l.fail("10.0.0.1", "me")
+		l.fail("10.0.0.1", "me")
+		l.succeed("me")
+		if lockout := l.fail("10.0.0.1", "me"); lockout != 0 {
+			t.Errorf("Incorrect lockout. Expected: %s, Got: %s\n", time.Duration(0), lockout)
+		}
+	})
+
+	t.Run("ips are limited across accounts", func(t *testing.T) {
+		l, clock := newLimiter()
+
+		for i := 0; i < limits.IPFailures; i++ {
+			l.fail("10.0.0.1", fmt.Sprintf("user%d", i))
+			clock.Add(time.Second)
+		}
+
+		// the first failure leaves the window first
+		if wait := l.wait("10.0.0.1", "other"); wait != 55*time.Second {
+			t.Errorf("Incorrect wait. Expected: %s, Got: %s\n", 55*time.Second, wait)
+		}
+		if wait := l.wait("10.0.0.2", "other"); wait != 0 {
+			t.Errorf("Incorrect wait. Expected: %s, Got: %s\n", time.Duration(0), wait)
+		}
+	})
+
+	t.Run("stale entries are swept", func(t *testing.T) {
+		l, clock := newLimiter()
+
+		l.fail("10.0.0.1", "me")
+		clock.Add(limits.Window + limits.MaxLockout + time.Second)
+		l.wait("10.0.0.2", "other")
+
+		if len(l.ips) != 1 || len(l.accounts) != 0 {
+			t.Errorf("Entries not swept: %v %v\n", l.ips, l.accounts)
+		}
+	})
+
+	t.Run("zero limits are off", func(t *testing.T) {
+		l := newLoginLimiter(LoginLimits{Window: time.Minute})
+		for i := 0; i < 100; i++ {
+			l.fail("10.0.0.1", "me")
+		}
+		if wait := l.wait("10.0.0.1", "me"); wait != 0 {
+			t.Errorf("Incorrect wait. Expected: %s, Got: %s\n", time.Duration(0), wait)
+		}
+	})
+}
+
+func TestLoginLockout(t *testing.T) {
+	// create dummy db
+	db, cleanup := openTestDB(t)
+	defer cleanup()
+
+	routes := NewRoutes(db, []byte{}, &HTTPClient{})
+	routes.MigrateDB()
+	routes.SetLoginLimits(LoginLimits{Window: time.Minute, IPFailures: 10, AccountFailures: 2, Lockout: time.Minute})
+
+	clock := &testClock{now: time.Now()}
+	routes.limiter.now = clock.Now
+
+	u := User{Email: "me@email.com", Hash: hashPassword("pw")}
+	admin := User{Email: "admin@email.com", Admin: true}
+	db.Create(&u)
+	db.Create(&admin)
+
+	login := func(password string) *httptest.ResponseRecorder {
+		return serveAs(http.HandlerFunc(routes.LoginFunc), User{}, "POST", "/login", "email=me@email.com&password="+password)
+	}
+
+	testHarness := []struct {
+		testName string
+		password string
+		status   int
+	}{
+		{testName: "first failure", password: "wrong", status: http.StatusUnauthorized},
+		{testName: "locking failure", password: "wrong", status: http.StatusUnauthorized},
+		{testName: "locked with the right password", password: "pw", status: http.StatusTooManyRequests},
+	}
+
+	for _, th := range testHarness {
+		t.Run(th.testName, func(t *testing.T) {
+			if status := login(th.password).Code; status != th.status {
+				t.Errorf("Incorrect status. Expected: %d, Got: %d\n", th.status, status)
+			}
+		})
+	}
+
+	t.Run("retry after", func(t *testing.T) {
+		clock.Add(30 * time.Second)
+		rr := login("pw")
+		if retry := rr.Header().Get("Retry-After"); rr.Code != http.StatusTooManyRequests || retry != "30" {
+			t.Errorf("Incorrect Retry-After. Expected: %s, Got: %s\n", "30", retry)
+		}
+
+		clock.Add(30 * time.Second)
+		if status := login("pw").Code; status != http.StatusOK {
+			t.Errorf("Incorrect status. Expected: %d, Got: %d\n", http.StatusOK, status)
+		}
+	})
+
+	t.Run("lockout is audited", func(t *testing.T) {
+		rr := serveAs(http.HandlerFunc(routes.ListAuditEntries), admin, "GET", "/admin/audit?action="+AuditLoginLockout, "")
+
+		entries := []AuditEntry{}
+		json.NewDecoder(rr.Body).Decode(&entries)
+		if len(entries) != 1 || entries[0].UserID != u.ID || entries[0].Email != "me@email.com" ||
+			!strings.Contains(entries[0].Detail, "1m0s") || rr.Header().Get("X-Total-Count") != "1" {
+			t.Errorf("Incorrect audit entries: %+v\n", entries)
+		}
+
+		rr = serveAs(http.HandlerFunc(routes.ListAuditEntries), admin, "GET", "/admin/audit?user_id=abc", "")
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("Incorrect status. Expected: %d, Got: %d\n", http.StatusBadRequest, rr.Code)
+		}
+	})
+
+	t.Run("unknown accounts are locked too", func(t *testing.T) {
+		payload := "email=nobody@email.com&password=wrong"
+		for i := 0; i < 2; i++ {
+			serveAs(http.HandlerFunc(routes.LoginFunc), User{}, "POST", "/login", payload)
+		}
+
+		rr := serveAs(http.HandlerFunc(routes.LoginFunc), User{}, "POST", "/login", payload)
+		if status := rr.Code; status != http.StatusTooManyRequests {
+			t.Errorf("Incorrect status. Expected: %d, Got: %d\n", http.StatusTooManyRequests, status)
+		}
+	})
+}
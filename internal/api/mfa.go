@@ -0,0 +1,407 @@
+package api
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// mfaTokenTTL is how long a user has to enter their code after their password
+const mfaTokenTTL = 5 * time.Minute
+
+// recoveryCodeCount is how many recovery codes a user gets at a time
+const recoveryCodeCount = 10
+
+// recoveryCodeBytes is how many random bytes make up a recovery code
+const recoveryCodeBytes = 10
+
+// EnrollTOTP starts two-factor authentication for the current user with a new
+// secret, returned along with its otpauth URI. Logins don't ask for a code
+// until the secret is confirmed with ConfirmTOTP. Enrolling again replaces an
+// unconfirmed secret. Like the other /mfa routes it is refused to API keys.
+func (routes *Routes) EnrollTOTP(w http.ResponseWriter, r *http.Request) {
+	if !requireSession(w, r) {
+		return
+	}
+
+	u := currentUser(r)
+	if u.TOTPEnabled {
+		writeErrorMessage(w, "Two-factor authentication already enabled", http.StatusBadRequest)
+		return
+	}
+
+	secret, err := newTOTPSecret()
+	if err != nil {
+		writeErrorMessage(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	err = routes.db.Model(&u).Updates(map[string]interface{}{
+		"totp_secret":    secret,
+		"totp_last_step": 0,
+	}).Error
+	if err != nil {
+		writeErrorMessage(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	resp, err := json.Marshal(map[string]string{
+		"secret": secret,
+		"uri":    totpURI(secret, u.Email),
+	})
+	if err != nil {
+		writeErrorMessage(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	w.Write(resp)
+}
+
+// ConfirmTOTP enables two-factor authentication for the current user once the
+// code form value matches their enrolled secret. It returns their recovery
+// codes, which are only ever shown here and by RegenerateRecoveryCodes. Wrong
+// codes count as failed logins.
+func (routes *Routes) ConfirmTOTP(w http.ResponseWriter, r *http.Request) {
+	if !requireSession(w, r) {
+		return
+	}
+
+	u := currentUser(r)
+	if u.TOTPEnabled {
+		writeErrorMessage(w, "Two-factor authentication already enabled", http.StatusBadRequest)
+		return
+	}
+	if u.TOTPSecret == "" {
+		writeErrorMessage(w, "Enroll before confirming", http.StatusBadRequest)
+		return
+	}
+
+	ip := clientIP(r)
+	account := strings.ToLower(u.Email)
+	if wait := routes.limiter.wait(ip, account); wait > 0 {
+		writeTooManyRequests(w, wait)
+		return
+	}
+
+	step := matchTOTP(u.TOTPSecret, r.FormValue("code"), u.TOTPLastStep, time.Now())
+	if step == 0 {
+		routes.loginFailed(ip, account, u)
+		writeErrorMessage(w, "Invalid code", http.StatusForbidden)
+		return
+	}
+	routes.limiter.succeed(account)
+
+	var codes []string
+	err := transaction(routes.db, func(tx *gorm.DB) error {
+		err := tx.Model(&u).Updates(map[string]interface{}{
+			"totp_enabled":   true,
+			"totp_last_step": step,
+		}).Error
+		if err != nil {
+			return err
+		}
+
+		codes, err = newRecoveryCodes(tx, u.ID)
+		return err
+	})
+	if err != nil {
+		writeErrorMessage(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	routes.audit(AuditEntry{Action: AuditMFAEnabled, UserID: u.ID, Email: u.Email, IP: clientIP(r)})
+	writeRecoveryCodes(w, codes)
+}
+
+// DisableTOTP turns off two-factor authentication for the current user. It
+// takes a code or a recovery_code form value, so a stolen access token is not
+// enough.
+func (routes *Routes) DisableTOTP(w http.ResponseWriter, r *http.Request) {
+	if !requireSession(w, r) {
+		return
+	}
+
+	u, ok := routes.requireSecondFactor(w, r)
+	if !ok {
+		return
+	}
+
+	if err := routes.resetMFA(u); err != nil {
+		writeErrorMessage(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	routes.audit(AuditEntry{Action: AuditMFADisabled, UserID: u.ID, Email: u.Email, IP: clientIP(r)})
+}
+
+// RegenerateRecoveryCodes replaces the recovery codes of the current user. It
+// takes a code or a recovery_code form value like DisableTOTP.
+func (routes *Routes) RegenerateRecoveryCodes(w http.ResponseWriter, r *http.Request) {
+	if !requireSession(w, r) {
+		return
+	}
+
+	u, ok := routes.requireSecondFactor(w, r)
+	if !ok {
+		return
+	}
+
+	var codes []string
+	err := transaction(routes.db, func(tx *gorm.DB) error {
+		var err error
+		codes, err = newRecoveryCodes(tx, u.ID)
+		return err
+	})
+	if err != nil {
+		writeErrorMessage(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeRecoveryCodes(w, codes)
+}
+
+// ResetMFA turns off two-factor authentication for a user who lost their
+// authenticator and their recovery codes
+func (routes *Routes) ResetMFA(w http.ResponseWriter, r *http.Request) {
+	u, ok := routes.findUser(w, r)
+	if !ok {
+		return
+	}
+
+	if err := routes.resetMFA(u); err != nil {
+		writeErrorMessage(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	routes.audit(AuditEntry{
+		Action: AuditMFADisabled,
+		UserID: u.ID,
+		Email:  u.Email,
+		IP:     clientIP(r),
+		Detail: "Reset by " + currentUser(r).Email,
+	})
+}
+
+// LoginMFAFunc finishes the login of a user with two-factor authentication
+// and assigns session tokens. It takes the mfa_token returned by LoginFunc
+// along with a code or a recovery_code form value. Wrong codes count as
+// failed logins, see LoginLimits.
+func (routes *Routes) LoginMFAFunc(w http.ResponseWriter, r *http.Request) {
+	claims, err := routes.parseClaims(r.FormValue("mfa_token"), mfaAudience)
+	if err != nil {
+		writeErrorMessage(w, "Invalid or expired mfa_token", http.StatusUnauthorized)
+		return
+	}
+
+	ip := clientIP(r)
+	account := strings.ToLower(claims.Email)
+	if wait := routes.limiter.wait(ip, account); wait > 0 {
+		writeTooManyRequests(w, wait)
+		return
+	}
+
+	u := User{}
+	routes.db.Where("email = ?", claims.Email).First(&u)
+	if u.ID == 0 || u.Disabled || !u.TOTPEnabled {
+		writeErrorMessage(w, "Invalid or expired mfa_token", http.StatusUnauthorized)
+		return
+	}
+
+	ok, err := routes.verifySecondFactor(u, r)
+	if err != nil {
+		writeErrorMessage(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		routes.loginFailed(ip, account, u)
+		writeErrorMessage(w, "Incorrect code", http.StatusUnauthorized)
+		return
+	}
+
+	routes.limiter.succeed(account)
+
+	access, refresh, err := routes.startSession(u, claims.Scopes)
+	if err != nil {
+		writeErrorMessage(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeTokens(w, access, refresh)
+}
+
+// writeMFAToken answers a login with the right password for a user with
+// two-factor authentication. The token carries the scopes asked for at login
+// and only LoginMFAFunc accepts it, being signed for the mfaAudience with the
+// jwt secret.
+func (routes *Routes) writeMFAToken(w http.ResponseWriter, u User, scopes Scopes) {
+	token, err := routes.signMFAToken(u, scopes)
+	if err != nil {
+		writeErrorMessage(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	resp, err := json.Marshal(map[string]interface{}{
+		"mfa_token":  token,
+		"expires_in": int(mfaTokenTTL.Seconds()),
+	})
+	if err != nil {
+		writeErrorMessage(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+	w.Write(resp)
+}
+
+// signMFAToken signs the token LoginMFAFunc exchanges for a session of u
+// with scopes once the second factor is checked
+func (routes *Routes) signMFAToken(u User, scopes Scopes) (string, error) {
+	return routes.signClaims(accessClaims{
+		Email:  u.Email,
+		Scopes: scopes,
+	}, mfaAudience, mfaTokenTTL)
+}
+
+// requireSecondFactor returns the current user when they have two-factor
+// authentication and the request carries one of their codes, writing an
+// error otherwise. Wrong codes count as failed logins like in LoginMFAFunc.
+func (routes *Routes) requireSecondFactor(w http.ResponseWriter, r *http.Request) (User, bool) {
+	u := currentUser(r)
+	if !u.TOTPEnabled {
+		writeErrorMessage(w, "Two-factor authentication not enabled", http.StatusBadRequest)
+		return u, false
+	}
+
+	ip := clientIP(r)
+	account := strings.ToLower(u.Email)
+	if wait := routes.limiter.wait(ip, account); wait > 0 {
+		writeTooManyRequests(w, wait)
+		return u, false
+	}
+
+	ok, err := routes.verifySecondFactor(u, r)
+	if err != nil {
+		writeErrorMessage(w, err.Error(), http.StatusInternalServerError)
+		return u, false
+	}
+	if !ok {
+		routes.loginFailed(ip, account, u)
+		writeErrorMessage(w, "Invalid code", http.StatusForbidden)
+		return u, false
+	}
+
+	routes.limiter.succeed(account)
+	return u, true
+}
+
+// verifySecondFactor checks the code or recovery_code form value of r against
+// the TOTP secret or the unused recovery codes of u. Either can only be used
+// once.
+func (routes *Routes) verifySecondFactor(u User, r *http.Request) (bool, error) {
+	if code := r.FormValue("code"); code != "" {
+		step := matchTOTP(u.TOTPSecret, code, u.TOTPLastStep, time.Now())
+		if step == 0 {
+			return false, nil
+		}
+
+		// only one request can use the code
+		result := routes.db.Model(&User{}).
+			Where("id = ? AND totp_last_step < ?", u.ID, step).
+			Update("totp_last_step", step)
+		return result.RowsAffected == 1, result.Error
+	}
+
+	if code := r.FormValue("recovery_code"); code != "" {
+		result := routes.db.Model(&RecoveryCode{}).
+			Where("user_id = ? AND code_hash = ? AND used_at IS NULL", u.ID, hashToken(normalizeRecoveryCode(code))).
+			Update("used_at", time.Now().UTC())
+		if result.Error != nil || result.RowsAffected != 1 {
+			return false, result.Error
+		}
+
+		remaining := 0
+		routes.db.Model(&RecoveryCode{}).Where("user_id = ? AND used_at IS NULL", u.ID).Count(&remaining)
+		log.Printf("Recovery code of %s used, %d left\n", u.Email, remaining)
+		routes.audit(AuditEntry{
+			Action: AuditMFARecoveryCodeUsed,
+			UserID: u.ID,
+			Email:  u.Email,
+			IP:     clientIP(r),
+			Detail: fmt.Sprintf("%d recovery codes left", remaining),
+		})
+		return true, nil
+	}
+
+	return false, nil
+}
+
+// resetMFA turns off two-factor authentication for u and deletes their
+// recovery codes
+func (routes *Routes) resetMFA(u User) error {
+	return transaction(routes.db, func(tx *gorm.DB) error {
+		err := tx.Model(&u).Updates(map[string]interface{}{
+			"totp_secret":    "",
+			"totp_enabled":   false,
+			"totp_last_step": 0,
+		}).Error
+		if err != nil {
+			return err
+		}
+		return tx.Unscoped().Where("user_id = ?", u.ID).Delete(&RecoveryCode{}).Error
+	})
+}
+
+// newRecoveryCodes replaces the recovery codes of the user with userID,
+// returning the new codes
+func newRecoveryCodes(tx *gorm.DB, userID uint) ([]string, error) {
+	if err := tx.Unscoped().Where("user_id = ?", userID).Delete(&RecoveryCode{}).Error; err != nil {
+		return nil, err
+	}
+
+	codes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		// 80 random bits, too many to guess even with a fast hash
+		b := make([]byte, recoveryCodeBytes)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		code := hex.EncodeToString(b)
+
+		groups := []string{}
+		for j := 0; j < len(code); j += 5 {
+			groups = append(groups, code[j:j+5])
+		}
+		codes[i] = strings.Join(groups, "-")
+
+		rc := RecoveryCode{UserID: userID, CodeHash: hashToken(code)}
+		if err := tx.Create(&rc).Error; err != nil {
+			return nil, err
+		}
+	}
+	return codes, nil
+}
+
+// normalizeRecoveryCode drops the dash and spaces people type along with a
+// recovery code
+func normalizeRecoveryCode(code string) string {
+	code = strings.Replace(code, "-", "", -1)
+	code = strings.Replace(code, " ", "", -1)
+	return strings.ToLower(code)
+}
+
+func writeRecoveryCodes(w http.ResponseWriter, codes []string) {
+	resp, err := json.Marshal(map[string][]string{"recovery_codes": codes})
+	if err != nil {
+		writeErrorMessage(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Write(resp)
+}
@@ -0,0 +1,301 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func TestMFA(t *testing.T) {
+	// create dummy db
+	db, cleanup := openTestDB(t)
+	defer cleanup()
+
+	routes := NewRoutes(db, []byte("secret"), &HTTPClient{})
+	routes.MigrateDB()
+
+	u := User{Email: "me@email.com", Name: "me", Hash: hashPassword("pw")}
+	admin := User{Email: "admin@email.com", Name: "admin", Hash: hashPassword("pw"), Admin: true}
+	db.Create(&u)
+	db.Create(&admin)
+
+	router := mux.NewRouter()
+	router.HandleFunc("/login", routes.LoginFunc).Methods("POST")
+	router.HandleFunc("/login/mfa", routes.LoginMFAFunc).Methods("POST")
+	a := router.PathPrefix("/").Subrouter()
+	a.Use(routes.AuthMiddleware)
+	a.HandleFunc("/me", routes.Me).Methods("GET")
+	account := routes.RequireScope(ScopeAccount)
+	a.Handle("/mfa/totp", account(http.HandlerFunc(routes.EnrollTOTP))).Methods("POST")
+	a.Handle("/mfa/totp/disable", account(http.HandlerFunc(routes.DisableTOTP))).Methods("POST")
+	a.Handle("/mfa/totp/confirm", account(http.HandlerFunc(routes.ConfirmTOTP))).Methods("POST")
+	a.Handle("/mfa/recovery-codes", account(http.HandlerFunc(routes.RegenerateRecoveryCodes))).Methods("POST")
+	a.HandleFunc("/admin/users/{id}/mfa", routes.ResetMFA).Methods("DELETE")
+
+	serve := func(method string, path string, access string, payload string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, path, bytes.NewBuffer([]byte(payload)))
+		req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+		if access != "" {
+			req.Header.Set("Authorization", "Bearer "+access)
+		}
+
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	login := func(email string) *httptest.ResponseRecorder {
+		return serve("POST", "/login", "", "email="+email+"&password=pw")
+	}
+
+	access := func(t *testing.T, rr *httptest.ResponseRecorder) string {
+		if rr.Code != http.StatusOK {
+			t.Fatalf("Incorrect status. Expected: %d, Got: %d\n", http.StatusOK, rr.Code)
+		}
+		body, _ := ioutil.ReadAll(rr.Body)
+		return string(body)
+	}
+
+	// a code is only good once, so the last step used is forgotten for the
+	// next code rather than waiting for the next time step
+	var secret string
+	nextCode := func() string {
+		db.Model(&User{}).Where("id = ?", u.ID).Update("totp_last_step", 0)
+		code, _ := totpCode(secret, totpStep(time.Now()))
+		return code
+	}
+
+	token := access(t, login("me@email.com"))
+	var recoveryCodes []string
+
+	t.Run("api keys and limited tokens can not enroll", func(t *testing.T) {
+		k := APIKey{UserID: u.ID, Name: "dashboard", Scopes: AllScopes, Key: apiKeyPrefix + "dashboard"}
+		k.KeyHash = hashToken(k.Key)
+		db.Create(&k)
+		limited := access(t, serve("POST", "/login", "", "email=me@email.com&password=pw&scope=schedules:read"))
+
+		testHarness := []struct {
+			testName string
+			access   string
+			path     string
+			status   int
+		}{
+			{testName: "api key enroll", access: k.Key, path: "/mfa/totp", status: http.StatusBadRequest},
+			{testName: "api key confirm", access: k.Key, path: "/mfa/totp/confirm", status: http.StatusBadRequest},
+			{testName: "limited token", access: limited, path: "/mfa/totp", status: http.StatusForbidden},
+		}
+
+		for _, th := range testHarness {
+			t.Run(th.testName, func(t *testing.T) {
+				if rr := serve("POST", th.path, th.access, "code=123456"); rr.Code != th.status {
+					t.Errorf("Incorrect status. Expected: %d, Got: %d\n", th.status, rr.Code)
+				}
+			})
+		}
+
+		db.First(&u, u.ID)
+		if u.TOTPSecret != "" {
+			t.Error("Secret enrolled without a session")
+		}
+	})
+
+	t.Run("enroll", func(t *testing.T) {
+		rr := serve("POST", "/mfa/totp", token, "")
+		if rr.Code != http.StatusCreated {
+			t.Fatalf("Incorrect status. Expected: %d, Got: %d\n", http.StatusCreated, rr.Code)
+		}
+
+		enrollment := map[string]string{}
+		json.NewDecoder(rr.Body).Decode(&enrollment)
+		secret = enrollment["secret"]
+		uri, _ := url.Parse(enrollment["uri"])
+		if secret == "" || uri.Query().Get("secret") != secret {
+			t.Errorf("Incorrect enrollment: %v\n", enrollment)
+		}
+
+		// logins don't ask for a code until it is confirmed
+		access(t, login("me@email.com"))
+	})
+
+	t.Run("confirm", func(t *testing.T) {
+		if rr := serve("POST", "/mfa/totp/confirm", token, "code=000000"); rr.Code != http.StatusForbidden {
+			t.Errorf("Incorrect status. Expected: %d, Got: %d\n", http.StatusForbidden, rr.Code)
+		}
+
+		rr := serve("POST", "/mfa/totp/confirm", token, "code="+nextCode())
+		if rr.Code != http.StatusOK {
+			t.Fatalf("Incorrect status. Expected: %d, Got: %d\n", http.StatusOK, rr.Code)
+		}
+
+		resp := map[string][]string{}
+		json.NewDecoder(rr.Body).Decode(&resp)
+		recoveryCodes = resp["recovery_codes"]
+		if len(recoveryCodes) != recoveryCodeCount {
+			t.Errorf("Incorrect number of recovery codes. Expected: %d, Got: %d\n", recoveryCodeCount, len(recoveryCodes))
+		}
+		for _, code := range recoveryCodes {
+			if len(normalizeRecoveryCode(code)) != 2*recoveryCodeBytes {
+				t.Errorf("Incorrect recovery code: %s\n", code)
+			}
+		}
+
+		if rr := serve("POST", "/mfa/totp", token, ""); rr.Code != http.StatusBadRequest {
+			t.Errorf("Incorrect status. Expected: %d, Got: %d\n", http.StatusBadRequest, rr.Code)
+		}
+	})
+
+	mfaToken := func(t *testing.T) string {
+		rr := login("me@email.com")
+		if rr.Code != http.StatusAccepted {
+			t.Fatalf("Incorrect status. Expected: %d, Got: %d\n", http.StatusAccepted, rr.Code)
+		}
+		if rr.Header().Get("X-Refresh-Token") != "" {
+			t.Errorf("Refresh token issued before the code\n")
+		}
+
+		resp := map[string]interface{}{}
+		json.NewDecoder(rr.Body).Decode(&resp)
+		return resp["mfa_token"].(string)
+	}
+
+	t.Run("two step login", func(t *testing.T) {
+		pending := mfaToken(t)
+		code := nextCode()
+
+		testHarness := []struct {
+			testName string
+			payload  string
+			status   int
+		}{
+			{testName: "mfa token is not an access token", status: http.StatusUnauthorized},
+			{testName: "no mfa token", payload: "code=" + code, status: http.StatusUnauthorized},
+			{testName: "access token is not an mfa token", payload: "mfa_token=" + token + "&code=" + code, status: http.StatusUnauthorized},
+			{testName: "wrong code", payload: "mfa_token=" + pending + "&code=000000", status: http.StatusUnauthorized},
+			{testName: "code", payload: "mfa_token=" + pending + "&code=" + code, status: http.StatusOK},
+			{testName: "code replayed", payload: "mfa_token=" + pending + "&code=" + code, status: http.StatusUnauthorized},
+			{testName: "recovery code", payload: "mfa_token=" + pending + "&recovery_code=" + recoveryCodes[0], status: http.StatusOK},
+			{testName: "recovery code replayed", payload: "mfa_token=" + pending + "&recovery_code=" + recoveryCodes[0], status: http.StatusUnauthorized},
+		}
+
+		for i, th := range testHarness {
+			t.Run(th.testName, func(t *testing.T) {
+				var rr *httptest.ResponseRecorder
+				if i == 0 {
+					rr = serve("GET", "/me", pending, "")
+				} else {
+					rr = serve("POST", "/login/mfa", "", th.payload)
+				}
+				if status := rr.Code; status != th.status {
+					t.Errorf("Incorrect status. Expected: %d, Got: %d\n", th.status, status)
+				}
+				if rr.Code == http.StatusOK && i > 0 {
+					if rr := serve("GET", "/me", access(t, rr), ""); rr.Code != http.StatusOK {
+						t.Errorf("Incorrect status. Expected: %d, Got: %d\n", http.StatusOK, rr.Code)
+					}
+				}
+			})
+		}
+	})
+
+	t.Run("recovery code use is audited", func(t *testing.T) {
+		entries := []AuditEntry{}
+		db.Where("action = ?", AuditMFARecoveryCodeUsed).Find(&entries)
+		if len(entries) != 1 || entries[0].UserID != u.ID || entries[0].Detail != "9 recovery codes left" {
+			t.Errorf("Incorrect audit entries: %+v\n", entries)
+		}
+	})
+
+	t.Run("regenerate recovery codes", func(t *testing.T) {
+		rr := serve("POST", "/mfa/recovery-codes", token, "code="+nextCode())
+		if rr.Code != http.StatusOK {
+			t.Fatalf("Incorrect status. Expected: %d, Got: %d\n", http.StatusOK, rr.Code)
+		}
+
+		resp := map[string][]string{}
+		json.NewDecoder(rr.Body).Decode(&resp)
+		old := recoveryCodes[1]
+		recoveryCodes = resp["recovery_codes"]
+
+		payload := "mfa_token=" + mfaToken(t) + "&recovery_code="
+		if rr := serve("POST", "/login/mfa", "", payload+old); rr.Code != http.StatusUnauthorized {
+			t.Errorf("Incorrect status. Expected: %d, Got: %d\n", http.StatusUnauthorized, rr.Code)
+		}
+		access(t, serve("POST", "/login/mfa", "", payload+recoveryCodes[0]))
+	})
+
+	t.Run("disable", func(t *testing.T) {
+		if rr := serve("POST", "/mfa/totp/disable", token, ""); rr.Code != http.StatusForbidden {
+			t.Errorf("Incorrect status. Expected: %d, Got: %d\n", http.StatusForbidden, rr.Code)
+		}
+		if rr := serve("POST", "/mfa/totp/disable", token, "recovery_code="+recoveryCodes[1]); rr.Code != http.StatusOK {
+			t.Fatalf("Incorrect status. Expected: %d, Got: %d\n", http.StatusOK, rr.Code)
+		}
+
+		count := -1
+		db.Model(&RecoveryCode{}).Where("user_id = ?", u.ID).Count(&count)
+		if count != 0 {
+			t.Errorf("Incorrect number of recovery codes. Expected: %d, Got: %d\n", 0, count)
+		}
+		access(t, login("me@email.com"))
+	})
+
+	t.Run("admin reset", func(t *testing.T) {
+		serve("POST", "/mfa/totp", token, "")
+		db.First(&u, u.ID)
+		secret = u.TOTPSecret
+		serve("POST", "/mfa/totp/confirm", token, "code="+nextCode())
+		if rr := login("me@email.com"); rr.Code != http.StatusAccepted {
+			t.Fatalf("Incorrect status. Expected: %d, Got: %d\n", http.StatusAccepted, rr.Code)
+		}
+
+		adminToken := access(t, login("admin@email.com"))
+		if rr := serve("DELETE", fmt.Sprintf("/admin/users/%d/mfa", u.ID), adminToken, ""); rr.Code != http.StatusOK {
+			t.Fatalf("Incorrect status. Expected: %d, Got: %d\n", http.StatusOK, rr.Code)
+		}
+		access(t, login("me@email.com"))
+
+		entries := []AuditEntry{}
+		db.Where("action = ? AND user_id = ?", AuditMFADisabled, u.ID).Order("id").Find(&entries)
+		if len(entries) != 2 || entries[1].Detail != "Reset by admin@email.com" {
+			t.Errorf("Incorrect audit entries: %+v\n", entries)
+		}
+	})
+
+	t.Run("wrong codes are limited", func(t *testing.T) {
+		routes.SetLoginLimits(LoginLimits{Window: time.Minute, AccountFailures: 3, Lockout: time.Minute, MaxLockout: time.Minute})
+		defer routes.SetLoginLimits(DefaultLoginLimits)
+
+		serve("POST", "/mfa/totp", token, "")
+		db.First(&u, u.ID)
+		secret = u.TOTPSecret
+		if rr := serve("POST", "/mfa/totp/confirm", token, "code="+nextCode()); rr.Code != http.StatusOK {
+			t.Fatalf("Incorrect status. Expected: %d, Got: %d\n", http.StatusOK, rr.Code)
+		}
+
+		for i := 0; i < 3; i++ {
+			if rr := serve("POST", "/mfa/totp/disable", token, "code=000000"); rr.Code != http.StatusForbidden {
+				t.Fatalf("Incorrect status. Expected: %d, Got: %d\n", http.StatusForbidden, rr.Code)
+			}
+		}
+
+		// locked out, even with the right code
+		for _, path := range []string{"/mfa/totp/disable", "/mfa/recovery-codes"} {
+			if rr := serve("POST", path, token, "code="+nextCode()); rr.Code != http.StatusTooManyRequests {
+				t.Errorf("Incorrect status. Expected: %d, Got: %d\n", http.StatusTooManyRequests, rr.Code)
+			}
+		}
+
+		db.First(&u, u.ID)
+		if !u.TOTPEnabled {
+			t.Error("Two-factor authentication disabled while locked out")
+		}
+	})
+}
@@ -0,0 +1,595 @@
+package api
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// migration is a single versioned change to the schema. Migrations describe
+// the tables with their own structs rather than the models so that they keep
+// doing the same thing as the models change.
+type migration struct {
+	Version int
+	Name    string
+	Up      func(tx *gorm.DB) error
+	Down    func(tx *gorm.DB) error
+}
+
+// migrations lists every change to the schema in the order they are applied.
+// Only ever append to it, an applied migration must not change.
+var migrations = []migration{
+	{
+		Version: 1,
+		Name:    "create users, schedules, executions and leader_leases",
+		Up: func(tx *gorm.DB) error {
+			type Model struct {
+				ID        uint `gorm:"primary_key"`
+				CreatedAt time.Time
+				UpdatedAt time.Time
+				DeletedAt *time.Time
+			}
+			type user struct {
+				Model
+				Email string
+				Name  string
+				Hash  string
+			}
+			type schedule struct {
+				Model
+				Time           time.Time
+				Source         string
+				Status         string
+				URL            string
+				Method         string
+				Headers        string `gorm:"type:text"`
+				Body           string `gorm:"type:text"`
+				Coalesce       bool
+				Cron           string
+				TimeZone       string
+				Attempts       int
+				MaxAttempts    int
+				RetryDelay     int
+				Backoff        float64
+				Jitter         float64
+				RetryableCodes string
+				LeaseOwner     string
+				LeaseExpiresAt *time.Time
+			}
+			type execution struct {
+				Model
+				ScheduleID      uint `gorm:"index"`
+				Time            time.Time
+				Attempt         int
+				Status          string
+				StartedAt       time.Time
+				FinishedAt      time.Time
+				Latency         int64
+				StatusCode      int
+				ResponseHeaders string `gorm:"type:text"`
+				ResponseBody    string `gorm:"type:text"`
+				Error           string `gorm:"type:text"`
+			}
+			type leaderLease struct {
+				Name      string `gorm:"primary_key"`
+				Holder    string
+				ExpiresAt time.Time
+			}
+
+			// databases created before migrations existed already have
+			// these tables, AutoMigrate leaves them as they are
+			return tx.AutoMigrate(&user{}, &schedule{}, &execution{}, &leaderLease{}).Error
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.DropTableIfExists("leader_leases", "executions", "schedules", "users").Error
+		},
+	},
+	{
+		Version: 2,
+		Name:    "index schedules by status and time",
+		Up: func(tx *gorm.DB) error {
+			return tx.Table("schedules").AddIndex("idx_schedules_status_time", "status", "time").Error
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.Table("schedules").RemoveIndex("idx_schedules_status_time").Error
+		},
+	},
+	{
+		Version: 3,
+		Name:    "add user_id to schedules",
+		Up: func(tx *gorm.DB) error {
+			type schedule struct {
+				UserID uint `gorm:"index"`
+			}
+			if err := tx.AutoMigrate(&schedule{}).Error; err != nil {
+				return err
+			}
+
+			// Source holds the name of the creator, existing schedules go to
+			// the user with that name when it is not ambiguous. The rest are
+			// left without an owner.
+			return tx.Exec(`UPDATE schedules SET user_id = (
+				SELECT MIN(id) FROM users WHERE users.name = schedules.source AND users.deleted_at IS NULL
+			) WHERE user_id IS NULL AND (
+				SELECT COUNT(*) FROM users WHERE users.name = schedules.source AND users.deleted_at IS NULL
+			) = 1`).Error
+		},
+		Down: func(tx *gorm.DB) error {
+			if err := tx.Table("schedules").RemoveIndex("idx_schedules_user_id").Error; err != nil {
+				return err
+			}
+			return tx.Table("schedules").DropColumn("user_id").Error
+		},
+	},
+	{
+		Version: 4,
+		Name:    "create teams and memberships, add team_id to schedules",
+		Up: func(tx *gorm.DB) error {
+			type Model struct {
+				ID        uint `gorm:"primary_key"`
+				CreatedAt time.Time
+				UpdatedAt time.Time
+				DeletedAt *time.Time
+			}
+			type team struct {
+				Model
+				Name string
+			}
+			type membership struct {
+				Model
+				TeamID uint `gorm:"unique_index:idx_memberships_team_id_user_id"`
+				UserID uint `gorm:"unique_index:idx_memberships_team_id_user_id;index"`
+				Role   string
+			}
+			type schedule struct {
+				TeamID uint `gorm:"index"`
+			}
+			return tx.AutoMigrate(&team{}, &membership{}, &schedule{}).Error
+		},
+		Down: func(tx *gorm.DB) error {
+			if err := tx.Table("schedules").RemoveIndex("idx_schedules_team_id").Error; err != nil {
+				return err
+			}
+			if err := tx.Table("schedules").DropColumn("team_id").Error; err != nil {
+				return err
+			}
+			return tx.DropTableIfExists("memberships", "teams").Error
+		},
+	},
+	{
+		Version: 5,
+		Name:    "add admin and disabled to users",
+		Up: func(tx *gorm.DB) error {
+			type user struct {
+				Admin    bool `gorm:"not null;default:false"`
+				Disabled bool `gorm:"not null;default:false"`
+			}
+			return tx.AutoMigrate(&user{}).Error
+		},
+		Down: func(tx *gorm.DB) error {
+			if err := tx.Table("users").DropColumn("admin").Error; err != nil {
+				return err
+			}
+			return tx.Table("users").DropColumn("disabled").Error
+		},
+	},
+	{
+		Version: 6,
+		Name:    "create invites",
+		Up: func(tx *gorm.DB) error {
+			type Model struct {
+				ID        uint `gorm:"primary_key"`
+				CreatedAt time.Time
+				UpdatedAt time.Time
+				DeletedAt *time.Time
+			}
+			type invite struct {
+				Model
+				Email       string
+				TokenHash   string `gorm:"unique_index"`
+				TeamID      uint   `gorm:"index"`
+				Role        string
+				CreatedByID uint
+				ExpiresAt   time.Time
+				UsedAt      *time.Time
+			}
+			return tx.AutoMigrate(&invite{}).Error
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.DropTableIfExists("invites").Error
+		},
+	},
+	{
+		Version: 7,
+		Name:    "create sessions",
+		Up: func(tx *gorm.DB) error {
+			type Model struct {
+				ID        uint `gorm:"primary_key"`
+				CreatedAt time.Time
+				UpdatedAt time.Time
+				DeletedAt *time.Time
+			}
+			type session struct {
+				Model
+				UserID       uint   `gorm:"index"`
+				RefreshHash  string `gorm:"unique_index"`
+				PreviousHash string `gorm:"index"`
+				ExpiresAt    time.Time
+				RevokedAt    *time.Time
+			}
+			return tx.AutoMigrate(&session{}).Error
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.DropTableIfExists("sessions").Error
+		},
+	},
+	{
+		Version: 8,
+		Name:    "create api keys",
+		Up: func(tx *gorm.DB) error {
+			type Model struct {
+				ID        uint `gorm:"primary_key"`
+				CreatedAt time.Time
+				UpdatedAt time.Time
+				DeletedAt *time.Time
+			}
+			type apiKey struct {
+				Model
+				UserID     uint `gorm:"index"`
+				Name       string
+				Prefix     string
+				KeyHash    string `gorm:"unique_index"`
+				ExpiresAt  *time.Time
+				LastUsedAt *time.Time
+			}
+			return tx.AutoMigrate(&apiKey{}).Error
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.DropTableIfExists("api_keys").Error
+		},
+	},
+	{
+		Version: 9,
+		Name:    "add scopes to sessions and api keys",
+		Up: func(tx *gorm.DB) error {
+			type session struct {
+				Scopes string
+			}
+			type apiKey struct {
+				Scopes string
+			}
+			if err := tx.AutoMigrate(&session{}, &apiKey{}).Error; err != nil {
+				return err
+			}
+
+			// everything was allowed before scopes
+			all := "schedules:read schedules:write executions:read teams:read teams:write admin"
+			if err := tx.Table("sessions").Update("scopes", all).Error; err != nil {
+				return err
+			}
+			return tx.Table("api_keys").Update("scopes", all).Error
+		},
+		Down: func(tx *gorm.DB) error {
+			if err := tx.Table("sessions").DropColumn("scopes").Error; err != nil {
+				return err
+			}
+			return tx.Table("api_keys").DropColumn("scopes").Error
+		},
+	},
+	{
+		Version: 10,
+		Name:    "create audit entries",
+		Up: func(tx *gorm.DB) error {
+			type Model struct {
+				ID        uint `gorm:"primary_key"`
+				CreatedAt time.Time
+				UpdatedAt time.Time
+				DeletedAt *time.Time
+			}
+			type auditEntry struct {
+				Model
+				Action     string `gorm:"index"`
+				UserID     uint   `gorm:"index"`
+				Email      string
+				IP         string
+				Detail     string `gorm:"type:text"`
+				OccurredAt time.Time
+			}
+			return tx.AutoMigrate(&auditEntry{}).Error
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.DropTableIfExists("audit_entries").Error
+		},
+	},
+	{
+		Version: 11,
+		Name:    "add totp to users and create recovery codes",
+		Up: func(tx *gorm.DB) error {
+			type Model struct {
+				ID        uint `gorm:"primary_key"`
+				CreatedAt time.Time
+				UpdatedAt time.Time
+				DeletedAt *time.Time
+			}
+			type user struct {
+				TOTPSecret   string
+				TOTPEnabled  bool  `gorm:"not null;default:false"`
+				TOTPLastStep int64 `gorm:"not null;default:0"`
+			}
+			type recoveryCode struct {
+				Model
+				UserID   uint `gorm:"index"`
+				CodeHash string
+				UsedAt   *time.Time
+			}
+			return tx.AutoMigrate(&user{}, &recoveryCode{}).Error
+		},
+		Down: func(tx *gorm.DB) error {
+			for _, column := range []string{"totp_secret", "totp_enabled", "totp_last_step"} {
+				if err := tx.Table("users").DropColumn(column).Error; err != nil {
+					return err
+				}
+			}
+			return tx.DropTableIfExists("recovery_codes").Error
+		},
+	},
+	{
+		Version: 12,
+		Name:    "create oidc states",
+		Up: func(tx *gorm.DB) error {
+			type Model struct {
+				ID        uint `gorm:"primary_key"`
+				CreatedAt time.Time
+				UpdatedAt time.Time
+				DeletedAt *time.Time
+			}
+			type oidcState struct {
+				Model
+				StateHash string `gorm:"index"`
+				Nonce     string
+				Verifier  string
+				ExpiresAt time.Time
+			}
+			return tx.AutoMigrate(&oidcState{}).Error
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.DropTableIfExists("oidc_states").Error
+		},
+	},
+	{
+		Version: 13,
+		Name:    "create password resets",
+		Up: func(tx *gorm.DB) error {
+			type Model struct {
+				ID        uint `gorm:"primary_key"`
+				CreatedAt time.Time
+				UpdatedAt time.Time
+				DeletedAt *time.Time
+			}
+			type passwordReset struct {
+				Model
+				UserID    uint   `gorm:"index"`
+				TokenHash string `gorm:"index"`
+				ExpiresAt time.Time
+				UsedAt    *time.Time
+			}
+			return tx.AutoMigrate(&passwordReset{}).Error
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.DropTableIfExists("password_resets").Error
+		},
+	},
+	{
+		Version: 14,
+		Name:    "add versions to schedules",
+		Up: func(tx *gorm.DB) error {
+			type schedule struct {
+				Version int `gorm:"not null;default:1"`
+			}
+			return tx.AutoMigrate(&schedule{}).Error
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.Table("schedules").DropColumn("version").Error
+		},
+	},
+	{
+		Version: 15,
+		Name:    "add account scope to sessions",
+		Up: func(tx *gorm.DB) error {
+			// only sessions that could do everything before get the new scope,
+			// api keys never manage the account
+			all := "schedules:read schedules:write executions:read teams:read teams:write admin"
+			return tx.Table("sessions").Where("scopes = ?", all).Update("scopes", all+" account").Error
+		},
+		Down: func(tx *gorm.DB) error {
+			all := "schedules:read schedules:write executions:read teams:read teams:write admin"
+			return tx.Table("sessions").Where("scopes = ?", all+" account").Update("scopes", all).Error
+		},
+	},
+	{
+		Version: 16,
+		Name:    "remove account scope from api keys",
+		Up: func(tx *gorm.DB) error {
+			// an earlier form of migration 15 gave the scope to api keys too
+			type apiKey struct {
+				ID     uint
+				Scopes string
+			}
+			keys := []apiKey{}
+			if err := tx.Table("api_keys").Where("scopes LIKE ?", "%account%").Find(&keys).Error; err != nil {
+				return err
+			}
+
+			for _, k := range keys {
+				scopes := []string{}
+				for _, scope := range strings.Fields(k.Scopes) {
+					if scope != "account" {
+						scopes = append(scopes, scope)
+					}
+				}
+				err := tx.Table("api_keys").Where("id = ?", k.ID).Update("scopes", strings.Join(scopes, " ")).Error
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+		Down: func(tx *gorm.DB) error {
+			// api keys are never meant to have the scope
+			return nil
+		},
+	},
+}
+
+// SchemaMigration is a row of the schema_migrations table, recording a
+// migration applied to the db
+type SchemaMigration struct {
+	Version   int `gorm:"primary_key;auto_increment:false"`
+	Name      string
+	AppliedAt time.Time
+}
+
+// MigrationStatus describes a known migration and whether it was applied
+type MigrationStatus struct {
+	Version   int
+	Name      string
+	AppliedAt *time.Time
+}
+
+// latestVersion is the schema version this build knows about
+func latestVersion() int {
+	return migrations[len(migrations)-1].Version
+}
+
+// appliedMigrations returns the migrations recorded in the db, oldest first
+func appliedMigrations(db *gorm.DB) ([]SchemaMigration, error) {
+	if err := db.AutoMigrate(&SchemaMigration{}).Error; err != nil {
+		return nil, err
+	}
+
+	applied := []SchemaMigration{}
+	err := db.Order("version asc").Find(&applied).Error
+	return applied, err
+}
+
+// MigrateUp applies every migration not yet recorded in the db, each in a
+// transaction of its own. It refuses to touch a db with a schema newer than
+// this build knows about.
+func MigrateUp(db *gorm.DB) error {
+	applied, err := appliedMigrations(db)
+	if err != nil {
+		return err
+	}
+
+	done := map[int]bool{}
+	for _, m := range applied {
+		done[m.Version] = true
+		if m.Version > latestVersion() {
+			return fmt.Errorf("Database schema version %d is newer than the latest known version %d. Upgrade the server", m.Version, latestVersion())
+		}
+	}
+
+	for _, m := range migrations {
+		if done[m.Version] {
+			continue
+		}
+
+		err := transaction(db, func(tx *gorm.DB) error {
+			if err := m.Up(tx); err != nil {
+				return err
+			}
+			return tx.Create(&SchemaMigration{
+				Version:   m.Version,
+				Name:      m.Name,
+				AppliedAt: time.Now().UTC(),
+			}).Error
+		})
+		if err != nil {
+			return fmt.Errorf("Error applying migration %d %s: %s", m.Version, m.Name, err.Error())
+		}
+	}
+
+	return nil
+}
+
+// MigrateDown reverts the last steps applied migrations, newest first
+func MigrateDown(db *gorm.DB, steps int) error {
+	applied, err := appliedMigrations(db)
+	if err != nil {
+		return err
+	}
+
+	known := map[int]migration{}
+	for _, m := range migrations {
+		known[m.Version] = m
+	}
+
+	for i := len(applied) - 1; i >= 0 && steps > 0; i, steps = i-1, steps-1 {
+		m, ok := known[applied[i].Version]
+		if !ok {
+			return fmt.Errorf("Unknown migration %d %s. Upgrade the server to revert it", applied[i].Version, applied[i].Name)
+		}
+
+		err := transaction(db, func(tx *gorm.DB) error {
+			if err := m.Down(tx); err != nil {
+				return err
+			}
+			return tx.Delete(&SchemaMigration{}, "version = ?", m.Version).Error
+		})
+		if err != nil {
+			return fmt.Errorf("Error reverting migration %d %s: %s", m.Version, m.Name, err.Error())
+		}
+	}
+
+	return nil
+}
+
+// MigrationStatuses lists the known migrations along with any unknown ones
+// found in the db, ordered by version
+func MigrationStatuses(db *gorm.DB) ([]MigrationStatus, error) {
+	applied, err := appliedMigrations(db)
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := []MigrationStatus{}
+	i := 0
+	for _, m := range migrations {
+		for ; i < len(applied) && applied[i].Version < m.Version; i++ {
+			statuses = append(statuses, appliedStatus(applied[i]))
+		}
+
+		status := MigrationStatus{Version: m.Version, Name: m.Name}
+		if i < len(applied) && applied[i].Version == m.Version {
+			status.AppliedAt = &applied[i].AppliedAt
+			i++
+		}
+		statuses = append(statuses, status)
+	}
+	for ; i < len(applied); i++ {
+		statuses = append(statuses, appliedStatus(applied[i]))
+	}
+
+	return statuses, nil
+}
+
+func appliedStatus(m SchemaMigration) MigrationStatus {
+	appliedAt := m.AppliedAt
+	return MigrationStatus{Version: m.Version, Name: m.Name, AppliedAt: &appliedAt}
+}
+
+// transaction runs f in a transaction, committing it when f succeeds
+func transaction(db *gorm.DB, f func(tx *gorm.DB) error) error {
+	tx := db.Begin()
+	if tx.Error != nil {
+		return tx.Error
+	}
+
+	if err := f(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
+}
@@ -0,0 +1,183 @@
+package api
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestMigrations(t *testing.T) {
+	// create dummy db
+	db, cleanup := openTestDB(t)
+	defer cleanup()
+
+	t.Run("up applies every migration once", func(t *testing.T) {
+		if err := MigrateUp(db); err != nil {
+			t.Fatal("Error migrating: ", err.Error())
+		}
+		if err := MigrateUp(db); err != nil {
+			t.Fatal("Error migrating twice: ", err.Error())
+		}
+
+		applied := []SchemaMigration{}
+		db.Order("version asc").Find(&applied)
+		if len(applied) != len(migrations) {
+			t.Fatalf("Incorrect number of migrations. Expected: %d, Got: %d\n", len(migrations), len(applied))
+		}
+
+		for _, table := range []string{"users", "schedules", "executions", "leader_leases"} {
+			if !db.HasTable(table) {
+				t.Errorf("Table %s not created\n", table)
+			}
+		}
+
+		s := Schedule{Time: time.Now(), Status: "PENDING", Headers: Headers{"A": "b"}}
+		if err := db.Create(&s).Error; err != nil {
+			t.Error("Error creating schedule: ", err.Error())
+		}
+	})
+
+	t.Run("status lists applied and pending migrations", func(t *testing.T) {
+		if err := MigrateDown(db, 1); err != nil {
+			t.Fatal("Error reverting: ", err.Error())
+		}
+
+		statuses, err := MigrationStatuses(db)
+		if err != nil {
+			t.Fatal("Error listing migrations: ", err.Error())
+		}
+		if len(statuses) != len(migrations) {
+			t.Fatalf("Incorrect number of statuses. Expected: %d, Got: %d\n", len(migrations), len(statuses))
+		}
+		for i, s := range statuses {
+			pending := i == len(statuses)-1
+			if s.Version != migrations[i].Version || (s.AppliedAt == nil) != pending {
+				t.Errorf("Incorrect status: %+v\n", s)
+			}
+		}
+
+		if err := MigrateUp(db); err != nil {
+			t.Fatal("Error migrating: ", err.Error())
+		}
+	})
+
+	t.Run("down reverts everything", func(t *testing.T) {
+		if err := MigrateDown(db, len(migrations)); err != nil {
+			t.Fatal("Error reverting: ", err.Error())
+		}
+
+		if db.HasTable("schedules") {
+			t.Error("Table schedules not dropped")
+		}
+
+		count := -1
+		db.Model(&SchemaMigration{}).Count(&count)
+		if count != 0 {
+			t.Errorf("Incorrect number of migrations. Expected: %d, Got: %d\n", 0, count)
+		}
+	})
+
+	t.Run("newer schema is refused", func(t *testing.T) {
+		if err := MigrateUp(db); err != nil {
+			t.Fatal("Error migrating: ", err.Error())
+		}
+
+		newer := SchemaMigration{Version: latestVersion() + 1, Name: "from the future", AppliedAt: time.Now().UTC()}
+		db.Create(&newer)
+		defer db.Delete(&newer)
+
+		if err := MigrateUp(db); err == nil {
+			t.Error("Newer schema not refused")
+		}
+		if err := MigrateDown(db, 1); err == nil {
+			t.Error("Unknown migration reverted")
+		}
+	})
+
+	t.Run("schedules are given to the user named in source", func(t *testing.T) {
+		if err := MigrateDown(db, latestVersion()-2); err != nil {
+			t.Fatal("Error reverting: ", err.Error())
+		}
+
+		db.Exec("INSERT INTO users (email, name) VALUES (?, ?), (?, ?), (?, ?)",
+			"a@example.com", "alice", "b@example.com", "bob", "b2@example.com", "bob")
+		db.Exec("INSERT INTO schedules (source, status) VALUES (?, ?), (?, ?)",
+			"alice", "PENDING", "bob", "PENDING")
+
+		if err := MigrateUp(db); err != nil {
+			t.Fatal("Error migrating: ", err.Error())
+		}
+
+		alice := User{}
+		db.Where("name = ?", "alice").First(&alice)
+
+		schedules := []Schedule{}
+		db.Order("source asc").Find(&schedules)
+		if len(schedules) != 2 || schedules[0].UserID != alice.ID || schedules[1].UserID != 0 {
+			t.Errorf("Owners not set correctly: %+v\n", schedules)
+		}
+	})
+
+	t.Run("existing sessions and api keys keep every scope", func(t *testing.T) {
+		if err := MigrateDown(db, latestVersion()-8); err != nil {
+			t.Fatal("Error reverting: ", err.Error())
+		}
+
+		db.Exec("INSERT INTO sessions (user_id, refresh_hash) VALUES (?, ?)", 1, "hash")
+		db.Exec("INSERT INTO api_keys (user_id, key_hash) VALUES (?, ?)", 1, "hash")
+
+		if err := MigrateUp(db); err != nil {
+			t.Fatal("Error migrating: ", err.Error())
+		}
+
+		s := Session{}
+		db.First(&s)
+		k := APIKey{}
+		db.First(&k)
+		if !reflect.DeepEqual(s.Scopes, AllScopes) || !reflect.DeepEqual(k.Scopes, AllScopes.without(ScopeAccount)) {
+			t.Errorf("Scopes not set correctly: %v %v\n", s.Scopes, k.Scopes)
+		}
+	})
+
+	t.Run("api keys lose the account scope", func(t *testing.T) {
+		if err := MigrateDown(db, 1); err != nil {
+			t.Fatal("Error reverting: ", err.Error())
+		}
+
+		db.Exec("DELETE FROM api_keys")
+		db.Exec("INSERT INTO api_keys (user_id, key_hash, scopes) VALUES (?, ?, ?), (?, ?, ?)",
+			1, "full", "schedules:read schedules:write executions:read teams:read teams:write admin account",
+			1, "limited", "account schedules:read")
+
+		if err := MigrateUp(db); err != nil {
+			t.Fatal("Error migrating: ", err.Error())
+		}
+
+		keys := []APIKey{}
+		db.Order("id").Find(&keys)
+		if len(keys) != 2 || !reflect.DeepEqual(keys[0].Scopes, AllScopes.without(ScopeAccount)) || !reflect.DeepEqual(keys[1].Scopes, Scopes{ScopeSchedulesRead}) {
+			t.Errorf("Scopes not set correctly: %+v\n", keys)
+		}
+	})
+
+	t.Run("databases created before migrations are adopted", func(t *testing.T) {
+		if err := MigrateDown(db, len(migrations)); err != nil {
+			t.Fatal("Error reverting: ", err.Error())
+		}
+		db.DropTableIfExists(&SchemaMigration{})
+
+		// what MigrateDB used to do
+		db.AutoMigrate(&User{}, &Schedule{}, &Execution{}, &LeaderLease{})
+		db.Create(&User{Email: "old@example.com"})
+
+		if err := MigrateUp(db); err != nil {
+			t.Fatal("Error migrating: ", err.Error())
+		}
+
+		count := 0
+		db.Model(&User{}).Count(&count)
+		if count != 1 {
+			t.Errorf("Incorrect number of users. Expected: %d, Got: %d\n", 1, count)
+		}
+	})
+}
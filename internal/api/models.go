@@ -1,6 +1,11 @@
 package api
 
-import "time"
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"time"
+)
 
 // DBModel is the base model for all db items
 type DBModel struct {
@@ -10,23 +15,289 @@ type DBModel struct {
 	DeletedAt *time.Time `json:"-"`
 }
 
-// User is the struct that holds user specific information
+// User is the struct that holds user specific information. Admins manage the
+// other users, disabled users can not log in.
 type User struct {
 	DBModel
-	Email string `json:"email,omitempty"`
-	Name  string `json:"name,omitempty"`
-	Hash  string `json:"-"`
+	Email    string `json:"email,omitempty"`
+	Name     string `json:"name,omitempty"`
+	Hash     string `json:"-"`
+	Admin    bool   `json:"admin"`
+	Disabled bool   `json:"disabled"`
+
+	// TOTPSecret is set when the user enrolls in two-factor authentication,
+	// which is only required at login once TOTPEnabled is confirmed with a
+	// code. TOTPLastStep is the time step of the last code used.
+	TOTPSecret   string `json:"-"`
+	TOTPEnabled  bool   `json:"totp_enabled"`
+	TOTPLastStep int64  `json:"-"`
 }
 
-// Schedule is the struct that holds the schedule information
+// Schedule is the struct that holds the schedule information. Schedules are
+// created by the user with UserID, Source is the name of that user. A
+// schedule with a TeamID is shared with the members of that team, otherwise
+// only its creator has access to it.
+//
+// URL, Method, Headers and Body describe the request made when the schedule
+// fires. An empty URL falls back to the global url of the HTTPClient.
+//
+// Recurring schedules have a Cron expression evaluated in TimeZone. Their
+// Time is the next time they fire and their Status stays PENDING, each run
+// is recorded as an Execution instead.
+//
+// A schedule with Coalesce set shares a single call with the other due
+// coalescing schedules that have the same target.
+//
+// Failed runs are retried according to the RetryPolicy. While waiting for a
+// retry the Status is RETRYING, Time is the time of the next attempt and
+// Attempts counts the attempts made so far.
+//
+// While a run is in progress the Status is RUNNING and the schedule is
+// leased by the server running it until LeaseExpiresAt.
+//
+// Paused schedules have the Status PAUSED and don't fire. Version counts the
+// changes made to a schedule, by edits and by its runs, and is used to
+// detect conflicting edits.
 type Schedule struct {
 	DBModel
-	Time   time.Time `json:"time"`
-	Source string    `json:"source,omitempty"`
-	Status string    `json:"status"`
+	UserID   uint       `json:"user_id"`
+	TeamID   uint       `json:"team_id,omitempty"`
+	Time     time.Time  `json:"time"`
+	Source   string     `json:"source,omitempty"`
+	Status   string     `json:"status"`
+	URL      string     `json:"url,omitempty"`
+	Method   string     `json:"method,omitempty"`
+	Headers  Headers    `json:"headers,omitempty" gorm:"type:text"`
+	Body     string     `json:"body,omitempty" gorm:"type:text"`
+	Coalesce bool       `json:"coalesce"`
+	Cron     string     `json:"cron,omitempty"`
+	TimeZone string     `json:"timezone,omitempty"`
+	NextRun  *time.Time `json:"next_run,omitempty" gorm:"-"`
+	Attempts int        `json:"attempts"`
+	Version  int        `json:"version"`
+	RetryPolicy
+
+	LeaseOwner     string     `json:"-"`
+	LeaseExpiresAt *time.Time `json:"-"`
+}
+
+// RetryPolicy describes how failed runs of a schedule are retried. A
+// MaxAttempts of 0 or 1 disables retries. RetryableCodes is a comma separated
+// list of status codes and ranges, e.g. "429,500-599".
+type RetryPolicy struct {
+	MaxAttempts    int     `json:"max_attempts,omitempty"`
+	RetryDelay     Seconds `json:"retry_delay,omitempty"`
+	Backoff        float64 `json:"backoff,omitempty"`
+	Jitter         float64 `json:"jitter,omitempty"`
+	RetryableCodes string  `json:"retryable_codes,omitempty"`
+}
+
+// Seconds is a duration stored in the db as a whole number of seconds. It is
+// written to json as a duration string like 1m30s, the form it is given in.
+type Seconds int
+
+// MarshalJSON implements json.Marshaler
+func (s Seconds) MarshalJSON() ([]byte, error) {
+	return json.Marshal((time.Duration(s) * time.Second).String())
+}
+
+// UnmarshalJSON implements json.Unmarshaler
+func (s *Seconds) UnmarshalJSON(b []byte) error {
+	var v string
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return err
+	}
+	*s = Seconds(d / time.Second)
+	return nil
+}
+
+// AfterFind is a gorm callback exposing the next run of recurring schedules
+func (s *Schedule) AfterFind() error {
+	if s.Cron != "" {
+		next := s.Time
+		s.NextRun = &next
+	}
+	return nil
+}
+
+// Execution records a single attempt to run a schedule along with the
+// response of the remote endpoint. The captured response headers and body are
+// truncated to keep the table small.
+type Execution struct {
+	DBModel
+	ScheduleID      uint      `json:"schedule_id" gorm:"index"`
+	Time            time.Time `json:"time"`
+	Attempt         int       `json:"attempt"`
+	Status          string    `json:"status"`
+	StartedAt       time.Time `json:"started_at"`
+	FinishedAt      time.Time `json:"finished_at"`
+	Latency         int64     `json:"latency_ms"`
+	StatusCode      int       `json:"status_code,omitempty"`
+	ResponseHeaders Headers   `json:"response_headers,omitempty" gorm:"type:text"`
+	ResponseBody    string    `json:"response_body,omitempty" gorm:"type:text"`
+	Error           string    `json:"error,omitempty" gorm:"type:text"`
+}
+
+// LeaderLease is the row held by the replica currently dispatching
+// schedules. The holder renews ExpiresAt while it is alive, once it expires
+// any replica may take over.
+type LeaderLease struct {
+	Name      string    `json:"name" gorm:"primary_key"`
+	Holder    string    `json:"holder"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// Team is a group of users sharing schedules
+type Team struct {
+	DBModel
+	Name string `json:"name"`
+	Role string `json:"role,omitempty" gorm:"-"` // role of the current user
+}
+
+// Membership gives a user a Role in a team. Viewers can see the schedules of
+// the team, editors can also create and delete them and owners can also
+// manage the members.
+type Membership struct {
+	DBModel
+	TeamID uint   `json:"team_id"`
+	UserID uint   `json:"user_id"`
+	Role   string `json:"role"`
+}
+
+// Session is a login of a user. Access tokens name the session they were
+// issued for and are refused once it is revoked or expired. Only hashes of
+// the refresh token and the one it replaced are stored. The access tokens
+// of a session carry its Scopes.
+type Session struct {
+	DBModel
+	UserID       uint       `json:"user_id"`
+	RefreshHash  string     `json:"-"`
+	PreviousHash string     `json:"-"`
+	Scopes       Scopes     `json:"scopes"`
+	ExpiresAt    time.Time  `json:"expires_at"`
+	RevokedAt    *time.Time `json:"revoked_at,omitempty"`
+}
+
+// Invite lets the holder of its token register with Email until ExpiresAt.
+// Only a hash of the token is stored. An invite with a TeamID makes the new
+// user a member of that team with Role.
+type Invite struct {
+	DBModel
+	Email       string     `json:"email"`
+	TokenHash   string     `json:"-"`
+	Token       string     `json:"token,omitempty" gorm:"-"` // only set when created
+	TeamID      uint       `json:"team_id,omitempty"`
+	Role        string     `json:"role,omitempty"`
+	CreatedByID uint       `json:"created_by_id"`
+	ExpiresAt   time.Time  `json:"expires_at"`
+	UsedAt      *time.Time `json:"used_at,omitempty"`
+}
+
+// APIKey lets machine clients act as the user with UserID without a
+// password, limited to its Scopes. Only a hash of the key is stored, Prefix
+// is kept to tell keys apart.
+type APIKey struct {
+	DBModel
+	UserID     uint       `json:"user_id"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"`
+	KeyHash    string     `json:"-"`
+	Key        string     `json:"key,omitempty" gorm:"-"` // only set when created
+	Scopes     Scopes     `json:"scopes"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+}
+
+// RecoveryCode lets the user with UserID log in once without their TOTP
+// code. Only a hash of the code is stored.
+type RecoveryCode struct {
+	DBModel
+	UserID   uint       `json:"user_id"`
+	CodeHash string     `json:"-"`
+	UsedAt   *time.Time `json:"used_at,omitempty"`
+}
+
+// PasswordReset lets the holder of its token set a new password for the user
+// with UserID until ExpiresAt. Only a hash of the token is stored.
+type PasswordReset struct {
+	DBModel
+	UserID    uint       `json:"user_id"`
+	TokenHash string     `json:"-"`
+	ExpiresAt time.Time  `json:"expires_at"`
+	UsedAt    *time.Time `json:"used_at,omitempty"`
+}
+
+// OIDCState is a single sign-on login waiting for the identity provider to
+// send the browser back. Only a hash of the state is stored, the Nonce and
+// the PKCE Verifier are checked when it comes back.
+type OIDCState struct {
+	DBModel
+	StateHash string    `json:"-"`
+	Nonce     string    `json:"-"`
+	Verifier  string    `json:"-"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// TableName keeps gorm from naming the table o_id_c_states
+func (OIDCState) TableName() string {
+	return "oidc_states"
+}
+
+// AuditEntry records a security relevant event, like an account being
+// locked out, for admins to review
+type AuditEntry struct {
+	DBModel
+	Action     string    `json:"action"`
+	UserID     uint      `json:"user_id,omitempty"`
+	Email      string    `json:"email,omitempty"`
+	IP         string    `json:"ip,omitempty"`
+	Detail     string    `json:"detail,omitempty"`
+	OccurredAt time.Time `json:"occurred_at"`
+}
+
+// Headers holds the http headers sent with a schedule. It is stored in the
+// db as a json encoded string
+type Headers map[string]string
+
+// Value implements driver.Valuer so Headers can be written to the db
+func (h Headers) Value() (driver.Value, error) {
+	if len(h) == 0 {
+		return "", nil
+	}
+	b, err := json.Marshal(h)
+	if err != nil {
+		return nil, err
+	}
+	return string(b), nil
+}
+
+// Scan implements sql.Scanner so Headers can be read from the db
+func (h *Headers) Scan(src interface{}) error {
+	var b []byte
+	switch v := src.(type) {
+	case nil:
+		*h = nil
+		return nil
+	case string:
+		b = []byte(v)
+	case []byte:
+		b = v
+	default:
+		return errors.New("Unsupported type for headers")
+	}
+
+	if len(b) == 0 {
+		*h = nil
+		return nil
+	}
+	return json.Unmarshal(b, h)
 }
 
-// MigrateDB creates all necessary database relations
-func (routes *Routes) MigrateDB() {
-	routes.db.AutoMigrate(&User{}, &Schedule{})
+// MigrateDB brings the schema up to date by applying any pending migrations
+func (routes *Routes) MigrateDB() error {
+	return MigrateUp(routes.db)
 }
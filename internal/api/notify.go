@@ -0,0 +1,56 @@
+package api
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// Notifier delivers messages to users, like the links of password resets.
+// Plug in email or chat delivery with SetNotifier.
+type Notifier interface {
+	Notify(to string, subject string, body string) error
+}
+
+// SetNotifier replaces how users are notified. NewRoutes starts with a
+// LogNotifier.
+func (routes *Routes) SetNotifier(n Notifier) {
+	routes.notifier = n
+}
+
+// LogNotifier writes messages to the server log, for local use
+type LogNotifier struct{}
+
+// Notify implements Notifier
+func (LogNotifier) Notify(to string, subject string, body string) error {
+	log.Printf("Notification to %s: %s\n%s\n", to, subject, body)
+	return nil
+}
+
+// FileNotifier appends messages to the file at Path, for local use and tests
+// of clients
+type FileNotifier struct {
+	Path string
+
+	mu sync.Mutex
+}
+
+// Notify implements Notifier
+func (n *FileNotifier) Notify(to string, subject string, body string) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	f, err := os.OpenFile(n.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(f, "Date: %s\nTo: %s\nSubject: %s\n\n%s\n\n", time.Now().UTC().Format(time.RFC1123Z), to, subject, body)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,517 @@
+package api
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+// oidcStateCookie binds a single sign-on login to the browser that started it
+const oidcStateCookie = "oidc_state"
+
+// oidcLoginTTL is how long a user has to log in with the identity provider
+const oidcLoginTTL = 10 * time.Minute
+
+// jwksRefreshInterval is how often the keys of the identity provider may be
+// fetched again for an unknown key id, so tokens with made up key ids can't
+// make us hammer the provider
+const jwksRefreshInterval = time.Minute
+
+// oidcLeeway is the clock skew allowed with the identity provider
+const oidcLeeway = time.Minute
+
+// OIDCConfig configures single sign-on with an OpenID Connect identity
+// provider, see SetOIDC
+type OIDCConfig struct {
+	// Issuer is the url of the provider. Its discovery document is at
+	// Issuer/.well-known/openid-configuration
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	// RedirectURL is the url of OIDCCallback, as registered with the
+	// provider
+	RedirectURL string
+	// AutoProvision creates users on their first login. Otherwise only
+	// existing users can log in.
+	AutoProvision bool
+	// LoginPage is where the browser is sent back to with the session
+	// tokens, or an error, in the url fragment. Defaults to /login.
+	LoginPage string
+}
+
+// SetOIDC turns on single sign-on with an OpenID Connect provider. The
+// provider is only contacted once someone logs in, so it being down does not
+// stop the server from starting.
+func (routes *Routes) SetOIDC(config OIDCConfig) error {
+	if config.Issuer == "" || config.ClientID == "" || config.RedirectURL == "" {
+		return errors.New("OIDC requires an issuer, a client id and a redirect url")
+	}
+	if _, err := url.Parse(config.RedirectURL); err != nil {
+		return fmt.Errorf("Invalid OIDC redirect url: %s", err.Error())
+	}
+	if config.LoginPage == "" {
+		config.LoginPage = "/login"
+	}
+
+	routes.oidc = newOIDCProvider(config)
+	return nil
+}
+
+// OIDCLogin sends the browser to the identity provider to log in
+func (routes *Routes) OIDCLogin(w http.ResponseWriter, r *http.Request) {
+	if routes.oidc == nil {
+		writeErrorMessage(w, "Single sign-on is not configured", http.StatusNotFound)
+		return
+	}
+
+	d, err := routes.oidc.discover()
+	if err != nil {
+		log.Printf("Error discovering the identity provider: %s\n", err.Error())
+		writeErrorMessage(w, "Error contacting the identity provider", http.StatusBadGateway)
+		return
+	}
+
+	var tokens [3]string
+	for i := range tokens {
+		if tokens[i], err = randomToken(); err != nil {
+			writeErrorMessage(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	state, nonce, verifier := tokens[0], tokens[1], tokens[2]
+
+	now := time.Now().UTC()
+	routes.db.Unscoped().Where("expires_at < ?", now).Delete(&OIDCState{})
+
+	s := OIDCState{
+		StateHash: hashToken(state),
+		Nonce:     nonce,
+		Verifier:  verifier,
+		ExpiresAt: now.Add(oidcLoginTTL),
+	}
+	if err := routes.db.Create(&s).Error; err != nil {
+		writeErrorMessage(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookie,
+		Value:    state,
+		Path:     "/oidc",
+		MaxAge:   int(oidcLoginTTL.Seconds()),
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(routes.oidc.config.RedirectURL, "https://"),
+		// sent along when the provider redirects back
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	challenge := sha256.Sum256([]byte(verifier))
+	v := url.Values{}
+	v.Set("response_type", "code")
+	v.Set("client_id", routes.oidc.config.ClientID)
+	v.Set("redirect_uri", routes.oidc.config.RedirectURL)
+	v.Set("scope", "openid email profile")
+	v.Set("state", state)
+	v.Set("nonce", nonce)
+	v.Set("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:]))
+	v.Set("code_challenge_method", "S256")
+
+	sep := "?"
+	if strings.Contains(d.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	http.Redirect(w, r, d.AuthorizationEndpoint+sep+v.Encode(), http.StatusFound)
+}
+
+// OIDCCallback finishes a single sign-on login when the identity provider
+// sends the browser back. The user with the email of the ID token is logged
+// in, or created when OIDCConfig.AutoProvision is set, and the browser is
+// sent on to the login page with the session tokens in the url fragment.
+func (routes *Routes) OIDCCallback(w http.ResponseWriter, r *http.Request) {
+	if routes.oidc == nil {
+		writeErrorMessage(w, "Single sign-on is not configured", http.StatusNotFound)
+		return
+	}
+
+	// the state is only good once
+	http.SetCookie(w, &http.Cookie{Name: oidcStateCookie, Path: "/oidc", MaxAge: -1})
+
+	if e := r.FormValue("error"); e != "" {
+		routes.oidcFailed(w, r, "Single sign-on failed: "+e, errors.New(r.FormValue("error_description")))
+		return
+	}
+
+	state := r.FormValue("state")
+	cookie, err := r.Cookie(oidcStateCookie)
+	if err != nil || state == "" || cookie.Value != state {
+		routes.oidcFailed(w, r, "Single sign-on failed. Please try again", errors.New("state does not match the cookie"))
+		return
+	}
+
+	s := OIDCState{}
+	routes.db.Where("state_hash = ?", hashToken(state)).First(&s)
+	result := routes.db.Unscoped().Where("id = ?", s.ID).Delete(&OIDCState{})
+	if s.ID == 0 || result.RowsAffected != 1 || s.ExpiresAt.Before(time.Now()) {
+		routes.oidcFailed(w, r, "Single sign-on expired. Please try again", errors.New("unknown or expired state"))
+		return
+	}
+
+	idToken, err := routes.oidc.exchange(r.FormValue("code"), s.Verifier)
+	if err != nil {
+		routes.oidcFailed(w, r, "Error contacting the identity provider", err)
+		return
+	}
+
+	claims, err := routes.oidc.verifyIDToken(idToken, s.Nonce)
+	if err != nil {
+		routes.oidcFailed(w, r, "Invalid ID token", err)
+		return
+	}
+
+	u, err := routes.ssoUser(claims)
+	if err != nil {
+		routes.oidcFailed(w, r, err.Error(), err)
+		return
+	}
+
+	// the same scopes as a password login, which also has to pass the
+	// second factor before it gets a session
+	scopes := loginScopes(u, AllScopes)
+	v := url.Values{}
+	if u.TOTPEnabled {
+		token, err := routes.signMFAToken(u, scopes)
+		if err != nil {
+			routes.oidcFailed(w, r, "Error starting a session", err)
+			return
+		}
+		v.Set("mfa_token", token)
+		v.Set("expires_in", strconv.Itoa(int(mfaTokenTTL.Seconds())))
+		http.Redirect(w, r, routes.oidc.config.LoginPage+"#"+v.Encode(), http.StatusFound)
+		return
+	}
+
+	access, refresh, err := routes.startSession(u, scopes)
+	if err != nil {
+		routes.oidcFailed(w, r, "Error starting a session", err)
+		return
+	}
+
+	v.Set("access_token", access)
+	v.Set("refresh_token", refresh)
+	http.Redirect(w, r, routes.oidc.config.LoginPage+"#"+v.Encode(), http.StatusFound)
+}
+
+// oidcFailed sends the browser back to the login page with message
+func (routes *Routes) oidcFailed(w http.ResponseWriter, r *http.Request, message string, err error) {
+	log.Printf("Error with single sign-on: %s: %s\n", message, err.Error())
+
+	v := url.Values{}
+	v.Set("error", message)
+	http.Redirect(w, r, routes.oidc.config.LoginPage+"#"+v.Encode(), http.StatusFound)
+}
+
+// ssoUser returns the user with the email of claims, creating them when
+// OIDCConfig.AutoProvision is set. Returned errors are safe to show to the
+// caller.
+func (routes *Routes) ssoUser(claims idTokenClaims) (User, error) {
+	if claims.Email == "" {
+		return User{}, errors.New("The identity provider did not share an email")
+	}
+	// a provider that doesn't say the email is verified could let anyone
+	// claim the account of an existing user
+	if claims.EmailVerified == nil || !*claims.EmailVerified {
+		return User{}, errors.New("Email not verified with the identity provider")
+	}
+
+	u := User{}
+	routes.db.Where("email = ?", claims.Email).First(&u)
+	if u.ID != 0 {
+		if u.Disabled {
+			return User{}, errors.New("Account disabled")
+		}
+		return u, nil
+	}
+
+	if !routes.oidc.config.AutoProvision {
+		return User{}, fmt.Errorf("No account for %s", claims.Email)
+	}
+
+	name := claims.Name
+	if name == "" {
+		name = claims.Email
+	}
+
+	// without a password hash they can only log in with single sign-on
+	u = User{Email: claims.Email, Name: name}
+	if err := routes.db.Create(&u).Error; err != nil {
+		return User{}, err
+	}
+	log.Printf("Created %s on their first single sign-on\n", u.Email)
+	return u, nil
+}
+
+// oidcProvider talks to the identity provider, caching its discovery
+// document and keys
+type oidcProvider struct {
+	config OIDCConfig
+	client *http.Client
+
+	mu          sync.Mutex
+	discovery   *oidcDiscovery
+	keys        map[string]interface{}
+	keysFetched time.Time
+}
+
+// oidcDiscovery is the part of the discovery document of the provider we use
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+func newOIDCProvider(config OIDCConfig) *oidcProvider {
+	return &oidcProvider{
+		config: config,
+		client: &http.Client{Timeout: 10 * time.Second},
+		keys:   map[string]interface{}{},
+	}
+}
+
+// discover returns the discovery document of the provider
+func (p *oidcProvider) discover() (oidcDiscovery, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.discovery != nil {
+		return *p.discovery, nil
+	}
+
+	d := oidcDiscovery{}
+	u := strings.TrimSuffix(p.config.Issuer, "/") + "/.well-known/openid-configuration"
+	if err := p.getJSON(u, &d); err != nil {
+		return d, err
+	}
+	if d.Issuer != p.config.Issuer {
+		return d, fmt.Errorf("Discovered issuer %s does not match %s", d.Issuer, p.config.Issuer)
+	}
+	if d.AuthorizationEndpoint == "" || d.TokenEndpoint == "" || d.JWKSURI == "" {
+		return d, errors.New("Discovery document is missing endpoints")
+	}
+
+	p.discovery = &d
+	return d, nil
+}
+
+// exchange trades the authorization code for an ID token
+func (p *oidcProvider) exchange(code string, verifier string) (string, error) {
+	if code == "" {
+		return "", errors.New("No authorization code")
+	}
+
+	d, err := p.discover()
+	if err != nil {
+		return "", err
+	}
+
+	v := url.Values{}
+	v.Set("grant_type", "authorization_code")
+	v.Set("code", code)
+	v.Set("redirect_uri", p.config.RedirectURL)
+	v.Set("code_verifier", verifier)
+	if p.config.ClientSecret == "" {
+		v.Set("client_id", p.config.ClientID)
+	}
+
+	req, err := http.NewRequest("POST", d.TokenEndpoint, strings.NewReader(v.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if p.config.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(p.config.ClientID), url.QueryEscape(p.config.ClientSecret))
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("Token endpoint returned %d", resp.StatusCode)
+	}
+
+	tokens := struct {
+		IDToken string `json:"id_token"`
+	}{}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&tokens); err != nil {
+		return "", err
+	}
+	if tokens.IDToken == "" {
+		return "", errors.New("Token endpoint returned no id_token")
+	}
+	return tokens.IDToken, nil
+}
+
+// idTokenClaims are the claims of an ID token we check or use
+type idTokenClaims struct {
+	Issuer        string   `json:"iss"`
+	Subject       string   `json:"sub"`
+	Audience      audience `json:"aud"`
+	ExpiresAt     int64    `json:"exp"`
+	IssuedAt      int64    `json:"iat"`
+	Nonce         string   `json:"nonce"`
+	Email         string   `json:"email"`
+	EmailVerified *bool    `json:"email_verified"`
+	Name          string   `json:"name"`
+}
+
+// Valid implements jwt.Claims
+func (c idTokenClaims) Valid() error {
+	if c.ExpiresAt == 0 {
+		return errors.New("Expiry not present on claims")
+	}
+	if time.Now().Add(-oidcLeeway).Unix() > c.ExpiresAt {
+		return errors.New("Token is expired")
+	}
+	return nil
+}
+
+// audience is the aud claim, a single string or a list of them
+type audience []string
+
+// UnmarshalJSON implements json.Unmarshaler
+func (a *audience) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		*a = audience{s}
+		return nil
+	}
+
+	var l []string
+	if err := json.Unmarshal(b, &l); err != nil {
+		return err
+	}
+	*a = l
+	return nil
+}
+
+func (a audience) contains(s string) bool {
+	for _, v := range a {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// verifyIDToken checks the signature of the ID token against the keys of the
+// provider, that it was issued by the provider for us and that it carries
+// nonce
+func (p *oidcProvider) verifyIDToken(raw string, nonce string) (idTokenClaims, error) {
+	claims := idTokenClaims{}
+	_, err := jwt.ParseWithClaims(raw, &claims, func(token *jwt.Token) (interface{}, error) {
+		// only the asymmetric algs, the client secret is no key
+		switch token.Method.(type) {
+		case *jwt.SigningMethodRSA, *jwt.SigningMethodECDSA:
+		default:
+			return nil, fmt.Errorf("Unexpected signing method: %v", token.Header["alg"])
+		}
+
+		kid, _ := token.Header["kid"].(string)
+		return p.key(kid)
+	})
+	if err != nil {
+		return claims, err
+	}
+
+	if claims.Issuer != p.config.Issuer {
+		return claims, fmt.Errorf("Unexpected issuer: %s", claims.Issuer)
+	}
+	if !claims.Audience.contains(p.config.ClientID) {
+		return claims, fmt.Errorf("Unexpected audience: %v", claims.Audience)
+	}
+	if nonce == "" || claims.Nonce != nonce {
+		return claims, errors.New("Nonce does not match")
+	}
+	return claims, nil
+}
+
+// key returns the public key of the provider with kid, fetching the keys
+// again when it is unknown. A token without a kid can only be checked when
+// the provider has a single key.
+func (p *oidcProvider) key(kid string) (interface{}, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if k, ok := p.lookup(kid); ok {
+		return k, nil
+	}
+
+	if time.Since(p.keysFetched) < jwksRefreshInterval {
+		return nil, fmt.Errorf("Unknown key id: %q", kid)
+	}
+	p.keysFetched = time.Now()
+
+	if p.discovery == nil {
+		return nil, errors.New("Provider not discovered")
+	}
+
+	set := jwkSet{}
+	if err := p.getJSON(p.discovery.JWKSURI, &set); err != nil {
+		return nil, err
+	}
+
+	p.keys = map[string]interface{}{}
+	for _, j := range set.Keys {
+		k, err := j.publicKey()
+		if err != nil {
+			log.Printf("Skipping key %q of the identity provider: %s\n", j.Kid, err.Error())
+			continue
+		}
+		p.keys[j.Kid] = k
+	}
+
+	if k, ok := p.lookup(kid); ok {
+		return k, nil
+	}
+	return nil, fmt.Errorf("Unknown key id: %q", kid)
+}
+
+func (p *oidcProvider) lookup(kid string) (interface{}, bool) {
+	if kid == "" && len(p.keys) == 1 {
+		for _, k := range p.keys {
+			return k, true
+		}
+	}
+	k, ok := p.keys[kid]
+	return k, ok
+}
+
+// getJSON decodes the json at u into v
+func (p *oidcProvider) getJSON(u string, v interface{}) error {
+	resp, err := p.client.Get(u)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %d", u, resp.StatusCode)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(v)
+}
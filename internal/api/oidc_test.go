@@ -0,0 +1,374 @@
+package api
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/gorilla/mux"
+)
+
+// stubIdP is an identity provider that logs in whoever it is told to
+type stubIdP struct {
+	server   *httptest.Server
+	rsaKey   *rsa.PrivateKey
+	ecKey    *ecdsa.PrivateKey
+	jwksHits int
+
+	mu     sync.Mutex
+	logins map[string]stubLogin
+}
+
+// stubLogin is a login the stub has authorized, waiting for its code to be
+// exchanged
+type stubLogin struct {
+	challenge string
+	claims    jwt.MapClaims
+	method    jwt.SigningMethod
+	kid       string
+}
+
+func newStubIdP(t *testing.T) *stubIdP {
+	idp := &stubIdP{logins: map[string]stubLogin{}}
+	idp.rsaKey, _ = rsa.GenerateKey(rand.Reader, 2048)
+	idp.ecKey, _ = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	b64 := func(b []byte) string {
+		return base64.RawURLEncoding.EncodeToString(b)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(oidcDiscovery{
+			Issuer:                idp.server.URL,
+			AuthorizationEndpoint: idp.server.URL + "/authorize",
+			TokenEndpoint:         idp.server.URL + "/token",
+			JWKSURI:               idp.server.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		idp.mu.Lock()
+		idp.jwksHits++
+		idp.mu.Unlock()
+
+		json.NewEncoder(w).Encode(jwkSet{Keys: []jwk{
+			{Kty: "RSA", Kid: "rsa", Use: "sig", N: b64(idp.rsaKey.N.Bytes()), E: b64(big.NewInt(int64(idp.rsaKey.E)).Bytes())},
+			{Kty: "EC", Kid: "ec", Crv: "P-256", X: b64(idp.ecKey.X.Bytes()), Y: b64(idp.ecKey.Y.Bytes())},
+			{Kty: "oct", Kid: "secret"},
+		}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		// client credentials are form encoded, see RFC 6749 2.3.1
+		id, secret, _ := r.BasicAuth()
+		id, _ = url.QueryUnescape(id)
+		secret, _ = url.QueryUnescape(secret)
+		if id != "scheduler" || secret != "client secret" || r.FormValue("grant_type") != "authorization_code" {
+			http.Error(w, "invalid_client", http.StatusUnauthorized)
+			return
+		}
+
+		idp.mu.Lock()
+		login, ok := idp.logins[r.FormValue("code")]
+		delete(idp.logins, r.FormValue("code"))
+		idp.mu.Unlock()
+
+		// PKCE
+		sum := sha256.Sum256([]byte(r.FormValue("code_verifier")))
+		if !ok || b64(sum[:]) != login.challenge {
+			http.Error(w, "invalid_grant", http.StatusBadRequest)
+			return
+		}
+
+		token := jwt.NewWithClaims(login.method, login.claims)
+		token.Header["kid"] = login.kid
+		var key interface{} = idp.rsaKey
+		switch login.method {
+		case jwt.SigningMethodES256:
+			key = idp.ecKey
+		case jwt.SigningMethodHS256:
+			key = []byte(secret)
+		}
+		signed, err := token.SignedString(key)
+		if err != nil {
+			t.Errorf("Error signing id token: %s\n", err.Error())
+		}
+
+		json.NewEncoder(w).Encode(map[string]string{"access_token": "abc", "token_type": "Bearer", "id_token": signed})
+	})
+
+	idp.server = httptest.NewServer(mux)
+	return idp
+}
+
+// authorize logs in at the stub as the user of claims, returning the
+// redirect back to the scheduler
+func (idp *stubIdP) authorize(t *testing.T, location string, claims jwt.MapClaims, method jwt.SigningMethod, kid string) string {
+	u, err := url.Parse(location)
+	if err != nil {
+		t.Fatalf("Error parsing redirect: %s\n", err.Error())
+	}
+	q := u.Query()
+	if q.Get("client_id") != "scheduler" || q.Get("code_challenge_method") != "S256" || q.Get("scope") != "openid email profile" {
+		t.Fatalf("Incorrect authorization request: %s\n", location)
+	}
+
+	full := jwt.MapClaims{
+		"iss":            idp.server.URL,
+		"sub":            "1234",
+		"aud":            []string{"scheduler", "other"},
+		"exp":            time.Now().Add(time.Minute).Unix(),
+		"iat":            time.Now().Unix(),
+		"nonce":          q.Get("nonce"),
+		"email_verified": true,
+	}
+	for k, v := range claims {
+		full[k] = v
+	}
+
+	code, _ := randomToken()
+	idp.mu.Lock()
+	idp.logins[code] = stubLogin{challenge: q.Get("code_challenge"), claims: full, method: method, kid: kid}
+	idp.mu.Unlock()
+
+	v := url.Values{}
+	v.Set("code", code)
+	v.Set("state", q.Get("state"))
+	return q.Get("redirect_uri") + "?" + v.Encode()
+}
+
+func TestOIDC(t *testing.T) {
+	// create dummy db
+	db, cleanup := openTestDB(t)
+	defer cleanup()
+
+	idp := newStubIdP(t)
+	defer idp.server.Close()
+
+	routes := NewRoutes(db, []byte("secret"), &HTTPClient{})
+	routes.MigrateDB()
+
+	config := OIDCConfig{
+		Issuer:       idp.server.URL,
+		ClientID:     "scheduler",
+		ClientSecret: "client secret",
+		RedirectURL:  "http://scheduler/oidc/callback",
+	}
+	if err := routes.SetOIDC(config); err != nil {
+		t.Fatalf("Error setting oidc: %s\n", err.Error())
+	}
+
+	existing := User{Email: "me@email.com", Name: "me", Hash: hashPassword("pw")}
+	disabled := User{Email: "disabled@email.com", Name: "disabled", Disabled: true}
+	twoFactor := User{Email: "mfa@email.com", Name: "mfa", TOTPSecret: "JBSWY3DPEHPK3PXP", TOTPEnabled: true}
+	db.Create(&existing)
+	db.Create(&disabled)
+	db.Create(&twoFactor)
+
+	router := mux.NewRouter()
+	router.HandleFunc("/oidc/login", routes.OIDCLogin).Methods("GET")
+	router.HandleFunc("/oidc/callback", routes.OIDCCallback).Methods("GET")
+	a := router.PathPrefix("/").Subrouter()
+	a.Use(routes.AuthMiddleware)
+	a.HandleFunc("/me", routes.Me).Methods("GET")
+
+	serve := func(path string, cookies []*http.Cookie, header string, value string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", path, nil)
+		for _, c := range cookies {
+			req.AddCookie(c)
+		}
+		if value != "" {
+			req.Header.Set(header, value)
+		}
+
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	// start logs in at the scheduler, returning the redirect to the stub
+	// and the state cookie
+	start := func(t *testing.T) (string, []*http.Cookie) {
+		rr := serve("/oidc/login", nil, "", "")
+		if rr.Code != http.StatusFound {
+			t.Fatalf("Incorrect status. Expected: %d, Got: %d\n", http.StatusFound, rr.Code)
+		}
+		return rr.Header().Get("Location"), rr.Result().Cookies()
+	}
+
+	// fragment returns the url fragment the callback sent the browser to
+	fragment := func(t *testing.T, rr *httptest.ResponseRecorder) url.Values {
+		if rr.Code != http.StatusFound {
+			t.Fatalf("Incorrect status. Expected: %d, Got: %d\n", http.StatusFound, rr.Code)
+		}
+		u, _ := url.Parse(rr.Header().Get("Location"))
+		if u.Path != "/login" {
+			t.Errorf("Incorrect redirect. Expected: %s, Got: %s\n", "/login", u.Path)
+		}
+		v, _ := url.ParseQuery(u.Fragment)
+		return v
+	}
+
+	testHarness := []struct {
+		testName      string
+		claims        jwt.MapClaims
+		method        jwt.SigningMethod
+		kid           string
+		autoProvision bool
+		err           string
+	}{
+		{testName: "existing user", claims: jwt.MapClaims{"email": "me@email.com"}},
+		{testName: "es256", claims: jwt.MapClaims{"email": "me@email.com"}, method: jwt.SigningMethodES256, kid: "ec"},
+		{testName: "unknown user", claims: jwt.MapClaims{"email": "new@email.com"}, err: "No account for new@email.com"},
+		{testName: "auto provision", claims: jwt.MapClaims{"email": "new@email.com", "name": "new"}, autoProvision: true},
+		{testName: "disabled user", claims: jwt.MapClaims{"email": "disabled@email.com"}, err: "Account disabled"},
+		{testName: "unverified email", claims: jwt.MapClaims{"email": "me@email.com", "email_verified": false}, err: "Email not verified with the identity provider"},
+		{testName: "email verification missing", claims: jwt.MapClaims{"email": "me@email.com", "email_verified": nil}, err: "Email not verified with the identity provider"},
+		{testName: "no email", err: "The identity provider did not share an email"},
+		{testName: "wrong audience", claims: jwt.MapClaims{"email": "me@email.com", "aud": "other"}, err: "Invalid ID token"},
+		{testName: "wrong issuer", claims: jwt.MapClaims{"email": "me@email.com", "iss": "http://evil"}, err: "Invalid ID token"},
+		{testName: "wrong nonce", claims: jwt.MapClaims{"email": "me@email.com", "nonce": "abc"}, err: "Invalid ID token"},
+		{testName: "expired", claims: jwt.MapClaims{"email": "me@email.com", "exp": time.Now().Add(-2 * time.Minute).Unix()}, err: "Invalid ID token"},
+		{testName: "signed with the client secret", claims: jwt.MapClaims{"email": "me@email.com"}, method: jwt.SigningMethodHS256, kid: "secret", err: "Invalid ID token"},
+		{testName: "wrong key", claims: jwt.MapClaims{"email": "me@email.com"}, method: jwt.SigningMethodRS256, kid: "ec", err: "Invalid ID token"},
+		{testName: "unknown key", claims: jwt.MapClaims{"email": "me@email.com"}, method: jwt.SigningMethodRS256, kid: "other", err: "Invalid ID token"},
+	}
+
+	for _, th := range testHarness {
+		t.Run(th.testName, func(t *testing.T) {
+			routes.oidc.config.AutoProvision = th.autoProvision
+			if th.method == nil {
+				th.method, th.kid = jwt.SigningMethodRS256, "rsa"
+			}
+
+			location, cookies := start(t)
+			callback := idp.authorize(t, location, th.claims, th.method, th.kid)
+			v := fragment(t, serve(callback, cookies, "", ""))
+
+			if v.Get("error") != th.err {
+				t.Fatalf("Incorrect error. Expected: %q, Got: %q\n", th.err, v.Get("error"))
+			}
+			if th.err != "" {
+				return
+			}
+
+			rr := serve("/me", nil, "Authorization", "Bearer "+v.Get("access_token"))
+			if rr.Code != http.StatusOK {
+				t.Fatalf("Incorrect status. Expected: %d, Got: %d\n", http.StatusOK, rr.Code)
+			}
+			me := User{}
+			json.NewDecoder(rr.Body).Decode(&me)
+			if me.Email != th.claims["email"] || v.Get("refresh_token") == "" {
+				t.Errorf("Incorrect user: %+v\n", me)
+			}
+		})
+	}
+
+	t.Run("scopes", func(t *testing.T) {
+		location, cookies := start(t)
+		callback := idp.authorize(t, location, jwt.MapClaims{"email": "me@email.com"}, jwt.SigningMethodRS256, "rsa")
+		v := fragment(t, serve(callback, cookies, "", ""))
+
+		claims, err := routes.parseClaims(v.Get("access_token"), accessAudience)
+		if err != nil {
+			t.Fatalf("Error parsing access token: %s\n", err.Error())
+		}
+		if claims.Scopes.has(ScopeAdmin) || !claims.Scopes.has(ScopeAccount) {
+			t.Errorf("Incorrect scopes: %v\n", claims.Scopes)
+		}
+	})
+
+	t.Run("second factor", func(t *testing.T) {
+		location, cookies := start(t)
+		callback := idp.authorize(t, location, jwt.MapClaims{"email": "mfa@email.com"}, jwt.SigningMethodRS256, "rsa")
+		v := fragment(t, serve(callback, cookies, "", ""))
+
+		if v.Get("access_token") != "" || v.Get("refresh_token") != "" {
+			t.Fatalf("Logged in without the second factor\n")
+		}
+		if _, err := routes.parseClaims(v.Get("mfa_token"), mfaAudience); err != nil {
+			t.Fatalf("Incorrect mfa token: %s\n", err.Error())
+		}
+		if v.Get("expires_in") != strconv.Itoa(int(mfaTokenTTL.Seconds())) {
+			t.Errorf("Incorrect expires_in. Expected: %d, Got: %s\n", int(mfaTokenTTL.Seconds()), v.Get("expires_in"))
+		}
+
+		var sessions int
+		db.Model(&Session{}).Where("user_id = ?", twoFactor.ID).Count(&sessions)
+		if sessions != 0 {
+			t.Errorf("Incorrect number of sessions. Expected: %d, Got: %d\n", 0, sessions)
+		}
+	})
+
+	t.Run("provisioned users have no password", func(t *testing.T) {
+		u := User{}
+		db.Where("email = ?", "new@email.com").First(&u)
+		if u.Name != "new" || u.Hash != "" || verifyPassword("", u.Hash) {
+			t.Errorf("Incorrect provisioned user: %+v\n", u)
+		}
+	})
+
+	t.Run("unknown keys are fetched at most once a minute", func(t *testing.T) {
+		idp.mu.Lock()
+		defer idp.mu.Unlock()
+		if idp.jwksHits != 1 {
+			t.Errorf("Incorrect number of jwks fetches. Expected: %d, Got: %d\n", 1, idp.jwksHits)
+		}
+	})
+
+	t.Run("state", func(t *testing.T) {
+		location, cookies := start(t)
+		callback := idp.authorize(t, location, jwt.MapClaims{"email": "me@email.com"}, jwt.SigningMethodRS256, "rsa")
+
+		for _, c := range cookies {
+			if c.Name == oidcStateCookie && (!c.HttpOnly || c.SameSite != http.SameSiteLaxMode) {
+				t.Errorf("Incorrect cookie: %+v\n", c)
+			}
+		}
+
+		// the state has to come back to the browser that started the login
+		if v := fragment(t, serve(callback, nil, "", "")); v.Get("error") == "" {
+			t.Errorf("Logged in without the state cookie\n")
+		}
+		other, _ := start(t)
+		otherState, _ := url.Parse(other)
+		forged := &http.Cookie{Name: oidcStateCookie, Value: otherState.Query().Get("state")}
+		if v := fragment(t, serve(callback, []*http.Cookie{forged}, "", "")); v.Get("error") == "" {
+			t.Errorf("Logged in with the state cookie of another login\n")
+		}
+
+		if v := fragment(t, serve(callback, cookies, "", "")); v.Get("error") != "" {
+			t.Fatalf("Incorrect error. Expected: %q, Got: %q\n", "", v.Get("error"))
+		}
+		if v := fragment(t, serve(callback, cookies, "", "")); v.Get("error") != "Single sign-on expired. Please try again" {
+			t.Errorf("Incorrect error. Expected: %q, Got: %q\n", "Single sign-on expired. Please try again", v.Get("error"))
+		}
+	})
+
+	t.Run("provider errors", func(t *testing.T) {
+		_, cookies := start(t)
+		rr := serve("/oidc/callback?error=access_denied&error_description=no", cookies, "", "")
+		if v := fragment(t, rr); v.Get("error") != "Single sign-on failed: access_denied" {
+			t.Errorf("Incorrect error. Expected: %q, Got: %q\n", "Single sign-on failed: access_denied", v.Get("error"))
+		}
+	})
+
+	t.Run("not configured", func(t *testing.T) {
+		routes.oidc = nil
+		if rr := serve("/oidc/login", nil, "", ""); rr.Code != http.StatusNotFound {
+			t.Errorf("Incorrect status. Expected: %d, Got: %d\n", http.StatusNotFound, rr.Code)
+		}
+	})
+}
@@ -0,0 +1,133 @@
+package api
+
+import (
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// Password hashes are bcrypt hashes, which start with their version and cost
+// like $2a$10$. Hashes without a $ prefix are legacy PBKDF2-SHA1 hashes,
+// stored as hex salt:key. They still verify and are replaced by a bcrypt
+// hash the next time their user logs in.
+
+// maxPasswordLength is the most bcrypt can hash
+const maxPasswordLength = 72
+
+// passwordCost is the bcrypt cost of new hashes, see SetPasswordCost
+var passwordCost = bcrypt.DefaultCost
+
+// parameters of legacy PBKDF2 hashes
+var iterations = 10000
+var keyLength = 32
+
+// SetPasswordCost sets the bcrypt cost of new password hashes. Hashes of
+// another cost are rehashed when their user logs in.
+func SetPasswordCost(cost int) error {
+	if cost < bcrypt.MinCost || cost > bcrypt.MaxCost {
+		return fmt.Errorf("Invalid password cost %d. Must be between %d and %d", cost, bcrypt.MinCost, bcrypt.MaxCost)
+	}
+
+	passwordCost = cost
+	return nil
+}
+
+// checkPassword returns an error safe to show to the caller when password can
+// not be used
+func checkPassword(password string) error {
+	if password == "" {
+		return errors.New("Password required")
+	}
+	if len(password) > maxPasswordLength {
+		return fmt.Errorf("Password too long. Must be at most %d bytes", maxPasswordLength)
+	}
+	return nil
+}
+
+func createPasswordHash(password string) (string, error) {
+	h, err := bcrypt.GenerateFromPassword([]byte(password), passwordCost)
+	if err != nil {
+		return "", err
+	}
+	return string(h), nil
+}
+
+// verifyPassword reports whether password matches a bcrypt or legacy hash.
+// Both are compared in constant time.
+func verifyPassword(password string, hash string) bool {
+	if strings.HasPrefix(hash, "$") {
+		return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+	}
+
+	p := strings.Split(hash, ":")
+	if len(p) != 2 {
+		return false
+	}
+
+	salt, err := hex.DecodeString(p[0])
+	if err != nil {
+		return false
+	}
+	key, err := hex.DecodeString(p[1])
+	if err != nil || len(key) != keyLength {
+		return false
+	}
+
+	k := pbkdf2.Key([]byte(password), salt, iterations, keyLength, sha1.New)
+	return subtle.ConstantTimeCompare(key, k) == 1
+}
+
+// dummyHash is a hash of an unknown password, see dummyPasswordHash
+var dummyHash struct {
+	sync.Mutex
+	cost int
+	hash string
+}
+
+// dummyPasswordHash returns a bcrypt hash of passwordCost that no password
+// matches. Logins of unknown emails check against it to take as long as
+// logins with a wrong password.
+func dummyPasswordHash() string {
+	dummyHash.Lock()
+	defer dummyHash.Unlock()
+
+	if dummyHash.hash == "" || dummyHash.cost != passwordCost {
+		password, err := randomToken()
+		if err == nil {
+			dummyHash.hash, err = createPasswordHash(password)
+		}
+		if err != nil {
+			log.Printf("Error creating dummy password hash: %s\n", err.Error())
+			return ""
+		}
+		dummyHash.cost = passwordCost
+	}
+	return dummyHash.hash
+}
+
+// rehashPassword replaces the hash of the user with a new hash of password.
+// Failing is logged, the old hash still works.
+func (routes *Routes) rehashPassword(u User, password string) {
+	h, err := createPasswordHash(password)
+	if err == nil {
+		err = routes.db.Model(&u).Update("hash", h).Error
+	}
+	if err != nil {
+		log.Printf("Error rehashing password of user %d: %s\n", u.ID, err.Error())
+	}
+}
+
+// needsRehash reports whether hash is a legacy hash or a bcrypt hash of
+// another cost than passwordCost
+func needsRehash(hash string) bool {
+	cost, err := bcrypt.Cost([]byte(hash))
+	return err != nil || cost != passwordCost
+}
@@ -0,0 +1,242 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// passwordResetTTL is how long a password reset token can be used
+const passwordResetTTL = time.Hour
+
+// passwordResetCooldown is how long after a reset link is sent to a user
+// further requests for them are ignored, so nobody can flood their inbox
+const passwordResetCooldown = time.Minute
+
+// errInvalidReset is returned for reset tokens that are unknown, used or
+// expired
+var errInvalidReset = errors.New("Invalid or expired reset token")
+
+// errResetCooldown is returned when a reset link was sent too recently
+var errResetCooldown = errors.New("Password reset sent too recently")
+
+// SetResetURL sets the page of the client that password reset links point
+// to. The token is added as the token query value.
+func (routes *Routes) SetResetURL(u string) error {
+	if _, err := url.Parse(u); err != nil {
+		return fmt.Errorf("Invalid password reset url: %s", err.Error())
+	}
+	routes.resetURL = u
+	return nil
+}
+
+// ChangePassword sets the password of the current user to the password form
+// value. It takes their current_password, and wrong ones count as failed
+// logins, see LoginLimits. Their other sessions are logged out.
+func (routes *Routes) ChangePassword(w http.ResponseWriter, r *http.Request) {
+	s := currentSession(r)
+	if s.ID == 0 {
+		writeErrorMessage(w, "Not logged in with a session", http.StatusBadRequest)
+		return
+	}
+
+	u := currentUser(r)
+	ip := clientIP(r)
+	account := strings.ToLower(u.Email)
+	if wait := routes.limiter.wait(ip, account); wait > 0 {
+		writeTooManyRequests(w, wait)
+		return
+	}
+
+	if !verifyPassword(r.FormValue("current_password"), u.Hash) {
+		routes.loginFailed(ip, account, u)
+		writeErrorMessage(w, "Incorrect password", http.StatusForbidden)
+		return
+	}
+
+	password := r.FormValue("password")
+	if err := checkPassword(password); err != nil {
+		writeErrorMessage(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	h, err := createPasswordHash(password)
+	if err != nil {
+		writeErrorMessage(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err := routes.db.Model(&u).Update("hash", h).Error; err != nil {
+		writeErrorMessage(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	routes.revokeOtherSessions(u.ID, s.ID)
+	routes.audit(AuditEntry{Action: AuditPasswordChanged, UserID: u.ID, Email: u.Email, IP: ip})
+}
+
+// ForgotPasswordFunc sends a password reset link to the email form value
+// through the Notifier. The link is sent in the background after answering,
+// so neither the answer nor how long it takes tells whether there is an
+// account for the email. Requests count against the failed logins of the IP,
+// see LoginLimits, and at most one link is sent to a user per
+// passwordResetCooldown.
+func (routes *Routes) ForgotPasswordFunc(w http.ResponseWriter, r *http.Request) {
+	email := r.FormValue("email")
+	if email == "" {
+		writeErrorMessage(w, "Email required", http.StatusBadRequest)
+		return
+	}
+
+	ip := clientIP(r)
+	if wait := routes.limiter.wait(ip, strings.ToLower(email)); wait > 0 {
+		writeTooManyRequests(w, wait)
+		return
+	}
+	routes.limiter.hit(ip)
+
+	w.WriteHeader(http.StatusAccepted)
+
+	routes.resets.Add(1)
+	go func() {
+		defer routes.resets.Done()
+		routes.sendPasswordReset(email)
+	}()
+}
+
+// sendPasswordReset creates a reset token for the user with email and sends
+// them the link, unless there is no such user or they were sent one in the
+// last passwordResetCooldown
+func (routes *Routes) sendPasswordReset(email string) {
+	u := User{}
+	routes.db.Where("email = ?", email).First(&u)
+	if u.ID == 0 || u.Disabled {
+		return
+	}
+
+	token, err := randomToken()
+	if err != nil {
+		log.Printf("Error creating password reset token: %s\n", err.Error())
+		return
+	}
+
+	now := time.Now().UTC()
+	err = transaction(routes.db, func(tx *gorm.DB) error {
+		// links expire passwordResetTTL after being sent, so a link expiring
+		// later than this was sent within the cooldown
+		recent := 0
+		err := tx.Model(&PasswordReset{}).
+			Where("user_id = ? AND expires_at > ?", u.ID, now.Add(passwordResetTTL-passwordResetCooldown)).
+			Count(&recent).Error
+		if err != nil {
+			return err
+		}
+		if recent > 0 {
+			return errResetCooldown
+		}
+
+		// only the latest link works
+		if err := tx.Unscoped().Where("user_id = ? AND used_at IS NULL", u.ID).Delete(&PasswordReset{}).Error; err != nil {
+			return err
+		}
+		return tx.Create(&PasswordReset{
+			UserID:    u.ID,
+			TokenHash: hashToken(token),
+			ExpiresAt: now.Add(passwordResetTTL),
+		}).Error
+	})
+	if err == errResetCooldown {
+		log.Printf("Password reset of user %d asked for again within %s, not sending\n", u.ID, passwordResetCooldown)
+		return
+	}
+	if err != nil {
+		log.Printf("Error creating password reset of user %d: %s\n", u.ID, err.Error())
+		return
+	}
+
+	link := routes.resetURL
+	if strings.Contains(link, "?") {
+		link += "&token=" + token
+	} else {
+		link += "?token=" + token
+	}
+
+	body := fmt.Sprintf("Someone asked to reset the password of your scheduler account. "+
+		"Set a new password within %s at\n\n%s\n\nIf it wasn't you, ignore this message.", passwordResetTTL, link)
+	if err := routes.notifier.Notify(u.Email, "Reset your password", body); err != nil {
+		log.Printf("Error sending password reset to user %d: %s\n", u.ID, err.Error())
+	}
+}
+
+// ResetPasswordFunc sets the password of the user a reset token was sent to
+// to the password form value. The token form value can only be used once.
+// All of the user's sessions are logged out and their API keys revoked, as
+// whoever took over the account could have made them.
+func (routes *Routes) ResetPasswordFunc(w http.ResponseWriter, r *http.Request) {
+	token := r.FormValue("token")
+	if token == "" {
+		writeErrorMessage(w, "Token required", http.StatusBadRequest)
+		return
+	}
+
+	password := r.FormValue("password")
+	if err := checkPassword(password); err != nil {
+		writeErrorMessage(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	reset := PasswordReset{}
+	routes.db.Where("token_hash = ?", hashToken(token)).First(&reset)
+
+	now := time.Now().UTC()
+	if reset.ID == 0 || reset.UsedAt != nil || !reset.ExpiresAt.After(now) {
+		writeErrorMessage(w, errInvalidReset.Error(), http.StatusForbidden)
+		return
+	}
+
+	// hashed only for a valid token, so bad tokens can't keep bcrypt busy
+	h, err := createPasswordHash(password)
+	if err != nil {
+		writeErrorMessage(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	u := User{}
+	err = transaction(routes.db, func(tx *gorm.DB) error {
+		// only one request can use the token
+		result := tx.Model(&PasswordReset{}).
+			Where("id = ? AND used_at IS NULL", reset.ID).
+			Update("used_at", now)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected != 1 {
+			return errInvalidReset
+		}
+
+		tx.Where("id = ?", reset.UserID).First(&u)
+		if u.ID == 0 || u.Disabled {
+			return errInvalidReset
+		}
+		return tx.Model(&u).Update("hash", h).Error
+	})
+	if err == errInvalidReset {
+		writeErrorMessage(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		writeErrorMessage(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	routes.revokeSessions(u.ID)
+	routes.revokeAPIKeys(u.ID)
+	routes.limiter.succeed(strings.ToLower(u.Email))
+	routes.audit(AuditEntry{Action: AuditPasswordReset, UserID: u.ID, Email: u.Email, IP: clientIP(r)})
+}
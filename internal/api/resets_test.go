@@ -0,0 +1,258 @@
+package api
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// testNotifier records the messages sent to users
+type testNotifier struct {
+	mu       sync.Mutex
+	messages []string
+}
+
+func (n *testNotifier) Notify(to string, subject string, body string) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.messages = append(n.messages, to+"\n"+body)
+	return nil
+}
+
+// token returns the reset token of the last message, empty when there is
+// none
+func (n *testNotifier) token(t *testing.T) string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if len(n.messages) == 0 {
+		return ""
+	}
+
+	link := regexp.MustCompile(`https://\S+`).FindString(n.messages[len(n.messages)-1])
+	u, err := url.Parse(link)
+	if err != nil {
+		t.Fatalf("Error parsing reset link: %s\n", err.Error())
+	}
+	return u.Query().Get("token")
+}
+
+func TestPasswordResets(t *testing.T) {
+	// create dummy db
+	db, cleanup := openTestDB(t)
+	defer cleanup()
+
+	routes := NewRoutes(db, []byte("secret"), &HTTPClient{})
+	routes.MigrateDB()
+	routes.SetResetURL("https://scheduler/reset-password")
+	notifier := &testNotifier{}
+	routes.SetNotifier(notifier)
+
+	u := User{Email: "me@email.com", Name: "me", Hash: hashPassword("pw")}
+	disabled := User{Email: "disabled@email.com", Name: "disabled", Hash: hashPassword("pw"), Disabled: true}
+	db.Create(&u)
+	db.Create(&disabled)
+
+	router := mux.NewRouter()
+	router.HandleFunc("/login", routes.LoginFunc).Methods("POST")
+	router.HandleFunc("/password/forgot", routes.ForgotPasswordFunc).Methods("POST")
+	router.HandleFunc("/password/reset", routes.ResetPasswordFunc).Methods("POST")
+	a := router.PathPrefix("/").Subrouter()
+	a.Use(routes.AuthMiddleware)
+	a.HandleFunc("/me", routes.Me).Methods("GET")
+	a.HandleFunc("/me/password", routes.ChangePassword).Methods("POST")
+
+	serve := func(method string, path string, access string, payload string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, path, bytes.NewBuffer([]byte(payload)))
+		req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+		if access != "" {
+			req.Header.Set("Authorization", "Bearer "+access)
+		}
+
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	login := func(password string) *httptest.ResponseRecorder {
+		return serve("POST", "/login", "", "email=me@email.com&password="+password)
+	}
+
+	// reset links are sent in the background
+	forgot := func(email string) *httptest.ResponseRecorder {
+		rr := serve("POST", "/password/forgot", "", "email="+email)
+		routes.resets.Wait()
+		return rr
+	}
+
+	// lets another link be sent right away
+	endCooldown := func() {
+		db.Model(&PasswordReset{}).Where("user_id = ?", u.ID).
+			Update("expires_at", time.Now().UTC().Add(passwordResetTTL-passwordResetCooldown-time.Second))
+	}
+
+	access := func(t *testing.T, password string) string {
+		rr := login(password)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("Incorrect status. Expected: %d, Got: %d\n", http.StatusOK, rr.Code)
+		}
+		body, _ := ioutil.ReadAll(rr.Body)
+		return string(body)
+	}
+
+	t.Run("change password", func(t *testing.T) {
+		token := access(t, "pw")
+		other := access(t, "pw")
+
+		testHarness := []struct {
+			testName string
+			payload  string
+			status   int
+		}{
+			{testName: "wrong current password", payload: "current_password=wrong&password=n3w_pw", status: http.StatusForbidden},
+			{testName: "no current password", payload: "password=n3w_pw", status: http.StatusForbidden},
+			{testName: "empty password", payload: "current_password=pw", status: http.StatusBadRequest},
+			{testName: "change", payload: "current_password=pw&password=n3w_pw", status: http.StatusOK},
+		}
+
+		for _, th := range testHarness {
+			t.Run(th.testName, func(t *testing.T) {
+				if status := serve("POST", "/me/password", token, th.payload).Code; status != th.status {
+					t.Errorf("Incorrect status. Expected: %d, Got: %d\n", th.status, status)
+				}
+			})
+		}
+
+		if rr := login("pw"); rr.Code != http.StatusUnauthorized {
+			t.Errorf("Incorrect status. Expected: %d, Got: %d\n", http.StatusUnauthorized, rr.Code)
+		}
+		access(t, "n3w_pw")
+
+		// the session changing it stays logged in, the others are logged out
+		if rr := serve("GET", "/me", token, ""); rr.Code != http.StatusOK {
+			t.Errorf("Incorrect status. Expected: %d, Got: %d\n", http.StatusOK, rr.Code)
+		}
+		if rr := serve("GET", "/me", other, ""); rr.Code != http.StatusUnauthorized {
+			t.Errorf("Incorrect status. Expected: %d, Got: %d\n", http.StatusUnauthorized, rr.Code)
+		}
+	})
+
+	t.Run("forgot password", func(t *testing.T) {
+		token := access(t, "n3w_pw")
+		key := APIKey{UserID: u.ID, Name: "ci", Scopes: AllScopes.without(ScopeAccount), KeyHash: hashToken(apiKeyPrefix + "ci")}
+		db.Create(&key)
+
+		for _, email := range []string{"nobody@email.com", "disabled@email.com"} {
+			if rr := forgot(email); rr.Code != http.StatusAccepted {
+				t.Errorf("Incorrect status. Expected: %d, Got: %d\n", http.StatusAccepted, rr.Code)
+			}
+		}
+		if reset := notifier.token(t); reset != "" {
+			t.Fatalf("Reset sent without an account\n")
+		}
+
+		forgot("me@email.com")
+		old := notifier.token(t)
+
+		// asking again right away sends nothing
+		if rr := forgot("me@email.com"); rr.Code != http.StatusAccepted {
+			t.Errorf("Incorrect status. Expected: %d, Got: %d\n", http.StatusAccepted, rr.Code)
+		}
+		if len(notifier.messages) != 1 {
+			t.Fatalf("Reset sent within the cooldown: %v\n", notifier.messages)
+		}
+
+		endCooldown()
+		forgot("me@email.com")
+		reset := notifier.token(t)
+		if reset == "" || reset == old || !strings.HasPrefix(notifier.messages[1], "me@email.com\n") {
+			t.Fatalf("Incorrect reset messages: %v\n", notifier.messages)
+		}
+
+		testHarness := []struct {
+			testName string
+			payload  string
+			status   int
+		}{
+			{testName: "replaced token", payload: "token=" + old + "&password=r3set_pw", status: http.StatusForbidden},
+			{testName: "unknown token", payload: "token=abc&password=r3set_pw", status: http.StatusForbidden},
+			{testName: "empty password", payload: "token=" + reset, status: http.StatusBadRequest},
+			{testName: "reset", payload: "token=" + reset + "&password=r3set_pw", status: http.StatusOK},
+			{testName: "used token", payload: "token=" + reset + "&password=other_pw", status: http.StatusForbidden},
+		}
+
+		for _, th := range testHarness {
+			t.Run(th.testName, func(t *testing.T) {
+				if status := serve("POST", "/password/reset", "", th.payload).Code; status != th.status {
+					t.Errorf("Incorrect status. Expected: %d, Got: %d\n", th.status, status)
+				}
+			})
+		}
+
+		access(t, "r3set_pw")
+		for _, access := range []string{token, apiKeyPrefix + "ci"} {
+			if rr := serve("GET", "/me", access, ""); rr.Code != http.StatusUnauthorized {
+				t.Errorf("Incorrect status. Expected: %d, Got: %d\n", http.StatusUnauthorized, rr.Code)
+			}
+		}
+	})
+
+	t.Run("expired token", func(t *testing.T) {
+		endCooldown()
+		forgot("me@email.com")
+		reset := notifier.token(t)
+		db.Model(&PasswordReset{}).Where("token_hash = ?", hashToken(reset)).Update("expires_at", time.Now().UTC().Add(-time.Minute))
+
+		if rr := serve("POST", "/password/reset", "", "token="+reset+"&password=other_pw"); rr.Code != http.StatusForbidden {
+			t.Errorf("Incorrect status. Expected: %d, Got: %d\n", http.StatusForbidden, rr.Code)
+		}
+	})
+
+	t.Run("requests are limited per ip", func(t *testing.T) {
+		routes.SetLoginLimits(LoginLimits{Window: time.Minute, IPFailures: 2})
+		defer routes.SetLoginLimits(DefaultLoginLimits)
+
+		for i, status := range []int{http.StatusAccepted, http.StatusAccepted, http.StatusTooManyRequests} {
+			if rr := forgot("nobody@email.com"); rr.Code != status {
+				t.Errorf("Incorrect status of request %d. Expected: %d, Got: %d\n", i, status, rr.Code)
+			}
+		}
+	})
+
+	t.Run("audited", func(t *testing.T) {
+		count := -1
+		db.Model(&AuditEntry{}).Where("user_id = ? AND action IN (?)", u.ID, []string{AuditPasswordChanged, AuditPasswordReset}).Count(&count)
+		if count != 2 {
+			t.Errorf("Incorrect number of audit entries. Expected: %d, Got: %d\n", 2, count)
+		}
+	})
+}
+
+func TestFileNotifier(t *testing.T) {
+	dir, err := ioutil.TempDir("", "notify")
+	if err != nil {
+		t.Fatalf("Error creating dir: %s\n", err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	n := &FileNotifier{Path: filepath.Join(dir, "messages")}
+	n.Notify("me@email.com", "first", "one")
+	n.Notify("you@email.com", "second", "two")
+
+	b, _ := ioutil.ReadFile(n.Path)
+	for _, s := range []string{"To: me@email.com\nSubject: first\n\none\n", "To: you@email.com\nSubject: second\n\ntwo\n"} {
+		if !strings.Contains(string(b), s) {
+			t.Errorf("Message missing from file: %q\n", s)
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultRetryDelay     = 10
+	defaultBackoff        = 2.0
+	defaultRetryableCodes = "408,429,500-599"
+)
+
+// Limits of the retry policy. maxRetryDelay also caps the delay that grows
+// with every attempt.
+const (
+	maxRetryAttempts = 100
+	maxRetryDelay    = 24 * time.Hour
+	maxBackoff       = 10.0
+)
+
+// responseError is returned when the remote endpoint responds with a non 2xx
+// status code
+type responseError struct {
+	code int
+}
+
+func (e *responseError) Error() string {
+	return fmt.Sprintf("Invalid response code: %d", e.code)
+}
+
+// shouldRetry reports whether another attempt should be made after the
+// failed attempt that returned err. Network errors are always retryable,
+// bad responses only when their code is one of the RetryableCodes.
+func (p RetryPolicy) shouldRetry(attempts int, err error) bool {
+	if err == nil || attempts >= p.MaxAttempts {
+		return false
+	}
+
+	respErr, ok := err.(*responseError)
+	if !ok {
+		return true
+	}
+
+	codes := p.RetryableCodes
+	if codes == "" {
+		codes = defaultRetryableCodes
+	}
+	retryable, _ := codeInList(respErr.code, codes)
+	return retryable
+}
+
+// delay calculates how long to wait before the next attempt, given the number
+// of attempts made so far. It is never more than maxRetryDelay.
+func (p RetryPolicy) delay(attempts int) time.Duration {
+	delay := float64(p.RetryDelay)
+	if delay <= 0 {
+		delay = defaultRetryDelay
+	}
+
+	backoff := p.Backoff
+	if backoff <= 0 {
+		backoff = defaultBackoff
+	}
+
+	delay *= math.Pow(backoff, float64(attempts-1))
+	if p.Jitter > 0 {
+		delay *= 1 + p.Jitter*(rand.Float64()*2-1)
+	}
+
+	// large backoffs overflow a time.Duration after a few attempts
+	if delay > maxRetryDelay.Seconds() {
+		return maxRetryDelay
+	}
+	return time.Duration(delay * float64(time.Second))
+}
+
+// codeInList checks if code is in the comma separated list of codes and
+// ranges. An error is returned when the list is malformed.
+func codeInList(code int, list string) (bool, error) {
+	found := false
+	for _, part := range strings.Split(list, ",") {
+		bounds := strings.SplitN(strings.TrimSpace(part), "-", 2)
+		low, err := strconv.Atoi(bounds[0])
+		if err != nil {
+			return false, fmt.Errorf("Invalid status code: %s", part)
+		}
+		high := low
+		if len(bounds) == 2 {
+			if high, err = strconv.Atoi(bounds[1]); err != nil {
+				return false, fmt.Errorf("Invalid status code: %s", part)
+			}
+		}
+		if low < 100 || high > 599 || low > high {
+			return false, fmt.Errorf("Invalid status code: %s", part)
+		}
+		if code >= low && code <= high {
+			found = true
+		}
+	}
+	return found, nil
+}
+
+// setRetryPolicy reads the retry policy of a schedule from the form values of
+// r. Returned errors are safe to show to the caller.
+func setRetryPolicy(p *RetryPolicy, r *http.Request) error {
+	if v := strings.TrimSpace(r.FormValue("max_attempts")); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 || n > maxRetryAttempts {
+			return fmt.Errorf("Invalid max_attempts. Must be an integer between 0 and %d", maxRetryAttempts)
+		}
+		p.MaxAttempts = n
+	}
+
+	if v := strings.TrimSpace(r.FormValue("retry_delay")); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < time.Second || d > maxRetryDelay {
+			return fmt.Errorf("Invalid retry_delay. Must be a duration between 1s and %s, e.g. 30s", maxRetryDelay)
+		}
+		p.RetryDelay = Seconds(d / time.Second)
+	}
+
+	if v := strings.TrimSpace(r.FormValue("backoff")); v != "" {
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil || !(f >= 1 && f <= maxBackoff) {
+			return fmt.Errorf("Invalid backoff. Must be a number between 1 and %g", maxBackoff)
+		}
+		p.Backoff = f
+	}
+
+	if v := strings.TrimSpace(r.FormValue("jitter")); v != "" {
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil || !(f >= 0 && f <= 1) {
+			return errors.New("Invalid jitter. Must be a number between 0 and 1")
+		}
+		p.Jitter = f
+	}
+
+	if v := strings.TrimSpace(r.FormValue("retryable_codes")); v != "" {
+		if _, err := codeInList(0, v); err != nil {
+			return errors.New("Invalid retryable_codes. " + err.Error())
+		}
+		p.RetryableCodes = v
+	}
+
+	return nil
+}
@@ -0,0 +1,147 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestShouldRetry(t *testing.T) {
+	networkErr := errors.New("connection refused")
+
+	testHarness := []struct {
+		testName string
+		policy   RetryPolicy
+		attempts int
+		err      error
+		expected bool
+	}{
+		{testName: "success", policy: RetryPolicy{MaxAttempts: 3}, attempts: 1, err: nil, expected: false},
+		{testName: "retries disabled", policy: RetryPolicy{}, attempts: 1, err: networkErr, expected: false},
+		{testName: "network error", policy: RetryPolicy{MaxAttempts: 3}, attempts: 1, err: networkErr, expected: true},
+		{testName: "attempts used up", policy: RetryPolicy{MaxAttempts: 3}, attempts: 3, err: networkErr, expected: false},
+		{testName: "default retryable code", policy: RetryPolicy{MaxAttempts: 3}, attempts: 1, err: &responseError{code: 503}, expected: true},
+		{testName: "default non retryable code", policy: RetryPolicy{MaxAttempts: 3}, attempts: 1, err: &responseError{code: 404}, expected: false},
+		{testName: "custom retryable code", policy: RetryPolicy{MaxAttempts: 3, RetryableCodes: "404,502-504"}, attempts: 1, err: &responseError{code: 404}, expected: true},
+		{testName: "custom non retryable code", policy: RetryPolicy{MaxAttempts: 3, RetryableCodes: "404,502-504"}, attempts: 1, err: &responseError{code: 500}, expected: false},
+	}
+
+	for _, th := range testHarness {
+		t.Run(th.testName, func(t *testing.T) {
+			if retry := th.policy.shouldRetry(th.attempts, th.err); retry != th.expected {
+				t.Errorf("Incorrect retry decision. Expected: %t, Got: %t\n", th.expected, retry)
+			}
+		})
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	t.Run("exponential backoff", func(t *testing.T) {
+		p := RetryPolicy{RetryDelay: 5, Backoff: 3}
+		expected := []time.Duration{5 * time.Second, 15 * time.Second, 45 * time.Second}
+		for i, e := range expected {
+			if d := p.delay(i + 1); d != e {
+				t.Errorf("Incorrect delay for attempt %d. Expected: %s, Got: %s\n", i+1, e, d)
+			}
+		}
+	})
+
+	t.Run("defaults", func(t *testing.T) {
+		p := RetryPolicy{}
+		if d := p.delay(2); d != 20*time.Second {
+			t.Errorf("Incorrect default delay. Expected: 20s, Got: %s\n", d)
+		}
+	})
+
+	t.Run("capped", func(t *testing.T) {
+		p := RetryPolicy{RetryDelay: Seconds(maxRetryDelay / time.Second), Backoff: maxBackoff}
+		for _, attempts := range []int{2, maxRetryAttempts} {
+			if d := p.delay(attempts); d != maxRetryDelay {
+				t.Errorf("Incorrect delay for attempt %d. Expected: %s, Got: %s\n", attempts, maxRetryDelay, d)
+			}
+		}
+	})
+
+	t.Run("jitter", func(t *testing.T) {
+		p := RetryPolicy{RetryDelay: 10, Jitter: 0.5}
+		for i := 0; i < 100; i++ {
+			if d := p.delay(1); d < 5*time.Second || d > 15*time.Second {
+				t.Fatalf("Delay outside of jitter bounds: %s\n", d)
+			}
+		}
+	})
+}
+
+func TestCodeInList(t *testing.T) {
+	if found, err := codeInList(502, "429, 500-599"); err != nil || !found {
+		t.Error("Code in range not found")
+	}
+
+	if found, err := codeInList(404, "429,500-599"); err != nil || found {
+		t.Error("Code not in list was found")
+	}
+
+	for _, list := range []string{"abc", "500-", "600", "599-500", ""} {
+		if _, err := codeInList(500, list); err == nil {
+			t.Errorf("Malformed list not rejected: %s\n", list)
+		}
+	}
+}
+
+func TestSetRetryPolicy(t *testing.T) {
+	testHarness := []struct {
+		testName string
+		key      string
+		value    string
+		valid    bool
+	}{
+		{testName: "max attempts", key: "max_attempts", value: "5", valid: true},
+		{testName: "negative max attempts", key: "max_attempts", value: "-1"},
+		{testName: "too many max attempts", key: "max_attempts", value: "1000000"},
+		{testName: "retry delay", key: "retry_delay", value: "1m30s", valid: true},
+		{testName: "short retry delay", key: "retry_delay", value: "500ms"},
+		{testName: "long retry delay", key: "retry_delay", value: "48h"},
+		{testName: "backoff", key: "backoff", value: "1.5", valid: true},
+		{testName: "small backoff", key: "backoff", value: "0.5"},
+		{testName: "large backoff", key: "backoff", value: "1e300"},
+		{testName: "nan backoff", key: "backoff", value: "NaN"},
+		{testName: "nan jitter", key: "jitter", value: "NaN"},
+	}
+
+	for _, th := range testHarness {
+		t.Run(th.testName, func(t *testing.T) {
+			form := url.Values{}
+			form.Set(th.key, th.value)
+			r, _ := http.NewRequest("POST", "/schedules", strings.NewReader(form.Encode()))
+			r.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+
+			if err := setRetryPolicy(&RetryPolicy{}, r); (err == nil) != th.valid {
+				t.Errorf("Incorrect validity. Expected: %t, Got: %v\n", th.valid, err)
+			}
+		})
+	}
+}
+
+func TestRetryDelayJSON(t *testing.T) {
+	form := url.Values{}
+	form.Set("retry_delay", "1m30s")
+	r, _ := http.NewRequest("POST", "/schedules", strings.NewReader(form.Encode()))
+	r.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+
+	p := RetryPolicy{}
+	setRetryPolicy(&p, r)
+
+	b, _ := json.Marshal(p)
+	if string(b) != `{"retry_delay":"1m30s"}` {
+		t.Errorf("Incorrect json: %s\n", b)
+	}
+
+	decoded := RetryPolicy{}
+	if err := json.Unmarshal(b, &decoded); err != nil || decoded.RetryDelay != 90 {
+		t.Errorf("Incorrect retry delay. Expected: %d, Got: %d (%v)\n", 90, decoded.RetryDelay, err)
+	}
+}
@@ -1,11 +1,18 @@
 package api
 
 import (
-	"fmt"
+	"encoding/json"
+	"errors"
+	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
+	"sort"
+	"strings"
 	"time"
+	"unicode/utf8"
+
+	"github.com/jinzhu/gorm"
 )
 
 // HTTPClient interacts with the remote endpoint
@@ -14,73 +21,312 @@ type HTTPClient struct {
 	url    string
 }
 
-// NewHTTPClient initializes the http client and sets
-// the base url to the given url
-func NewHTTPClient(url string) *HTTPClient {
+// NewHTTPClient initializes the http client and sets the base url to the
+// given url. Requests taking longer than timeout are cancelled, a timeout of
+// 0 means no timeout.
+func NewHTTPClient(url string, timeout time.Duration) *HTTPClient {
 	return &HTTPClient{
 		url:    url,
-		client: http.DefaultClient,
+		client: &http.Client{Timeout: timeout},
 	}
 }
 
+// targetURL returns the url called by the schedule
+func (h *HTTPClient) targetURL(s Schedule) string {
+	if s.URL == "" {
+		return h.url
+	}
+	return s.URL
+}
+
 // CheckSchedules checks the pending schedules if it is time to deploy and
-// calls ExecuteSchedule to deploy if the time has come
+// calls ExecuteSchedule to deploy if the time has come. The calls are made
+// one after another, see Dispatcher to make them concurrently.
 func (r *Routes) CheckSchedules() {
-	schedules := []Schedule{}
-	err := r.db.Where("status = ?", "PENDING").Find(&schedules).Error
+	jobs, err := r.dueJobs()
 	if err != nil {
 		log.Printf("Error finding schedules: %s\n", err.Error())
 		return
 	}
 
-	schedulesToRun := []Schedule{}
+	for _, job := range jobs {
+		r.runJob(job)
+	}
+}
+
+// dueJobs groups the due schedules in to the calls that need to be made.
+// Every due schedule is a job of its own, except for coalescing schedules
+// which share a job with the other due coalescing schedules that have the
+// same target. Schedules left RUNNING by a worker whose lease expired are
+// due again. When ids are given only those schedules are considered.
+func (r *Routes) dueJobs(ids ...uint) ([][]Schedule, error) {
+	now := time.Now().UTC()
+	query := r.db.Where("status IN (?) OR (status = ? AND lease_expires_at < ?)",
+		[]string{"PENDING", "RETRYING"}, "RUNNING", now)
+	if len(ids) > 0 {
+		query = query.Where("id IN (?)", ids)
+	}
+
+	schedules := []Schedule{}
+	if err := query.Find(&schedules).Error; err != nil {
+		return nil, err
+	}
+
+	jobs := [][]Schedule{}
+	coalesced := map[string]int{}
 	for _, s := range schedules {
-		if s.Time.Before(time.Now()) {
-			schedulesToRun = append(schedulesToRun, s)
+		if !s.Time.Before(now) {
+			// the schedule was asked for by id but moved since
+			if len(ids) > 0 {
+				r.timers.set(s.ID, s.Time)
+			}
+			continue
+		}
+
+		if s.Coalesce {
+			key := s.targetKey()
+			if i, ok := coalesced[key]; ok {
+				jobs[i] = append(jobs[i], s)
+				continue
+			}
+			coalesced[key] = len(jobs)
 		}
+
+		jobs = append(jobs, []Schedule{s})
 	}
 
-	if len(schedulesToRun) > 0 {
-		err := r.httpClient.executeSchedule()
-		if err != nil {
-			log.Printf("ERROR: %s", err.Error())
-			for _, s := range schedulesToRun {
+	return jobs, nil
+}
+
+// runJob claims the schedules of a job, makes the call and saves the outcome
+// on the claimed schedules. It returns false when none of the schedules
+// could be claimed and no call was made.
+func (r *Routes) runJob(job []Schedule) (bool, error) {
+	claimed := r.claim(job)
+	if len(claimed) == 0 {
+		return false, nil
+	}
+
+	execution, err := r.httpClient.executeSchedule(claimed[0])
+	r.saveStatus(claimed, execution, err)
+	return true, err
+}
+
+// targetKey identifies the request made by a schedule. Schedules with equal
+// keys make identical calls.
+func (s Schedule) targetKey() string {
+	headers, _ := json.Marshal(s.Headers)
+	return strings.Join([]string{s.Method, s.URL, string(headers), s.Body}, "\x00")
+}
+
+// errLeaseLost is returned when a worker's lease on a schedule was taken over
+var errLeaseLost = errors.New("Lease lost")
+
+// saveStatus records a copy of execution for each schedule and marks one off
+// schedules as SENT or ERROR depending on err. Failed attempts are retried
+// as allowed by the schedule's RetryPolicy. Recurring schedules stay PENDING
+// and move on to their next run.
+func (r *Routes) saveStatus(schedules []Schedule, execution Execution, err error) {
+	status := "SENT"
+	if err != nil {
+		log.Printf("ERROR: %s", err.Error())
+		status = "ERROR"
+		execution.Error = err.Error()
+	}
+	execution.Status = status
+
+	for _, s := range schedules {
+		s.Attempts++
+
+		execution.ID = 0
+		execution.ScheduleID = s.ID
+		execution.Time = s.Time
+		execution.Attempt = s.Attempts
+
+		if s.shouldRetry(s.Attempts, err) {
+			s.Status = "RETRYING"
+			s.Time = time.Now().UTC().Add(s.delay(s.Attempts))
+		} else if s.Cron == "" {
+			s.Status = status
+			s.Attempts = 0
+		} else {
+			s.Status = "PENDING"
+			s.Attempts = 0
+
+			// runs missed while the server was down are skipped
+			next, err := s.nextRun(time.Now())
+			if err != nil {
+				log.Printf("Error calculating next run of schedule %d: %s\n", s.ID, err.Error())
 				s.Status = "ERROR"
-				if err := r.db.Save(&s).Error; err != nil {
-					log.Printf("Error saving status: %s\n", err.Error())
-				}
+			} else {
+				s.Time = next.UTC()
 			}
-			return
 		}
 
-		for _, s := range schedulesToRun {
-			s.Status = "SENT"
-			if err := r.db.Save(&s).Error; err != nil {
-				log.Printf("Error saving status: %s\n", err.Error())
+		// only release the lease and record the run if the lease is still
+		// ours, otherwise another worker has taken the schedule over and
+		// records its own run
+		err := transaction(r.db, func(tx *gorm.DB) error {
+			result := tx.Model(&Schedule{}).
+				Where("id = ? AND status = ? AND lease_owner = ?", s.ID, "RUNNING", r.instanceID).
+				Updates(map[string]interface{}{
+					"status":           s.Status,
+					"time":             s.Time,
+					"attempts":         s.Attempts,
+					"lease_owner":      "",
+					"lease_expires_at": nil,
+					"version":          gorm.Expr("version + 1"),
+				})
+			if result.Error != nil {
+				return result.Error
 			}
+			if result.RowsAffected != 1 {
+				return errLeaseLost
+			}
+			return tx.Create(&execution).Error
+		})
+		if err == errLeaseLost {
+			log.Printf("Lease on schedule %d was lost, not saving status\n", s.ID)
+			continue
+		}
+		if err != nil {
+			log.Printf("Error saving status: %s\n", err.Error())
+			continue
+		}
+
+		if s.Status == "PENDING" || s.Status == "RETRYING" {
+			r.timers.set(s.ID, s.Time)
+		} else {
+			r.timers.remove(s.ID)
 		}
 	}
 }
 
-// ExecuteSchedule calls the remote endpoint
-func (h *HTTPClient) executeSchedule() error {
+// loadTimers fills the timer queue with every waiting schedule. RUNNING
+// schedules are woken when their lease expires in case their worker died.
+func (r *Routes) loadTimers() error {
+	schedules := []Schedule{}
+	err := r.db.Select("id, time, status, lease_expires_at").
+		Where("status IN (?)", []string{"PENDING", "RETRYING", "RUNNING"}).
+		Find(&schedules).Error
+	if err != nil {
+		return err
+	}
+
+	for i, s := range schedules {
+		if s.Status == "RUNNING" && s.LeaseExpiresAt != nil {
+			schedules[i].Time = *s.LeaseExpiresAt
+		}
+	}
+
+	r.timers.reset(schedules)
+	return nil
+}
+
+// ExecuteSchedule calls the remote endpoint of the schedule, falling back to
+// the global url when the schedule has none. The returned Execution captures
+// the timing and response of the call, even when an error is returned.
+func (h *HTTPClient) executeSchedule(s Schedule) (execution Execution, err error) {
 	log.Println("Executing schedule!")
 
-	resp, err := h.client.Get(h.url)
+	url := h.targetURL(s)
+
+	method := s.Method
+	if method == "" {
+		method = "GET"
+	}
+
+	execution = Execution{StartedAt: time.Now()}
+	defer func() {
+		execution.FinishedAt = time.Now()
+		execution.Latency = int64(execution.FinishedAt.Sub(execution.StartedAt) / time.Millisecond)
+	}()
+
+	req, err := http.NewRequest(method, url, strings.NewReader(s.Body))
 	if err != nil {
-		return err
+		return execution, err
+	}
+
+	for k, v := range s.Headers {
+		// net/http only sends the Host of the request
+		if http.CanonicalHeaderKey(k) == "Host" {
+			req.Host = v
+			continue
+		}
+		req.Header.Set(k, v)
+	}
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return execution, err
 	}
+	defer func() {
+		// the connection is only reused once the body is read to the end,
+		// bodies too large to read are left to close it
+		io.Copy(ioutil.Discard, io.LimitReader(resp.Body, maxDrainedBody))
+		resp.Body.Close()
+	}()
+
+	execution.StatusCode = resp.StatusCode
+	execution.ResponseHeaders = truncateHeaders(resp.Header)
+
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxResponseBody+1))
+	execution.ResponseBody = storableText(string(body), maxResponseBody)
 
 	if resp.StatusCode < 200 || resp.StatusCode > 299 {
-		return fmt.Errorf("Invalid response code: %d", resp.StatusCode)
+		return execution, &responseError{code: resp.StatusCode}
 	}
 
-	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		return err
+		return execution, err
 	}
 
-	log.Printf("Response: %s\n", string(body))
+	log.Printf("Response: %s\n", execution.ResponseBody)
 
-	return nil
+	return execution, nil
+}
+
+const (
+	maxResponseBody        = 4096
+	maxResponseHeaders     = 32
+	maxResponseHeaderValue = 256
+	maxDrainedBody         = 256 << 10
+)
+
+// truncateHeaders flattens the response headers, keeping at most
+// maxResponseHeaders of them, each cut to maxResponseHeaderValue bytes, see
+// storableText
+func truncateHeaders(header http.Header) Headers {
+	keys := make([]string, 0, len(header))
+	for k := range header {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	if len(keys) > maxResponseHeaders {
+		keys = keys[:maxResponseHeaders]
+	}
+
+	headers := Headers{}
+	for _, k := range keys {
+		headers[k] = storableText(strings.Join(header[k], ", "), maxResponseHeaderValue)
+	}
+	return headers
+}
+
+// storableText makes s safe to store in a text column of every supported db.
+// Invalid UTF-8 is replaced, NULs are dropped and s is cut to at most max
+// bytes without splitting a character.
+func storableText(s string, max int) string {
+	s = strings.ToValidUTF8(s, "\uFFFD")
+	s = strings.Replace(s, "\x00", "", -1)
+	if len(s) <= max {
+		return s
+	}
+
+	cut := max
+	for cut > 0 && !utf8.RuneStart(s[cut]) {
+		cut--
+	}
+	return s[:cut]
 }
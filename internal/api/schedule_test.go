@@ -1,26 +1,21 @@
 package api
 
 import (
+	"bytes"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptest"
-	"os"
+	"strings"
+	"sync"
 	"testing"
 	"time"
-
-	"github.com/jinzhu/gorm"
 )
 
 func TestCheckSchedules(t *testing.T) {
 	// create dummy db
-	f, _ := ioutil.TempFile("", "")
-	db, err := gorm.Open("sqlite3", f.Name())
-	defer os.Remove(f.Name())
-	defer db.Close()
-
-	if err != nil {
-		t.Fatal("Error initializing test sqlite db")
-	}
+	db, cleanup := openTestDB(t)
+	defer cleanup()
 
 	t.Run("client success", func(t *testing.T) {
 		// create web endpoint
@@ -100,6 +95,222 @@ func TestCheckSchedules(t *testing.T) {
 			t.Error("Did not mark the schedule as error")
 		}
 	})
+
+	t.Run("schedule target", func(t *testing.T) {
+		called := ""
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			called = r.Method + " " + r.URL.Path
+			w.Write([]byte(`OK`))
+		}))
+		defer server.Close()
+
+		// the global url is unreachable so only the schedule url can succeed
+		httpClient := HTTPClient{
+			client: server.Client(),
+			url:    "http://127.0.0.1:1",
+		}
+
+		routes := NewRoutes(db, []byte{}, &httpClient)
+		routes.MigrateDB()
+
+		s := Schedule{
+			Time:   time.Now().Add(-1 * time.Minute),
+			Status: "PENDING",
+			Source: "jimbobjoe",
+			URL:    server.URL + "/deploy",
+			Method: "POST",
+		}
+		routes.db.Create(&s)
+
+		routes.CheckSchedules()
+
+		routes.db.First(&s, s.ID)
+		if s.Status != "SENT" {
+			t.Errorf("Incorrect status. Expected: SENT, Got: %s\n", s.Status)
+		}
+
+		if called != "POST /deploy" {
+			t.Errorf("Schedule target not called. Got: %s\n", called)
+		}
+	})
+
+	t.Run("independent and coalesced schedules", func(t *testing.T) {
+		calls := map[string]int{}
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			calls[r.URL.Path]++
+			w.Write([]byte(`OK`))
+		}))
+		defer server.Close()
+		httpClient := HTTPClient{
+			client: server.Client(),
+			url:    server.URL,
+		}
+
+		routes := NewRoutes(db, []byte{}, &httpClient)
+		routes.MigrateDB()
+
+		due := time.Now().Add(-1 * time.Minute)
+		for _, s := range []Schedule{
+			{URL: server.URL + "/independent"},
+			{URL: server.URL + "/independent"},
+			{URL: server.URL + "/coalesced", Coalesce: true},
+			{URL: server.URL + "/coalesced", Coalesce: true},
+			{URL: server.URL + "/coalesced", Coalesce: true, Body: "different"},
+		} {
+			s.Time = due
+			s.Status = "PENDING"
+			s.Source = "jimbobjoe"
+			routes.db.Create(&s)
+		}
+
+		routes.CheckSchedules()
+
+		if calls["/independent"] != 2 {
+			t.Errorf("Independent schedules not called separately. Calls: %d\n", calls["/independent"])
+		}
+
+		if calls["/coalesced"] != 2 {
+			t.Errorf("Coalesced schedules not deduplicated. Calls: %d\n", calls["/coalesced"])
+		}
+
+		var sent int
+		routes.db.Model(&Schedule{}).Where("url LIKE ? AND status = ?", server.URL+"%", "SENT").Count(&sent)
+		if sent != 5 {
+			t.Errorf("Incorrect number of sent schedules. Expected: 5, Got: %d\n", sent)
+		}
+	})
+
+	t.Run("retry failed schedule", func(t *testing.T) {
+		fail := true
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if fail {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			w.Write([]byte(`OK`))
+		}))
+		defer server.Close()
+		httpClient := HTTPClient{
+			client: server.Client(),
+			url:    server.URL,
+		}
+
+		routes := NewRoutes(db, []byte{}, &httpClient)
+		routes.MigrateDB()
+
+		s := Schedule{
+			Time:        time.Now().Add(-1 * time.Minute),
+			Status:      "PENDING",
+			Source:      "jimbobjoe",
+			URL:         server.URL,
+			RetryPolicy: RetryPolicy{MaxAttempts: 2, RetryDelay: 60},
+		}
+		routes.db.Create(&s)
+
+		routes.CheckSchedules()
+
+		routes.db.First(&s, s.ID)
+		if s.Status != "RETRYING" || s.Attempts != 1 {
+			t.Fatalf("Schedule not marked for retry. Status: %s, Attempts: %d\n", s.Status, s.Attempts)
+		}
+
+		if s.Time.Before(time.Now().Add(55 * time.Second)) {
+			t.Errorf("Retry not delayed: %s\n", s.Time)
+		}
+
+		// pretend the retry delay has passed
+		fail = false
+		routes.db.Model(&s).Update("time", time.Now().Add(-1*time.Second))
+
+		routes.CheckSchedules()
+
+		routes.db.First(&s, s.ID)
+		if s.Status != "SENT" || s.Attempts != 0 {
+			t.Errorf("Retry did not succeed. Status: %s, Attempts: %d\n", s.Status, s.Attempts)
+		}
+
+		executions := []Execution{}
+		routes.db.Where("schedule_id = ?", s.ID).Order("attempt").Find(&executions)
+		if len(executions) != 2 || executions[0].Status != "ERROR" || executions[0].StatusCode != 503 || executions[1].Attempt != 2 {
+			t.Errorf("Attempts not recorded correctly: %+v\n", executions)
+		}
+	})
+
+	t.Run("retries exhausted", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusInternalServerError)
+		}))
+		defer server.Close()
+		httpClient := HTTPClient{
+			client: server.Client(),
+			url:    server.URL,
+		}
+
+		routes := NewRoutes(db, []byte{}, &httpClient)
+		routes.MigrateDB()
+
+		s := Schedule{
+			Time:        time.Now().Add(-1 * time.Minute),
+			Status:      "RETRYING",
+			Source:      "jimbobjoe",
+			URL:         server.URL,
+			Attempts:    2,
+			RetryPolicy: RetryPolicy{MaxAttempts: 3},
+		}
+		routes.db.Create(&s)
+
+		routes.CheckSchedules()
+
+		routes.db.First(&s, s.ID)
+		if s.Status != "ERROR" {
+			t.Errorf("Incorrect status. Expected: ERROR, Got: %s\n", s.Status)
+		}
+	})
+
+	t.Run("recurring schedule", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(`OK`))
+		}))
+		defer server.Close()
+		httpClient := HTTPClient{
+			client: server.Client(),
+			url:    server.URL,
+		}
+
+		routes := NewRoutes(db, []byte{}, &httpClient)
+		routes.MigrateDB()
+
+		due := time.Now().Add(-1 * time.Minute)
+		s := Schedule{
+			Time:   due,
+			Status: "PENDING",
+			Source: "jimbobjoe",
+			URL:    server.URL,
+			Cron:   "@hourly",
+		}
+		routes.db.Create(&s)
+
+		routes.CheckSchedules()
+
+		routes.db.First(&s, s.ID)
+		if s.Status != "PENDING" {
+			t.Errorf("Recurring schedule status changed. Expected: PENDING, Got: %s\n", s.Status)
+		}
+
+		if !s.Time.After(time.Now()) || s.Time.Minute() != 0 {
+			t.Errorf("Recurring schedule not moved to the next run: %s\n", s.Time)
+		}
+
+		executions := []Execution{}
+		routes.db.Where("schedule_id = ?", s.ID).Find(&executions)
+		if len(executions) != 1 {
+			t.Fatalf("Incorrect number of executions. Expected: 1, Got: %d\n", len(executions))
+		}
+
+		if executions[0].Status != "SENT" || !executions[0].Time.Equal(due) {
+			t.Errorf("Execution not recorded correctly: %+v\n", executions[0])
+		}
+	})
 }
 
 func TestExecuteSchedule(t *testing.T) {
@@ -116,9 +327,193 @@ func TestExecuteSchedule(t *testing.T) {
 		url:    server.URL,
 	}
 
-	httpClient.executeSchedule()
+	httpClient.executeSchedule(Schedule{})
 
 	if !executed {
 		t.Error("HTTP Endpoint not executed")
 	}
 }
+
+func TestExecuteScheduleTarget(t *testing.T) {
+	var method, header, host, body string
+	// create fake web endpoint
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		method = r.Method
+		header = r.Header.Get("X-Token")
+		host = r.Host
+		b, _ := ioutil.ReadAll(r.Body)
+		body = string(b)
+		w.Header().Set("X-Reply", "yes")
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	httpClient := HTTPClient{
+		client: server.Client(),
+		url:    "http://global.invalid",
+	}
+
+	execution, err := httpClient.executeSchedule(Schedule{
+		URL:     server.URL + "/hook",
+		Method:  "POST",
+		Headers: Headers{"X-Token": "abc", "host": "hooks.example.com"},
+		Body:    `{"text":"deploy"}`,
+	})
+	if err != nil {
+		t.Fatal("Error executing schedule: ", err.Error())
+	}
+
+	if method != "POST" {
+		t.Errorf("Incorrect method. Expected: POST, Got: %s\n", method)
+	}
+
+	if header != "abc" {
+		t.Errorf("Header not sent. Expected: abc, Got: %s\n", header)
+	}
+
+	if host != "hooks.example.com" {
+		t.Errorf("Host not sent. Expected: hooks.example.com, Got: %s\n", host)
+	}
+
+	if body != `{"text":"deploy"}` {
+		t.Errorf("Body not sent. Got: %s\n", body)
+	}
+
+	if execution.StatusCode != http.StatusOK || execution.ResponseBody != "ok" || execution.ResponseHeaders["X-Reply"] != "yes" {
+		t.Errorf("Response not captured: %+v\n", execution)
+	}
+
+	if execution.StartedAt.IsZero() || execution.FinishedAt.Before(execution.StartedAt) {
+		t.Errorf("Timing not captured: %+v\n", execution)
+	}
+}
+
+func TestExecuteScheduleReusesConnections(t *testing.T) {
+	var mu sync.Mutex
+	connections := 0
+	// create fake web endpoint with a body longer than what is captured
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(strings.Repeat("a", 64<<10)))
+	}))
+	server.Config.ConnState = func(c net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			mu.Lock()
+			connections++
+			mu.Unlock()
+		}
+	}
+	server.Start()
+	defer server.Close()
+
+	httpClient := HTTPClient{
+		client: server.Client(),
+		url:    server.URL,
+	}
+
+	for i := 0; i < 3; i++ {
+		if _, err := httpClient.executeSchedule(Schedule{}); err != nil {
+			t.Fatal("Error executing schedule: ", err.Error())
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if connections != 1 {
+		t.Errorf("Incorrect number of connections. Expected: %d, Got: %d\n", 1, connections)
+	}
+}
+
+func TestExecuteScheduleCapturesFailure(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+		w.Write(bytes.Repeat([]byte("x"), maxResponseBody*2))
+	}))
+	defer server.Close()
+
+	httpClient := HTTPClient{
+		client: server.Client(),
+		url:    server.URL,
+	}
+
+	execution, err := httpClient.executeSchedule(Schedule{})
+	if err == nil {
+		t.Fatal("Expected an error for a bad gateway response")
+	}
+
+	if execution.StatusCode != http.StatusBadGateway {
+		t.Errorf("Incorrect status code. Expected: 502, Got: %d\n", execution.StatusCode)
+	}
+
+	if len(execution.ResponseBody) != maxResponseBody {
+		t.Errorf("Response body not truncated. Length: %d\n", len(execution.ResponseBody))
+	}
+}
+
+func TestExecuteScheduleCapturesBinaryBody(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Reply", "\xffok")
+		w.Write([]byte{0x89, 'P', 'N', 'G', 0x00, 0xff, 0xfe})
+	}))
+	defer server.Close()
+
+	httpClient := HTTPClient{
+		client: server.Client(),
+		url:    server.URL,
+	}
+
+	execution, err := httpClient.executeSchedule(Schedule{})
+	if err != nil {
+		t.Fatal("Error executing schedule: ", err.Error())
+	}
+
+	if execution.ResponseBody != "\uFFFDPNG\uFFFD" {
+		t.Errorf("Body not sanitized: %q\n", execution.ResponseBody)
+	}
+	if execution.ResponseHeaders["X-Reply"] != "\uFFFDok" {
+		t.Errorf("Header not sanitized: %q\n", execution.ResponseHeaders["X-Reply"])
+	}
+}
+
+func TestStorableText(t *testing.T) {
+	testHarness := []struct {
+		testName string
+		value    string
+		max      int
+		expected string
+	}{
+		{testName: "short", value: "ok", max: 4, expected: "ok"},
+		{testName: "cut", value: "abcdef", max: 4, expected: "abcd"},
+		{testName: "multi-byte not split", value: "a€b", max: 3, expected: "a"},
+		{testName: "invalid utf-8", value: "a\xffb", max: 8, expected: "a\uFFFDb"},
+		{testName: "nul", value: "a\x00b", max: 8, expected: "ab"},
+	}
+
+	for _, th := range testHarness {
+		t.Run(th.testName, func(t *testing.T) {
+			if v := storableText(th.value, th.max); v != th.expected {
+				t.Errorf("Incorrect text. Expected: %q, Got: %q\n", th.expected, v)
+			}
+		})
+	}
+}
+
+func TestExecuteScheduleTimeout(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+
+	httpClient := NewHTTPClient(server.URL, 50*time.Millisecond)
+
+	start := time.Now()
+	_, err := httpClient.executeSchedule(Schedule{})
+	if err == nil {
+		t.Fatal("Expected a timeout error")
+	}
+
+	if time.Since(start) > 5*time.Second {
+		t.Error("Request was not cut off by the timeout")
+	}
+}
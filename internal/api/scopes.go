@@ -0,0 +1,140 @@
+package api
+
+import (
+	"database/sql/driver"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// Scopes limit what an access token or API key may do, see RequireScope
+const (
+	ScopeSchedulesRead  = "schedules:read"
+	ScopeSchedulesWrite = "schedules:write"
+	ScopeExecutionsRead = "executions:read"
+	ScopeTeamsRead      = "teams:read"
+	ScopeTeamsWrite     = "teams:write"
+	ScopeAdmin          = "admin"
+	ScopeAccount        = "account"
+)
+
+// AllScopes are the scopes of a login that does not ask for fewer
+var AllScopes = Scopes{
+	ScopeSchedulesRead,
+	ScopeSchedulesWrite,
+	ScopeExecutionsRead,
+	ScopeTeamsRead,
+	ScopeTeamsWrite,
+	ScopeAdmin,
+	ScopeAccount,
+}
+
+// Scopes holds the scopes granted to a session or an API key. It is stored
+// in the db as a space separated string.
+type Scopes []string
+
+// parseScopes parses the space or comma separated scopes of v. An empty v
+// returns fallback.
+func parseScopes(v string, fallback Scopes) (Scopes, error) {
+	fields := strings.FieldsFunc(v, func(r rune) bool {
+		return r == ' ' || r == ','
+	})
+	if len(fields) == 0 {
+		return fallback, nil
+	}
+
+	scopes := Scopes{}
+	for _, f := range fields {
+		if !AllScopes.has(f) {
+			return nil, errors.New("Invalid scope " + f + ". Must be one of " + strings.Join(AllScopes, ", "))
+		}
+		if !scopes.has(f) {
+			scopes = append(scopes, f)
+		}
+	}
+	return scopes, nil
+}
+
+// loginScopes returns the scopes a login of u asking for requested gets.
+// Only admins get the admin scope.
+func loginScopes(u User, requested Scopes) Scopes {
+	if u.Admin {
+		return requested
+	}
+	return requested.without(ScopeAdmin)
+}
+
+// has reports whether scope is one of s
+func (s Scopes) has(scope string) bool {
+	for _, v := range s {
+		if v == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// within reports whether every scope of s is also one of other
+func (s Scopes) within(other Scopes) bool {
+	for _, v := range s {
+		if !other.has(v) {
+			return false
+		}
+	}
+	return true
+}
+
+// without returns the scopes of s other than scope
+func (s Scopes) without(scope string) Scopes {
+	other := Scopes{}
+	for _, v := range s {
+		if v != scope {
+			other = append(other, v)
+		}
+	}
+	return other
+}
+
+// Value implements driver.Valuer so Scopes can be written to the db
+func (s Scopes) Value() (driver.Value, error) {
+	return strings.Join(s, " "), nil
+}
+
+// Scan implements sql.Scanner so Scopes can be read from the db
+func (s *Scopes) Scan(src interface{}) error {
+	switch v := src.(type) {
+	case nil:
+		*s = Scopes{}
+	case string:
+		*s = Scopes(strings.Fields(v))
+	case []byte:
+		*s = Scopes(strings.Fields(string(v)))
+	default:
+		return errors.New("Unsupported type for scopes")
+	}
+	return nil
+}
+
+// currentScopes returns the scopes of the session or API key the caller
+// authenticated with
+func currentScopes(r *http.Request) Scopes {
+	if k := currentAPIKey(r); k.ID != 0 {
+		return k.Scopes
+	}
+	return currentSession(r).Scopes
+}
+
+// RequireScope only lets callers whose token or API key has scope through.
+// It must run after AuthMiddleware.
+func (routes *Routes) RequireScope(scope string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !currentScopes(r).has(scope) {
+				writeErrorMessage(w, "Missing scope "+scope, http.StatusForbidden)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
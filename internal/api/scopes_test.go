@@ -0,0 +1,208 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestParseScopes(t *testing.T) {
+	testHarness := []struct {
+		testName string
+		value    string
+		scopes   Scopes
+		valid    bool
+	}{
+		{testName: "empty", value: "", scopes: AllScopes, valid: true},
+		{testName: "one", value: "schedules:read", scopes: Scopes{ScopeSchedulesRead}, valid: true},
+		{testName: "spaces and commas", value: "schedules:read, executions:read admin", scopes: Scopes{ScopeSchedulesRead, ScopeExecutionsRead, ScopeAdmin}, valid: true},
+		{testName: "duplicates", value: "admin admin", scopes: Scopes{ScopeAdmin}, valid: true},
+		{testName: "unknown", value: "schedules:read everything", valid: false},
+	}
+
+	for _, th := range testHarness {
+		t.Run(th.testName, func(t *testing.T) {
+			scopes, err := parseScopes(th.value, AllScopes)
+			if (err == nil) != th.valid {
+				t.Fatalf("Incorrect validity. Expected: %t, Got: %v\n", th.valid, err)
+			}
+			if th.valid && !reflect.DeepEqual(scopes, th.scopes) {
+				t.Errorf("Incorrect scopes. Expected: %v, Got: %v\n", th.scopes, scopes)
+			}
+		})
+	}
+}
+
+func TestLoginScopes(t *testing.T) {
+	testHarness := []struct {
+		testName string
+		user     User
+		admin    bool
+	}{
+		{testName: "admin", user: User{Admin: true}, admin: true},
+		{testName: "user", user: User{}, admin: false},
+	}
+
+	for _, th := range testHarness {
+		t.Run(th.testName, func(t *testing.T) {
+			scopes := loginScopes(th.user, AllScopes)
+			if scopes.has(ScopeAdmin) != th.admin || !scopes.has(ScopeAccount) {
+				t.Errorf("Incorrect scopes: %v\n", scopes)
+			}
+		})
+	}
+}
+
+func TestScopes(t *testing.T) {
+	// create dummy db
+	db, cleanup := openTestDB(t)
+	defer cleanup()
+
+	routes := NewRoutes(db, []byte("secret"), &HTTPClient{})
+	routes.MigrateDB()
+
+	u := User{Email: "me@email.com", Name: "me", Hash: hashPassword("pw"), Admin: true}
+	db.Create(&u)
+
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+	router := mux.NewRouter()
+	router.HandleFunc("/login", routes.LoginFunc).Methods("POST")
+	router.HandleFunc("/refresh", routes.RefreshFunc).Methods("POST")
+	a := router.PathPrefix("/").Subrouter()
+	a.Use(routes.AuthMiddleware)
+	a.Handle("/schedules", routes.RequireScope(ScopeSchedulesRead)(ok)).Methods("GET")
+	a.Handle("/schedules", routes.RequireScope(ScopeSchedulesWrite)(ok)).Methods("POST")
+	a.Handle("/api-keys", routes.RequireScope(ScopeAccount)(http.HandlerFunc(routes.CreateAPIKey))).Methods("POST")
+	a.Handle("/me", routes.RequireScope(ScopeAccount)(http.HandlerFunc(routes.Me))).Methods("GET")
+	a.Handle("/logout", routes.RequireScope(ScopeAccount)(http.HandlerFunc(routes.LogoutFunc))).Methods("POST")
+
+	serve := func(method string, path string, header string, value string, payload string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, path, bytes.NewBuffer([]byte(payload)))
+		req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+		if value != "" {
+			req.Header.Set(header, value)
+		}
+
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	login := func(t *testing.T, payload string) (string, string) {
+		rr := serve("POST", "/login", "", "", "email=me@email.com&password=pw"+payload)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("Incorrect status. Expected: %d, Got: %d\n", http.StatusOK, rr.Code)
+		}
+
+		body, _ := ioutil.ReadAll(rr.Body)
+		return "Bearer " + string(body), rr.Header().Get("X-Refresh-Token")
+	}
+
+	t.Run("invalid scope at login", func(t *testing.T) {
+		rr := serve("POST", "/login", "", "", "email=me@email.com&password=pw&scope=everything")
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("Incorrect status. Expected: %d, Got: %d\n", http.StatusBadRequest, rr.Code)
+		}
+	})
+
+	t.Run("tokens", func(t *testing.T) {
+		full, _ := login(t, "")
+		readOnly, refresh := login(t, "&scope=schedules:read")
+
+		rr := serve("POST", "/refresh", "", "", "refresh_token="+refresh)
+		body, _ := ioutil.ReadAll(rr.Body)
+		refreshed := "Bearer " + string(body)
+
+		testHarness := []struct {
+			testName string
+			token    string
+			method   string
+			status   int
+		}{
+			{testName: "full read", token: full, method: "GET", status: http.StatusOK},
+			{testName: "full write", token: full, method: "POST", status: http.StatusOK},
+			{testName: "read only read", token: readOnly, method: "GET", status: http.StatusOK},
+			{testName: "read only write", token: readOnly, method: "POST", status: http.StatusForbidden},
+			{testName: "refreshed read", token: refreshed, method: "GET", status: http.StatusOK},
+			{testName: "refreshed write", token: refreshed, method: "POST", status: http.StatusForbidden},
+		}
+
+		for _, th := range testHarness {
+			t.Run(th.testName, func(t *testing.T) {
+				rr := serve(th.method, "/schedules", "Authorization", th.token, "")
+				if status := rr.Code; status != th.status {
+					t.Errorf("Incorrect status. Expected: %d, Got: %d\n", th.status, status)
+				}
+			})
+		}
+	})
+
+	t.Run("account routes", func(t *testing.T) {
+		readOnly, _ := login(t, "&scope=schedules:read")
+		full, _ := login(t, "")
+
+		testHarness := []struct {
+			testName string
+			token    string
+			method   string
+			path     string
+			status   int
+		}{
+			{testName: "read only me", token: readOnly, method: "GET", path: "/me", status: http.StatusForbidden},
+			{testName: "read only logout", token: readOnly, method: "POST", path: "/logout", status: http.StatusForbidden},
+			{testName: "full me", token: full, method: "GET", path: "/me", status: http.StatusOK},
+			{testName: "full logout", token: full, method: "POST", path: "/logout", status: http.StatusOK},
+		}
+
+		for _, th := range testHarness {
+			t.Run(th.testName, func(t *testing.T) {
+				if rr := serve(th.method, th.path, "Authorization", th.token, ""); rr.Code != th.status {
+					t.Errorf("Incorrect status. Expected: %d, Got: %d\n", th.status, rr.Code)
+				}
+			})
+		}
+	})
+
+	t.Run("api keys", func(t *testing.T) {
+		noAccount, _ := login(t, "&scope=schedules:read")
+		if rr := serve("POST", "/api-keys", "Authorization", noAccount, "name=dashboard"); rr.Code != http.StatusForbidden {
+			t.Errorf("Incorrect status. Expected: %d, Got: %d\n", http.StatusForbidden, rr.Code)
+		}
+
+		readOnly, _ := login(t, "&scope=schedules:read account")
+
+		rr := serve("POST", "/api-keys", "Authorization", readOnly, "name=ci&scope=schedules:write")
+		if rr.Code != http.StatusForbidden {
+			t.Errorf("Incorrect status. Expected: %d, Got: %d\n", http.StatusForbidden, rr.Code)
+		}
+
+		rr = serve("POST", "/api-keys", "Authorization", readOnly, "name=ci&scope=account")
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("Incorrect status. Expected: %d, Got: %d\n", http.StatusBadRequest, rr.Code)
+		}
+
+		rr = serve("POST", "/api-keys", "Authorization", readOnly, "name=dashboard")
+		if rr.Code != http.StatusCreated {
+			t.Fatalf("Incorrect status. Expected: %d, Got: %d\n", http.StatusCreated, rr.Code)
+		}
+		k := APIKey{}
+		json.NewDecoder(rr.Body).Decode(&k)
+		if !reflect.DeepEqual(k.Scopes, Scopes{ScopeSchedulesRead}) {
+			t.Errorf("Incorrect scopes. Expected: %v, Got: %v\n", Scopes{ScopeSchedulesRead}, k.Scopes)
+		}
+
+		if rr := serve("GET", "/schedules", "X-API-Key", k.Key, ""); rr.Code != http.StatusOK {
+			t.Errorf("Incorrect status. Expected: %d, Got: %d\n", http.StatusOK, rr.Code)
+		}
+		if rr := serve("POST", "/schedules", "X-API-Key", k.Key, ""); rr.Code != http.StatusForbidden {
+			t.Errorf("Incorrect status. Expected: %d, Got: %d\n", http.StatusForbidden, rr.Code)
+		}
+	})
+}
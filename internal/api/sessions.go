@@ -0,0 +1,178 @@
+package api
+
+import (
+	"log"
+	"net/http"
+	"time"
+)
+
+const (
+	defaultAccessTTL  = 15 * time.Minute
+	defaultRefreshTTL = 30 * 24 * time.Hour
+)
+
+// SetTokenTTLs sets how long access tokens and sessions last. A session is
+// extended by refreshTTL every time it is refreshed.
+func (routes *Routes) SetTokenTTLs(accessTTL time.Duration, refreshTTL time.Duration) {
+	routes.accessTTL = accessTTL
+	routes.refreshTTL = refreshTTL
+}
+
+// active reports whether the session can still be used
+func (s Session) active() bool {
+	return s.ID != 0 && s.RevokedAt == nil && s.ExpiresAt.After(time.Now())
+}
+
+// currentSession returns the session set on the context by AuthMiddleware.
+// It is empty when the caller authenticated with an API key.
+func currentSession(r *http.Request) Session {
+	s, _ := r.Context().Value(sessionContextKey).(Session)
+	return s
+}
+
+// requireSession writes a 400 and returns false unless the caller logged in
+// with a session. The account is only managed from a login, never with an API
+// key, so a leaked key can't lock its owner out.
+func requireSession(w http.ResponseWriter, r *http.Request) bool {
+	if currentSession(r).ID == 0 {
+		writeErrorMessage(w, "Not logged in with a session", http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+// startSession creates a session for the user with scopes and returns an
+// access token and a refresh token for it
+func (routes *Routes) startSession(user User, scopes Scopes) (string, string, error) {
+	refresh, err := randomToken()
+	if err != nil {
+		return "", "", err
+	}
+
+	s := Session{
+		UserID:      user.ID,
+		RefreshHash: hashToken(refresh),
+		Scopes:      scopes,
+		ExpiresAt:   time.Now().UTC().Add(routes.refreshTTL),
+	}
+	if err := routes.db.Create(&s).Error; err != nil {
+		return "", "", err
+	}
+
+	access, err := routes.createJWT(user, s)
+	if err != nil {
+		return "", "", err
+	}
+	return access, refresh, nil
+}
+
+// RefreshFunc trades the refresh_token form value for a new access token and
+// a new refresh token, the old refresh token can not be used again. Using an
+// old refresh token revokes the session as the token must have leaked.
+func (routes *Routes) RefreshFunc(w http.ResponseWriter, r *http.Request) {
+	refresh := r.FormValue("refresh_token")
+	if refresh == "" {
+		writeErrorMessage(w, "Refresh token required", http.StatusBadRequest)
+		return
+	}
+	hash := hashToken(refresh)
+
+	s := Session{}
+	routes.db.Where("refresh_hash = ?", hash).First(&s)
+
+	if s.ID == 0 {
+		reused := Session{}
+		routes.db.Where("previous_hash = ?", hash).First(&reused)
+		if reused.ID != 0 {
+			log.Printf("Refresh token of session %d reused, revoking it\n", reused.ID)
+			routes.db.Model(&reused).Update("revoked_at", time.Now().UTC())
+		}
+
+		writeErrorMessage(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	u := User{}
+	routes.db.Where("id = ?", s.UserID).First(&u)
+	if !s.active() || u.ID == 0 || u.Disabled {
+		writeErrorMessage(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	next, err := randomToken()
+	if err != nil {
+		writeErrorMessage(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// only one refresh can rotate the token
+	result := routes.db.Model(&Session{}).
+		Where("id = ? AND refresh_hash = ? AND revoked_at IS NULL", s.ID, hash).
+		Updates(map[string]interface{}{
+			"refresh_hash":  hashToken(next),
+			"previous_hash": hash,
+			"expires_at":    time.Now().UTC().Add(routes.refreshTTL),
+		})
+	if result.Error != nil {
+		writeErrorMessage(w, result.Error.Error(), http.StatusInternalServerError)
+		return
+	}
+	if result.RowsAffected != 1 {
+		writeErrorMessage(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	access, err := routes.createJWT(u, s)
+	if err != nil {
+		writeErrorMessage(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeTokens(w, access, next)
+}
+
+// LogoutFunc revokes the current session, or every session of the current
+// user when all is set. API keys can't log anyone out.
+func (routes *Routes) LogoutFunc(w http.ResponseWriter, r *http.Request) {
+	if !requireSession(w, r) {
+		return
+	}
+
+	if r.FormValue("all") == "true" {
+		routes.revokeSessions(currentUser(r).ID)
+		return
+	}
+
+	s := currentSession(r)
+
+	routes.db.Model(&Session{}).
+		Where("id = ? AND revoked_at IS NULL", s.ID).
+		Update("revoked_at", time.Now().UTC())
+}
+
+// revokeSessions revokes every session of the user
+func (routes *Routes) revokeSessions(userID uint) {
+	err := routes.db.Model(&Session{}).
+		Where("user_id = ? AND revoked_at IS NULL", userID).
+		Update("revoked_at", time.Now().UTC()).Error
+	if err != nil {
+		log.Printf("Error revoking sessions of user %d: %s\n", userID, err.Error())
+	}
+}
+
+// revokeOtherSessions logs a user out everywhere but the session with keep
+func (routes *Routes) revokeOtherSessions(userID uint, keep uint) {
+	err := routes.db.Model(&Session{}).
+		Where("user_id = ? AND id <> ? AND revoked_at IS NULL", userID, keep).
+		Update("revoked_at", time.Now().UTC()).Error
+	if err != nil {
+		log.Printf("Error revoking sessions of user %d: %s\n", userID, err.Error())
+	}
+}
+
+// writeTokens writes the access token as the body, like logins always have,
+// and the refresh token in the X-Refresh-Token header
+func writeTokens(w http.ResponseWriter, access string, refresh string) {
+	w.Header().Set("X-Refresh-Token", refresh)
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(access))
+}
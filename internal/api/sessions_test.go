@@ -0,0 +1,148 @@
+package api
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func TestSessions(t *testing.T) {
+	// create dummy db
+	db, cleanup := openTestDB(t)
+	defer cleanup()
+
+	routes := NewRoutes(db, []byte("secret"), &HTTPClient{})
+	routes.MigrateDB()
+
+	u := User{Email: "me@email.com", Name: "me", Hash: hashPassword("pw")}
+	db.Create(&u)
+
+	router := mux.NewRouter()
+	router.HandleFunc("/login", routes.LoginFunc).Methods("POST")
+	router.HandleFunc("/refresh", routes.RefreshFunc).Methods("POST")
+	a := router.PathPrefix("/").Subrouter()
+	a.Use(routes.AuthMiddleware)
+	a.HandleFunc("/me", routes.Me).Methods("GET")
+	a.HandleFunc("/logout", routes.LogoutFunc).Methods("POST")
+
+	serve := func(method string, path string, access string, payload string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, path, bytes.NewBuffer([]byte(payload)))
+		req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+		if access != "" {
+			req.Header.Set("Authorization", "Bearer "+access)
+		}
+
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	login := func(t *testing.T) (string, string) {
+		rr := serve("POST", "/login", "", "email=me@email.com&password=pw")
+		if rr.Code != http.StatusOK {
+			t.Fatalf("Incorrect status. Expected: %d, Got: %d\n", http.StatusOK, rr.Code)
+		}
+
+		body, _ := ioutil.ReadAll(rr.Body)
+		return string(body), rr.Header().Get("X-Refresh-Token")
+	}
+
+	refresh := func(token string) *httptest.ResponseRecorder {
+		return serve("POST", "/refresh", "", "refresh_token="+token)
+	}
+
+	t.Run("refresh rotates the refresh token", func(t *testing.T) {
+		_, first := login(t)
+
+		rr := refresh(first)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("Incorrect status. Expected: %d, Got: %d\n", http.StatusOK, rr.Code)
+		}
+
+		body, _ := ioutil.ReadAll(rr.Body)
+		second := rr.Header().Get("X-Refresh-Token")
+		if second == "" || second == first {
+			t.Errorf("Refresh token not rotated: %s\n", second)
+		}
+
+		if rr := serve("GET", "/me", string(body), ""); rr.Code != http.StatusOK {
+			t.Errorf("Incorrect status. Expected: %d, Got: %d\n", http.StatusOK, rr.Code)
+		}
+
+		if rr := refresh(second); rr.Code != http.StatusOK {
+			t.Errorf("Incorrect status. Expected: %d, Got: %d\n", http.StatusOK, rr.Code)
+		}
+	})
+
+	t.Run("reusing a refresh token revokes the session", func(t *testing.T) {
+		access, first := login(t)
+
+		rr := refresh(first)
+		second := rr.Header().Get("X-Refresh-Token")
+
+		if rr := refresh(first); rr.Code != http.StatusUnauthorized {
+			t.Errorf("Incorrect status. Expected: %d, Got: %d\n", http.StatusUnauthorized, rr.Code)
+		}
+		if rr := refresh(second); rr.Code != http.StatusUnauthorized {
+			t.Errorf("Incorrect status. Expected: %d, Got: %d\n", http.StatusUnauthorized, rr.Code)
+		}
+		if rr := serve("GET", "/me", access, ""); rr.Code != http.StatusUnauthorized {
+			t.Errorf("Incorrect status. Expected: %d, Got: %d\n", http.StatusUnauthorized, rr.Code)
+		}
+	})
+
+	t.Run("logout", func(t *testing.T) {
+		access, token := login(t)
+		other, _ := login(t)
+
+		if rr := serve("POST", "/logout", access, ""); rr.Code != http.StatusOK {
+			t.Fatalf("Incorrect status. Expected: %d, Got: %d\n", http.StatusOK, rr.Code)
+		}
+		if rr := serve("GET", "/me", access, ""); rr.Code != http.StatusUnauthorized {
+			t.Errorf("Incorrect status. Expected: %d, Got: %d\n", http.StatusUnauthorized, rr.Code)
+		}
+		if rr := refresh(token); rr.Code != http.StatusUnauthorized {
+			t.Errorf("Incorrect status. Expected: %d, Got: %d\n", http.StatusUnauthorized, rr.Code)
+		}
+
+		// other sessions stay until all of them are logged out
+		if rr := serve("GET", "/me", other, ""); rr.Code != http.StatusOK {
+			t.Errorf("Incorrect status. Expected: %d, Got: %d\n", http.StatusOK, rr.Code)
+		}
+		serve("POST", "/logout", other, "all=true")
+
+		count := -1
+		db.Model(&Session{}).Where("user_id = ? AND revoked_at IS NULL", u.ID).Count(&count)
+		if count != 0 {
+			t.Errorf("Incorrect number of active sessions. Expected: %d, Got: %d\n", 0, count)
+		}
+	})
+
+	t.Run("expired tokens are refused", func(t *testing.T) {
+		routes.SetTokenTTLs(-time.Minute, -time.Minute)
+		defer routes.SetTokenTTLs(defaultAccessTTL, defaultRefreshTTL)
+
+		access, token := login(t)
+		if rr := serve("GET", "/me", access, ""); rr.Code != http.StatusUnauthorized {
+			t.Errorf("Incorrect status. Expected: %d, Got: %d\n", http.StatusUnauthorized, rr.Code)
+		}
+		if rr := refresh(token); rr.Code != http.StatusUnauthorized {
+			t.Errorf("Incorrect status. Expected: %d, Got: %d\n", http.StatusUnauthorized, rr.Code)
+		}
+	})
+
+	t.Run("disabled users can not refresh", func(t *testing.T) {
+		_, token := login(t)
+		db.Model(&u).Update("disabled", true)
+		defer db.Model(&u).Update("disabled", false)
+
+		if rr := refresh(token); rr.Code != http.StatusUnauthorized {
+			t.Errorf("Incorrect status. Expected: %d, Got: %d\n", http.StatusUnauthorized, rr.Code)
+		}
+	})
+}
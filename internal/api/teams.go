@@ -0,0 +1,312 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/jinzhu/gorm"
+)
+
+// The roles a user can have in a team, each allowing everything the roles
+// before it allow
+const (
+	RoleViewer = "viewer"
+	RoleEditor = "editor"
+	RoleOwner  = "owner"
+)
+
+var roleRanks = map[string]int{RoleViewer: 1, RoleEditor: 2, RoleOwner: 3}
+
+// roleAllows reports whether role grants at least the access of need
+func roleAllows(role string, need string) bool {
+	return role != "" && roleRanks[role] >= roleRanks[need]
+}
+
+// teamRole returns the role of the user in the team, or an empty string when
+// the user is not a member
+func (routes *Routes) teamRole(userID uint, teamID uint) string {
+	m := Membership{}
+	routes.db.Where("team_id = ? AND user_id = ?", teamID, userID).First(&m)
+	return m.Role
+}
+
+// scheduleRole returns the role of the user for the schedule. The creator of
+// a schedule without a team is its owner.
+func (routes *Routes) scheduleRole(user User, s Schedule) string {
+	if s.TeamID == 0 {
+		if s.UserID == user.ID {
+			return RoleOwner
+		}
+		return ""
+	}
+	return routes.teamRole(user.ID, s.TeamID)
+}
+
+// member is a user as listed among the members of a team
+type member struct {
+	UserID uint   `json:"user_id"`
+	Email  string `json:"email"`
+	Name   string `json:"name"`
+	Role   string `json:"role"`
+}
+
+// CreateTeam creates a team with the current user as its owner
+func (routes *Routes) CreateTeam(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimSpace(r.FormValue("name"))
+	if name == "" {
+		writeErrorMessage(w, "Name required", http.StatusBadRequest)
+		return
+	}
+
+	team := Team{Name: name}
+	err := transaction(routes.db, func(tx *gorm.DB) error {
+		if err := tx.Create(&team).Error; err != nil {
+			return err
+		}
+		return tx.Create(&Membership{TeamID: team.ID, UserID: currentUser(r).ID, Role: RoleOwner}).Error
+	})
+	if err != nil {
+		writeErrorMessage(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	team.Role = RoleOwner
+
+	b, err := json.Marshal(team)
+	if err != nil {
+		writeErrorMessage(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	w.Write(b)
+}
+
+// ListTeams returns the teams of the current user along with their role
+func (routes *Routes) ListTeams(w http.ResponseWriter, r *http.Request) {
+	memberships := []Membership{}
+	routes.db.Where("user_id = ?", currentUser(r).ID).Find(&memberships)
+
+	roles := map[uint]string{}
+	ids := []uint{}
+	for _, m := range memberships {
+		roles[m.TeamID] = m.Role
+		ids = append(ids, m.TeamID)
+	}
+
+	teams := []Team{}
+	if len(ids) > 0 {
+		routes.db.Where("id IN (?)", ids).Order("name asc").Find(&teams)
+	}
+	for i := range teams {
+		teams[i].Role = roles[teams[i].ID]
+	}
+
+	b, err := json.Marshal(teams)
+	if err != nil {
+		writeErrorMessage(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Write(b)
+}
+
+// ListMembers returns the members of a team. Any member may list them.
+func (routes *Routes) ListMembers(w http.ResponseWriter, r *http.Request) {
+	team, ok := routes.authorizedTeam(w, r, RoleViewer)
+	if !ok {
+		return
+	}
+
+	memberships := []Membership{}
+	routes.db.Where("team_id = ?", team.ID).Order("id asc").Find(&memberships)
+
+	ids := []uint{}
+	for _, m := range memberships {
+		ids = append(ids, m.UserID)
+	}
+	users := []User{}
+	routes.db.Where("id IN (?)", ids).Find(&users)
+
+	byID := map[uint]User{}
+	for _, u := range users {
+		byID[u.ID] = u
+	}
+
+	members := []member{}
+	for _, m := range memberships {
+		u := byID[m.UserID]
+		members = append(members, member{UserID: m.UserID, Email: u.Email, Name: u.Name, Role: m.Role})
+	}
+
+	b, err := json.Marshal(members)
+	if err != nil {
+		writeErrorMessage(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Write(b)
+}
+
+// AddMember adds the registered user with the given email to a team with the
+// given role, viewer by default. Only owners may add members.
+func (routes *Routes) AddMember(w http.ResponseWriter, r *http.Request) {
+	team, ok := routes.authorizedTeam(w, r, RoleOwner)
+	if !ok {
+		return
+	}
+
+	email := strings.TrimSpace(r.FormValue("email"))
+	if email == "" {
+		writeErrorMessage(w, "Email required", http.StatusBadRequest)
+		return
+	}
+
+	role, ok := formRole(w, r, RoleViewer)
+	if !ok {
+		return
+	}
+
+	u := User{}
+	routes.db.Where("email = ?", email).First(&u)
+	if u.ID == 0 {
+		writeErrorMessage(w, "No user registered with that email", http.StatusNotFound)
+		return
+	}
+
+	if routes.teamRole(u.ID, team.ID) != "" {
+		writeErrorMessage(w, "User is already a member", http.StatusBadRequest)
+		return
+	}
+
+	routes.db.Create(&Membership{TeamID: team.ID, UserID: u.ID, Role: role})
+	w.WriteHeader(http.StatusCreated)
+}
+
+// UpdateMember changes the role of a member of a team. Only owners may change
+// roles and the last owner of a team cannot be demoted.
+func (routes *Routes) UpdateMember(w http.ResponseWriter, r *http.Request) {
+	team, ok := routes.authorizedTeam(w, r, RoleOwner)
+	if !ok {
+		return
+	}
+
+	m, ok := routes.teamMembership(w, r, team)
+	if !ok {
+		return
+	}
+
+	role, ok := formRole(w, r, "")
+	if !ok {
+		return
+	}
+	if role == "" {
+		writeErrorMessage(w, "Role required", http.StatusBadRequest)
+		return
+	}
+
+	if m.Role == RoleOwner && role != RoleOwner && routes.lastOwner(team) {
+		writeErrorMessage(w, "A team needs at least one owner", http.StatusBadRequest)
+		return
+	}
+
+	routes.db.Model(&m).Update("role", role)
+}
+
+// RemoveMember removes a member from a team. Owners may remove anyone and
+// every member may leave, except for the last owner.
+func (routes *Routes) RemoveMember(w http.ResponseWriter, r *http.Request) {
+	team, ok := routes.authorizedTeam(w, r, RoleViewer)
+	if !ok {
+		return
+	}
+
+	m, ok := routes.teamMembership(w, r, team)
+	if !ok {
+		return
+	}
+
+	if m.UserID != currentUser(r).ID && team.Role != RoleOwner {
+		writeErrorMessage(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	if m.Role == RoleOwner && routes.lastOwner(team) {
+		writeErrorMessage(w, "A team needs at least one owner", http.StatusBadRequest)
+		return
+	}
+
+	// removed members may be added again, so the row is really deleted
+	routes.db.Unscoped().Delete(&m)
+}
+
+// authorizedTeam finds the team named by the id route var. It writes a 404
+// when there is no such team or the current user is not a member, and a 403
+// when their role does not allow need, returning false in both cases. The
+// role of the current user is set on the returned team.
+func (routes *Routes) authorizedTeam(w http.ResponseWriter, r *http.Request, need string) (Team, bool) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	team := Team{}
+	routes.db.Where("id = ?", id).First(&team)
+
+	if team.ID != 0 {
+		team.Role = routes.teamRole(currentUser(r).ID, team.ID)
+	}
+
+	if team.Role == "" {
+		writeErrorMessage(w, "Not Found", http.StatusNotFound)
+		return team, false
+	}
+
+	if !roleAllows(team.Role, need) {
+		writeErrorMessage(w, "Forbidden", http.StatusForbidden)
+		return team, false
+	}
+
+	return team, true
+}
+
+// teamMembership finds the membership of the user named by the user_id route
+// var in the team, writing a 404 when there is none
+func (routes *Routes) teamMembership(w http.ResponseWriter, r *http.Request, team Team) (Membership, bool) {
+	userID, err := strconv.ParseUint(mux.Vars(r)["user_id"], 10, 64)
+	if err != nil {
+		writeErrorMessage(w, "Not Found", http.StatusNotFound)
+		return Membership{}, false
+	}
+
+	m := Membership{}
+	routes.db.Where("team_id = ? AND user_id = ?", team.ID, userID).First(&m)
+	if m.ID == 0 {
+		writeErrorMessage(w, "Not Found", http.StatusNotFound)
+		return m, false
+	}
+
+	return m, true
+}
+
+// lastOwner reports whether the team has only one owner left
+func (routes *Routes) lastOwner(team Team) bool {
+	var owners int
+	routes.db.Model(&Membership{}).Where("team_id = ? AND role = ?", team.ID, RoleOwner).Count(&owners)
+	return owners <= 1
+}
+
+// formRole reads the role form value, falling back to fallback when it is
+// empty. It writes a 400 and returns false for unknown roles.
+func formRole(w http.ResponseWriter, r *http.Request, fallback string) (string, bool) {
+	role := strings.ToLower(strings.TrimSpace(r.FormValue("role")))
+	if role == "" {
+		return fallback, true
+	}
+
+	if _, ok := roleRanks[role]; !ok {
+		writeErrorMessage(w, "Invalid role. Must be one of viewer, editor or owner", http.StatusBadRequest)
+		return "", false
+	}
+	return role, true
+}
@@ -0,0 +1,250 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// serveAs makes a request to handler as the given user
+func serveAs(handler http.Handler, user User, method string, path string, payload string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest(method, path, bytes.NewBuffer([]byte(payload)))
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	req = req.WithContext(context.WithValue(req.Context(), userContextKey, user))
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	return rr
+}
+
+func TestTeams(t *testing.T) {
+	// create dummy db
+	db, cleanup := openTestDB(t)
+	defer cleanup()
+
+	routes := NewRoutes(db, []byte{}, &HTTPClient{})
+	routes.MigrateDB()
+
+	owner := User{Email: "owner@email.com", Name: "owner"}
+	editor := User{Email: "editor@email.com", Name: "editor"}
+	viewer := User{Email: "viewer@email.com", Name: "viewer"}
+	stranger := User{Email: "stranger@email.com", Name: "stranger"}
+	for _, u := range []*User{&owner, &editor, &viewer, &stranger} {
+		db.Create(u)
+	}
+
+	router := mux.NewRouter()
+	router.HandleFunc("/teams", routes.ListTeams).Methods("GET")
+	router.HandleFunc("/teams", routes.CreateTeam).Methods("POST")
+	router.HandleFunc("/teams/{id}/members", routes.ListMembers).Methods("GET")
+	router.HandleFunc("/teams/{id}/members", routes.AddMember).Methods("POST")
+	router.HandleFunc("/teams/{id}/members/{user_id}", routes.UpdateMember).Methods("PUT")
+	router.HandleFunc("/teams/{id}/members/{user_id}", routes.RemoveMember).Methods("DELETE")
+
+	team := Team{}
+
+	t.Run("create team", func(t *testing.T) {
+		rr := serveAs(router, owner, "POST", "/teams", "name=deployers")
+		if status := rr.Code; status != http.StatusCreated {
+			t.Fatalf("Incorrect status. Expected: %d, Got: %d\n", http.StatusCreated, status)
+		}
+
+		json.NewDecoder(rr.Body).Decode(&team)
+		if team.ID == 0 || team.Name != "deployers" || team.Role != RoleOwner {
+			t.Errorf("Team not created correctly: %+v\n", team)
+		}
+
+		if rr := serveAs(router, owner, "POST", "/teams", ""); rr.Code != http.StatusBadRequest {
+			t.Errorf("Incorrect status. Expected: %d, Got: %d\n", http.StatusBadRequest, rr.Code)
+		}
+	})
+
+	members := fmt.Sprintf("/teams/%d/members", team.ID)
+
+	testHarness := []struct {
+		testName string
+		user     User
+		method   string
+		path     string
+		payload  string
+		status   int
+	}{
+		{testName: "owner adds editor", user: owner, method: "POST", path: members, payload: "email=editor@email.com&role=editor", status: http.StatusCreated},
+		{testName: "owner adds viewer", user: owner, method: "POST", path: members, payload: "email=viewer@email.com", status: http.StatusCreated},
+		{testName: "member added twice", user: owner, method: "POST", path: members, payload: "email=viewer@email.com", status: http.StatusBadRequest},
+		{testName: "unknown email", user: owner, method: "POST", path: members, payload: "email=nobody@email.com", status: http.StatusNotFound},
+		{testName: "unknown role", user: owner, method: "POST", path: members, payload: "email=stranger@email.com&role=boss", status: http.StatusBadRequest},
+		{testName: "editor adds member", user: editor, method: "POST", path: members, payload: "email=stranger@email.com", status: http.StatusForbidden},
+		{testName: "stranger lists members", user: stranger, method: "GET", path: members, status: http.StatusNotFound},
+		{testName: "unknown team", user: owner, method: "GET", path: "/teams/9999/members", status: http.StatusNotFound},
+		{testName: "viewer lists members", user: viewer, method: "GET", path: members, status: http.StatusOK},
+		{testName: "editor changes role", user: editor, method: "PUT", path: fmt.Sprintf("%s/%d", members, viewer.ID), payload: "role=editor", status: http.StatusForbidden},
+		{testName: "owner changes role", user: owner, method: "PUT", path: fmt.Sprintf("%s/%d", members, viewer.ID), payload: "role=editor", status: http.StatusOK},
+		{testName: "owner demotes last owner", user: owner, method: "PUT", path: fmt.Sprintf("%s/%d", members, owner.ID), payload: "role=viewer", status: http.StatusBadRequest},
+		{testName: "role of non member", user: owner, method: "PUT", path: fmt.Sprintf("%s/%d", members, stranger.ID), payload: "role=viewer", status: http.StatusNotFound},
+		{testName: "editor removes member", user: editor, method: "DELETE", path: fmt.Sprintf("%s/%d", members, viewer.ID), status: http.StatusForbidden},
+		{testName: "member leaves", user: viewer, method: "DELETE", path: fmt.Sprintf("%s/%d", members, viewer.ID), status: http.StatusOK},
+		{testName: "last owner leaves", user: owner, method: "DELETE", path: fmt.Sprintf("%s/%d", members, owner.ID), status: http.StatusBadRequest},
+		{testName: "member added again", user: owner, method: "POST", path: members, payload: "email=viewer@email.com", status: http.StatusCreated},
+		{testName: "owner removes member", user: owner, method: "DELETE", path: fmt.Sprintf("%s/%d", members, viewer.ID), status: http.StatusOK},
+	}
+
+	for _, th := range testHarness {
+		t.Run(th.testName, func(t *testing.T) {
+			rr := serveAs(router, th.user, th.method, th.path, th.payload)
+			if status := rr.Code; status != th.status {
+				t.Errorf("Incorrect status. Expected: %d, Got: %d\n", th.status, status)
+			}
+		})
+	}
+
+	t.Run("members are listed with their role", func(t *testing.T) {
+		rr := serveAs(router, editor, "GET", members, "")
+
+		list := []member{}
+		json.NewDecoder(rr.Body).Decode(&list)
+		if len(list) != 2 || list[0].Email != owner.Email || list[0].Role != RoleOwner || list[1].Role != RoleEditor {
+			t.Errorf("Incorrect members: %+v\n", list)
+		}
+	})
+
+	t.Run("teams are listed with the role of the user", func(t *testing.T) {
+		rr := serveAs(router, editor, "GET", "/teams", "")
+
+		teams := []Team{}
+		json.NewDecoder(rr.Body).Decode(&teams)
+		if len(teams) != 1 || teams[0].ID != team.ID || teams[0].Role != RoleEditor {
+			t.Errorf("Incorrect teams: %+v\n", teams)
+		}
+
+		rr = serveAs(router, stranger, "GET", "/teams", "")
+		teams = []Team{}
+		json.NewDecoder(rr.Body).Decode(&teams)
+		if len(teams) != 0 {
+			t.Errorf("Incorrect teams: %+v\n", teams)
+		}
+	})
+}
+
+func TestTeamSchedules(t *testing.T) {
+	// create dummy db
+	db, cleanup := openTestDB(t)
+	defer cleanup()
+
+	routes := NewRoutes(db, []byte{}, &HTTPClient{})
+	routes.MigrateDB()
+
+	editor := User{Email: "editor@email.com", Name: "editor"}
+	viewer := User{Email: "viewer@email.com", Name: "viewer"}
+	stranger := User{Email: "stranger@email.com", Name: "stranger"}
+	for _, u := range []*User{&editor, &viewer, &stranger} {
+		db.Create(u)
+	}
+
+	team := Team{Name: "deployers"}
+	db.Create(&team)
+	db.Create(&Membership{TeamID: team.ID, UserID: editor.ID, Role: RoleEditor})
+	db.Create(&Membership{TeamID: team.ID, UserID: viewer.ID, Role: RoleViewer})
+
+	router := mux.NewRouter()
+	router.HandleFunc("/schedules", routes.ListSchedules).Methods("GET")
+	router.HandleFunc("/schedules", routes.CreateSchedule).Methods("POST")
+	router.HandleFunc("/schedules/{id}", routes.DeleteSchedule).Methods("DELETE")
+	router.HandleFunc("/schedules/{id}/executions", routes.ListExecutions).Methods("GET")
+
+	create := fmt.Sprintf("time=%s&team_id=%d", time.Now().Format(time.RFC3339), team.ID)
+
+	t.Run("only editors create team schedules", func(t *testing.T) {
+		testHarness := []struct {
+			user   User
+			status int
+		}{
+			{user: editor, status: http.StatusCreated},
+			{user: viewer, status: http.StatusForbidden},
+			{user: stranger, status: http.StatusForbidden},
+		}
+
+		for _, th := range testHarness {
+			rr := serveAs(router, th.user, "POST", "/schedules", create)
+			if status := rr.Code; status != th.status {
+				t.Errorf("Incorrect status for %s. Expected: %d, Got: %d\n", th.user.Name, th.status, status)
+			}
+		}
+
+		if rr := serveAs(router, editor, "POST", "/schedules", create+"x"); rr.Code != http.StatusBadRequest {
+			t.Errorf("Incorrect status. Expected: %d, Got: %d\n", http.StatusBadRequest, rr.Code)
+		}
+	})
+
+	s := Schedule{}
+	db.Where("team_id = ?", team.ID).First(&s)
+	if s.ID == 0 || s.UserID != editor.ID {
+		t.Fatalf("Team schedule not saved correctly: %+v\n", s)
+	}
+
+	// a personal schedule of the viewer
+	db.Create(&Schedule{Time: time.Now(), Status: "PENDING", UserID: viewer.ID})
+
+	t.Run("members see the team schedules", func(t *testing.T) {
+		testHarness := []struct {
+			user  User
+			query string
+			count int
+		}{
+			{user: editor, count: 1},
+			{user: viewer, count: 2},
+			{user: viewer, query: fmt.Sprintf("?team_id=%d", team.ID), count: 1},
+			{user: stranger, count: 0},
+		}
+
+		for _, th := range testHarness {
+			rr := serveAs(router, th.user, "GET", "/schedules"+th.query, "")
+
+			schedules := []Schedule{}
+			json.NewDecoder(rr.Body).Decode(&schedules)
+			if len(schedules) != th.count {
+				t.Errorf("Incorrect number of schedules for %s%s. Expected: %d, Got: %d\n", th.user.Name, th.query, th.count, len(schedules))
+			}
+		}
+
+		rr := serveAs(router, stranger, "GET", fmt.Sprintf("/schedules?team_id=%d", team.ID), "")
+		if status := rr.Code; status != http.StatusForbidden {
+			t.Errorf("Incorrect status. Expected: %d, Got: %d\n", http.StatusForbidden, status)
+		}
+	})
+
+	t.Run("access follows the role in the team", func(t *testing.T) {
+		executions := fmt.Sprintf("/schedules/%d/executions", s.ID)
+		schedule := fmt.Sprintf("/schedules/%d", s.ID)
+
+		testHarness := []struct {
+			testName string
+			user     User
+			method   string
+			path     string
+			status   int
+		}{
+			{testName: "viewer lists executions", user: viewer, method: "GET", path: executions, status: http.StatusOK},
+			{testName: "stranger lists executions", user: stranger, method: "GET", path: executions, status: http.StatusForbidden},
+			{testName: "viewer deletes", user: viewer, method: "DELETE", path: schedule, status: http.StatusForbidden},
+			{testName: "stranger deletes", user: stranger, method: "DELETE", path: schedule, status: http.StatusForbidden},
+			{testName: "editor deletes", user: editor, method: "DELETE", path: schedule, status: http.StatusOK},
+		}
+
+		for _, th := range testHarness {
+			t.Run(th.testName, func(t *testing.T) {
+				rr := serveAs(router, th.user, th.method, th.path, "")
+				if status := rr.Code; status != th.status {
+					t.Errorf("Incorrect status. Expected: %d, Got: %d\n", th.status, status)
+				}
+			})
+		}
+	})
+}
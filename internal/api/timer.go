@@ -0,0 +1,142 @@
+package api
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+)
+
+// timerQueue keeps the next fire time of every waiting schedule in a min-heap
+// so the dispatcher can sleep until exactly the next one is due. Changes are
+// signalled on the changed channel so a sleeping dispatcher can pick up a
+// schedule that is now due sooner.
+type timerQueue struct {
+	mu      sync.Mutex
+	heap    timerHeap
+	entries map[uint]*timerEntry
+	changed chan struct{}
+}
+
+type timerEntry struct {
+	id    uint
+	at    time.Time
+	index int
+}
+
+func newTimerQueue() *timerQueue {
+	return &timerQueue{
+		entries: map[uint]*timerEntry{},
+		changed: make(chan struct{}, 1),
+	}
+}
+
+// set adds the schedule to the queue or moves it to its new fire time
+func (q *timerQueue) set(id uint, at time.Time) {
+	q.mu.Lock()
+	if e, ok := q.entries[id]; ok {
+		e.at = at
+		heap.Fix(&q.heap, e.index)
+	} else {
+		e := &timerEntry{id: id, at: at}
+		q.entries[id] = e
+		heap.Push(&q.heap, e)
+	}
+	q.mu.Unlock()
+
+	q.notify()
+}
+
+// remove takes the schedule off the queue, if it is on it
+func (q *timerQueue) remove(id uint) {
+	q.mu.Lock()
+	if e, ok := q.entries[id]; ok {
+		heap.Remove(&q.heap, e.index)
+		delete(q.entries, id)
+	}
+	q.mu.Unlock()
+
+	q.notify()
+}
+
+// reset replaces the whole queue with the given schedules
+func (q *timerQueue) reset(schedules []Schedule) {
+	q.mu.Lock()
+	q.heap = make(timerHeap, 0, len(schedules))
+	q.entries = map[uint]*timerEntry{}
+	for _, s := range schedules {
+		e := &timerEntry{id: s.ID, at: s.Time, index: len(q.heap)}
+		q.entries[s.ID] = e
+		q.heap = append(q.heap, e)
+	}
+	heap.Init(&q.heap)
+	q.mu.Unlock()
+
+	q.notify()
+}
+
+// next returns the earliest fire time in the queue. It returns false when
+// the queue is empty.
+func (q *timerQueue) next() (time.Time, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if len(q.heap) == 0 {
+		return time.Time{}, false
+	}
+	return q.heap[0].at, true
+}
+
+// popDue takes every schedule due at or before now off the queue
+func (q *timerQueue) popDue(now time.Time) []uint {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	ids := []uint{}
+	for len(q.heap) > 0 && !q.heap[0].at.After(now) {
+		e := heap.Pop(&q.heap).(*timerEntry)
+		delete(q.entries, e.id)
+		ids = append(ids, e.id)
+	}
+	return ids
+}
+
+func (q *timerQueue) len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return len(q.heap)
+}
+
+func (q *timerQueue) notify() {
+	select {
+	case q.changed <- struct{}{}:
+	default:
+	}
+}
+
+// timerHeap implements heap.Interface ordered by fire time
+type timerHeap []*timerEntry
+
+func (h timerHeap) Len() int           { return len(h) }
+func (h timerHeap) Less(i, j int) bool { return h[i].at.Before(h[j].at) }
+
+func (h timerHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *timerHeap) Push(x interface{}) {
+	e := x.(*timerEntry)
+	e.index = len(*h)
+	*h = append(*h, e)
+}
+
+func (h *timerHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	e := old[n-1]
+	old[n-1] = nil
+	*h = old[:n-1]
+	return e
+}
@@ -0,0 +1,69 @@
+package api
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTimerQueue(t *testing.T) {
+	now := time.Now()
+	q := newTimerQueue()
+
+	if _, ok := q.next(); ok {
+		t.Error("Empty queue returned a next time")
+	}
+
+	q.set(1, now.Add(3*time.Minute))
+	q.set(2, now.Add(1*time.Minute))
+	q.set(3, now.Add(2*time.Minute))
+
+	if next, _ := q.next(); !next.Equal(now.Add(time.Minute)) {
+		t.Errorf("Incorrect next time. Expected: %s, Got: %s\n", now.Add(time.Minute), next)
+	}
+
+	t.Run("move", func(t *testing.T) {
+		q.set(1, now.Add(-1*time.Minute))
+		if next, _ := q.next(); !next.Equal(now.Add(-1 * time.Minute)) {
+			t.Errorf("Moved entry not first: %s\n", next)
+		}
+	})
+
+	t.Run("remove", func(t *testing.T) {
+		q.remove(2)
+		q.remove(42)
+		if q.len() != 2 {
+			t.Errorf("Incorrect length. Expected: 2, Got: %d\n", q.len())
+		}
+	})
+
+	t.Run("pop due", func(t *testing.T) {
+		ids := q.popDue(now.Add(2 * time.Minute))
+		if len(ids) != 2 || ids[0] != 1 || ids[1] != 3 {
+			t.Errorf("Incorrect due ids: %v\n", ids)
+		}
+
+		if q.len() != 0 {
+			t.Errorf("Due entries not removed. Length: %d\n", q.len())
+		}
+	})
+
+	t.Run("reset", func(t *testing.T) {
+		q.reset([]Schedule{
+			{DBModel: DBModel{ID: 7}, Time: now.Add(time.Hour)},
+			{DBModel: DBModel{ID: 8}, Time: now},
+		})
+
+		if ids := q.popDue(now); len(ids) != 1 || ids[0] != 8 {
+			t.Errorf("Incorrect due ids after reset: %v\n", ids)
+		}
+	})
+
+	t.Run("changes are signalled", func(t *testing.T) {
+		q.set(9, now)
+		select {
+		case <-q.changed:
+		default:
+			t.Error("Change was not signalled")
+		}
+	})
+}
@@ -0,0 +1,82 @@
+package api
+
+import (
+	"encoding/base32"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestTOTPCode(t *testing.T) {
+	// the SHA1 test vectors of RFC 6238, truncated to 6 digits
+	secret := base32.StdEncoding.EncodeToString([]byte("12345678901234567890"))
+
+	testHarness := []struct {
+		testName string
+		unix     int64
+		code     string
+	}{
+		{testName: "59", unix: 59, code: "287082"},
+		{testName: "1111111109", unix: 1111111109, code: "081804"},
+		{testName: "1111111111", unix: 1111111111, code: "050471"},
+		{testName: "1234567890", unix: 1234567890, code: "005924"},
+		{testName: "2000000000", unix: 2000000000, code: "279037"},
+	}
+
+	for _, th := range testHarness {
+		t.Run(th.testName, func(t *testing.T) {
+			code, err := totpCode(secret, totpStep(time.Unix(th.unix, 0)))
+			if err != nil {
+				t.Fatalf("Error creating code: %s\n", err.Error())
+			}
+			if code != th.code {
+				t.Errorf("Incorrect code. Expected: %s, Got: %s\n", th.code, code)
+			}
+		})
+	}
+}
+
+func TestMatchTOTP(t *testing.T) {
+	secret, _ := newTOTPSecret()
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	step := totpStep(now)
+
+	code := func(step int64) string {
+		c, _ := totpCode(secret, step)
+		return c
+	}
+
+	testHarness := []struct {
+		testName string
+		code     string
+		lastStep int64
+		step     int64
+	}{
+		{testName: "current", code: code(step), step: step},
+		{testName: "previous", code: code(step - 1), step: step - 1},
+		{testName: "next", code: code(step + 1), step: step + 1},
+		{testName: "too old", code: code(step - 2), step: 0},
+		{testName: "already used", code: code(step), lastStep: step, step: 0},
+		{testName: "spaces", code: code(step)[:3] + " " + code(step)[3:], step: step},
+		{testName: "too short", code: "123", step: 0},
+	}
+
+	for _, th := range testHarness {
+		t.Run(th.testName, func(t *testing.T) {
+			if step := matchTOTP(secret, th.code, th.lastStep, now); step != th.step {
+				t.Errorf("Incorrect step. Expected: %d, Got: %d\n", th.step, step)
+			}
+		})
+	}
+
+	t.Run("uri", func(t *testing.T) {
+		u, err := url.Parse(totpURI(secret, "me@email.com"))
+		if err != nil {
+			t.Fatalf("Error parsing uri: %s\n", err.Error())
+		}
+		if u.Scheme != "otpauth" || u.Host != "totp" || u.Path != "/Scheduler:me@email.com" ||
+			u.Query().Get("secret") != secret || u.Query().Get("issuer") != "Scheduler" {
+			t.Errorf("Incorrect uri: %s\n", u)
+		}
+	})
+}
@@ -3,12 +3,14 @@ package main
 import (
 	"crypto/rand"
 	"encoding/hex"
+	"flag"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
 	"path"
+	"strconv"
 	"strings"
 	"time"
 
@@ -17,15 +19,33 @@ import (
 	"github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
 	"github.com/jinzhu/gorm"
-	_ "github.com/jinzhu/gorm/dialects/sqlite"
 )
 
 func main() {
-	db, err := gorm.Open("sqlite3", "sqlite.db")
+	databaseURL := os.Getenv("DATABASE_URL")
+	if databaseURL == "" {
+		databaseURL = api.DefaultDatabaseURL
+	}
+	flag.StringVar(&databaseURL, "database-url", databaseURL, "sqlite3://, postgres:// or mysql:// url of the database")
+	adminEmail := flag.String("admin-email", os.Getenv("ADMIN_EMAIL"), "email of an admin user to create or promote on startup")
+	adminPassword := flag.String("admin-password", os.Getenv("ADMIN_PASSWORD"), "password of the admin user when it is created")
+	registration := flag.String("registration", envString("REGISTRATION", api.RegistrationOpen), "who may register: open, invite (with an invite token) or closed (admins create users)")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] [migrate up|down [steps]|status]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	db, err := api.OpenDB(databaseURL)
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	if flag.Arg(0) == "migrate" {
+		migrate(db, flag.Args()[1:])
+		return
+	}
+
 	var jwtSecret []byte
 	jwtSecretString := os.Getenv("JWT_SECRET")
 	if jwtSecretString == "" {
@@ -46,27 +66,165 @@ func main() {
 		log.Println("WARNING: Using dummy web endpoint url. Set REMOTE_URL env var.")
 	}
 
-	routes := api.NewRoutes(db, jwtSecret, api.NewHTTPClient(url))
-	routes.MigrateDB()
+	accessTokenTTL := envDuration("ACCESS_TOKEN_TTL", 15*time.Minute)
+	refreshTokenTTL := envDuration("REFRESH_TOKEN_TTL", 30*24*time.Hour)
+	requestTimeout := envDuration("REQUEST_TIMEOUT", 30*time.Second)
+	scanInterval := envDuration("SCAN_INTERVAL", time.Minute)
+	leaderTTL := envDuration("LEADER_TTL", 15*time.Second)
+	workers := envInt("WORKERS", 4)
+	hostConcurrency := envInt("HOST_CONCURRENCY", 2)
+	passwordCost := envInt("PASSWORD_COST", 10)
+	loginLimits := api.LoginLimits{
+		Window:          envDuration("LOGIN_WINDOW", api.DefaultLoginLimits.Window),
+		IPFailures:      envInt("LOGIN_IP_FAILURES", api.DefaultLoginLimits.IPFailures),
+		AccountFailures: envInt("LOGIN_ACCOUNT_FAILURES", api.DefaultLoginLimits.AccountFailures),
+		Lockout:         envDuration("LOGIN_LOCKOUT", api.DefaultLoginLimits.Lockout),
+		MaxLockout:      envDuration("LOGIN_MAX_LOCKOUT", api.DefaultLoginLimits.MaxLockout),
+	}
+	trustProxy := envBool("TRUST_PROXY", false)
+
+	routes := api.NewRoutes(db, jwtSecret, api.NewHTTPClient(url, requestTimeout))
+	if err := routes.MigrateDB(); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := api.SetPasswordCost(passwordCost); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := routes.SetIssuer(envString("JWT_ISSUER", "scheduler")); err != nil {
+		log.Fatal(err)
+	}
+
+	if path := os.Getenv("JWT_SIGNING_KEY"); path != "" {
+		signing, err := ioutil.ReadFile(path)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		verify := [][]byte{}
+		for _, p := range strings.Split(os.Getenv("JWT_VERIFY_KEYS"), ",") {
+			if p = strings.TrimSpace(p); p == "" {
+				continue
+			}
+			b, err := ioutil.ReadFile(p)
+			if err != nil {
+				log.Fatal(err)
+			}
+			verify = append(verify, b)
+		}
+
+		if err := routes.SetSigningKeys(signing, verify...); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if *adminEmail != "" {
+		if err := routes.BootstrapAdmin(*adminEmail, *adminPassword); err != nil {
+			log.Fatal(err)
+		}
+	}
+	routes.SetTokenTTLs(accessTokenTTL, refreshTokenTTL)
+	routes.SetLoginLimits(loginLimits)
+
+	if err := routes.SetRegistration(*registration); err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("Registration is %s\n", *registration)
+
+	switch notifier := envString("NOTIFIER", "log"); notifier {
+	case "log":
+		routes.SetNotifier(api.LogNotifier{})
+	case "file":
+		routes.SetNotifier(&api.FileNotifier{Path: envString("NOTIFY_FILE", "notifications.txt")})
+	default:
+		log.Fatalf("Unknown NOTIFIER %s. Provide log or file\n", notifier)
+	}
+	if err := routes.SetResetURL(envString("PASSWORD_RESET_URL", "http://localhost:1337/reset-password")); err != nil {
+		log.Fatal(err)
+	}
+
+	if issuer := os.Getenv("OIDC_ISSUER"); issuer != "" {
+		err := routes.SetOIDC(api.OIDCConfig{
+			Issuer:        issuer,
+			ClientID:      os.Getenv("OIDC_CLIENT_ID"),
+			ClientSecret:  os.Getenv("OIDC_CLIENT_SECRET"),
+			RedirectURL:   os.Getenv("OIDC_REDIRECT_URL"),
+			AutoProvision: envBool("OIDC_AUTO_PROVISION", false),
+			LoginPage:     os.Getenv("OIDC_LOGIN_PAGE"),
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("Single sign-on with %s\n", issuer)
+	}
+
+	elector := api.NewElector(routes, leaderTTL)
+	dispatcher := api.NewDispatcher(routes, elector, workers, hostConcurrency)
 
 	r := mux.NewRouter()
 
 	a := r.PathPrefix("/").Subrouter()
 	a.Use(routes.AuthMiddleware)
 
+	// scoped only lets tokens and API keys with scope through
+	scoped := func(scope string, h http.HandlerFunc) http.Handler {
+		return routes.RequireScope(scope)(h)
+	}
+
 	// All api requests must be authenticated
-	a.HandleFunc("/me", routes.Me).Methods("GET")
-	a.HandleFunc("/schedules", routes.ListSchedules).Methods("GET")
-	a.HandleFunc("/schedules", routes.CreateSchedule).Methods("POST")
-	a.HandleFunc("/schedules/{id}", routes.DeleteSchedule).Methods("DELETE")
+	a.Handle("/me", scoped(api.ScopeAccount, routes.Me)).Methods("GET")
+	a.Handle("/logout", scoped(api.ScopeAccount, routes.LogoutFunc)).Methods("POST")
+	a.Handle("/me/password", scoped(api.ScopeAccount, routes.ChangePassword)).Methods("POST")
+	a.Handle("/schedules", scoped(api.ScopeSchedulesRead, routes.ListSchedules)).Methods("GET")
+	a.Handle("/schedules", scoped(api.ScopeSchedulesWrite, routes.CreateSchedule)).Methods("POST")
+	a.Handle("/schedules/{id}", scoped(api.ScopeSchedulesRead, routes.GetSchedule)).Methods("GET")
+	a.Handle("/schedules/{id}", scoped(api.ScopeSchedulesWrite, routes.UpdateSchedule)).Methods("PATCH", "PUT")
+	a.Handle("/schedules/{id}", scoped(api.ScopeSchedulesWrite, routes.DeleteSchedule)).Methods("DELETE")
+	a.Handle("/schedules/{id}/executions", scoped(api.ScopeExecutionsRead, routes.ListExecutions)).Methods("GET")
+	a.Handle("/teams", scoped(api.ScopeTeamsRead, routes.ListTeams)).Methods("GET")
+	a.Handle("/teams", scoped(api.ScopeTeamsWrite, routes.CreateTeam)).Methods("POST")
+	a.Handle("/teams/{id}/members", scoped(api.ScopeTeamsRead, routes.ListMembers)).Methods("GET")
+	a.Handle("/teams/{id}/members", scoped(api.ScopeTeamsWrite, routes.AddMember)).Methods("POST")
+	a.Handle("/teams/{id}/members/{user_id}", scoped(api.ScopeTeamsWrite, routes.UpdateMember)).Methods("PUT")
+	a.Handle("/teams/{id}/members/{user_id}", scoped(api.ScopeTeamsWrite, routes.RemoveMember)).Methods("DELETE")
+	a.Handle("/invites", scoped(api.ScopeTeamsRead, routes.ListInvites)).Methods("GET")
+	a.Handle("/invites", scoped(api.ScopeTeamsWrite, routes.CreateInvite)).Methods("POST")
+	a.Handle("/invites/{id}", scoped(api.ScopeTeamsWrite, routes.RevokeInvite)).Methods("DELETE")
+	a.Handle("/api-keys", scoped(api.ScopeAccount, routes.ListAPIKeys)).Methods("GET")
+	a.Handle("/api-keys", scoped(api.ScopeAccount, routes.CreateAPIKey)).Methods("POST")
+	a.Handle("/api-keys/{id}", scoped(api.ScopeAccount, routes.RevokeAPIKey)).Methods("DELETE")
+	a.Handle("/mfa/totp", scoped(api.ScopeAccount, routes.EnrollTOTP)).Methods("POST")
+	a.Handle("/mfa/totp/disable", scoped(api.ScopeAccount, routes.DisableTOTP)).Methods("POST")
+	a.Handle("/mfa/totp/confirm", scoped(api.ScopeAccount, routes.ConfirmTOTP)).Methods("POST")
+	a.Handle("/mfa/recovery-codes", scoped(api.ScopeAccount, routes.RegenerateRecoveryCodes)).Methods("POST")
 
-	r.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
-		fmt.Fprintln(w, "We're up doc")
-	}).Methods("GET")
+	// Admin requests must also come from an admin with the admin scope
+	admin := a.PathPrefix("/admin").Subrouter()
+	admin.Use(routes.RequireScope(api.ScopeAdmin))
+	admin.Use(routes.AdminMiddleware)
+	admin.HandleFunc("/users", routes.ListUsers).Methods("GET")
+	admin.HandleFunc("/users", routes.CreateUser).Methods("POST")
+	admin.HandleFunc("/users/{id}", routes.DeleteUser).Methods("DELETE")
+	admin.HandleFunc("/users/{id}/disable", routes.DisableUser).Methods("POST")
+	admin.HandleFunc("/users/{id}/enable", routes.EnableUser).Methods("POST")
+	admin.HandleFunc("/users/{id}/password", routes.ResetPassword).Methods("POST")
+	admin.HandleFunc("/users/{id}/mfa", routes.ResetMFA).Methods("DELETE")
+	admin.HandleFunc("/audit", routes.ListAuditEntries).Methods("GET")
+
+	r.HandleFunc("/status", elector.Status).Methods("GET")
+	r.HandleFunc("/.well-known/jwks.json", routes.JWKS).Methods("GET")
+	r.HandleFunc("/metrics", dispatcher.Metrics).Methods("GET")
 
 	// Login should not be under the AuthMiddleware
 	r.HandleFunc("/login", routes.LoginFunc).Methods("POST")
+	r.HandleFunc("/login/mfa", routes.LoginMFAFunc).Methods("POST")
 	r.HandleFunc("/register", routes.RegisterFunc).Methods("POST")
+	r.HandleFunc("/refresh", routes.RefreshFunc).Methods("POST")
+	r.HandleFunc("/password/forgot", routes.ForgotPasswordFunc).Methods("POST")
+	r.HandleFunc("/password/reset", routes.ResetPasswordFunc).Methods("POST")
+	r.HandleFunc("/oidc/login", routes.OIDCLogin).Methods("GET")
+	r.HandleFunc("/oidc/callback", routes.OIDCCallback).Methods("GET")
 
 	if _, err := os.Stat("client/dist"); os.IsNotExist(err) {
 		log.Println("Could not find client/dist/index.html Run client build please")
@@ -76,20 +234,122 @@ func main() {
 
 	logRoutes(r)
 
-	log.Println("Checking schedules every 10 seconds for deploy to run")
-	go func() {
-		for {
-			routes.CheckSchedules()
-			time.Sleep(10 * time.Second)
-		}
-	}()
+	log.Printf("Dispatching schedules when due with %d workers while leader\n", workers)
+	go elector.Run()
+	go dispatcher.Run(scanInterval)
 
-	loggedRoutes := handlers.LoggingHandler(os.Stdout, r)
+	var handler http.Handler = r
+	if trustProxy {
+		// take the client IP from X-Forwarded-For when behind a proxy
+		handler = handlers.ProxyHeaders(r)
+	}
+	loggedRoutes := handlers.LoggingHandler(os.Stdout, handler)
 
 	log.Printf("Scheduler server listening on 0.0.0.0:1337\n\n")
 	log.Fatal(http.ListenAndServe("0.0.0.0:1337", loggedRoutes))
 }
 
+// migrate runs the migrate subcommand
+func migrate(db *gorm.DB, args []string) {
+	if len(args) == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	switch args[0] {
+	case "up":
+		if err := api.MigrateUp(db); err != nil {
+			log.Fatal(err)
+		}
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			var err error
+			if steps, err = strconv.Atoi(args[1]); err != nil || steps < 1 {
+				log.Fatal("Error parsing steps. Provide a positive whole number")
+			}
+		}
+		if err := api.MigrateDown(db, steps); err != nil {
+			log.Fatal(err)
+		}
+	case "status":
+		statuses, err := api.MigrationStatuses(db)
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, s := range statuses {
+			applied := "pending"
+			if s.AppliedAt != nil {
+				applied = s.AppliedAt.Format(time.RFC3339)
+			}
+			fmt.Printf("%4d  %-20s  %s\n", s.Version, applied, s.Name)
+		}
+		return
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	statuses, err := api.MigrationStatuses(db)
+	if err != nil {
+		log.Fatal(err)
+	}
+	version := 0
+	for _, s := range statuses {
+		if s.AppliedAt != nil {
+			version = s.Version
+		}
+	}
+	log.Printf("Database schema is at version %d\n", version)
+}
+
+func envInt(name string, fallback int) int {
+	v := os.Getenv(name)
+	if v == "" {
+		return fallback
+	}
+
+	i, err := strconv.Atoi(v)
+	if err != nil {
+		log.Fatalf("Error parsing %s. Provide a whole number\n", name)
+	}
+	return i
+}
+
+func envString(name string, fallback string) string {
+	v := os.Getenv(name)
+	if v == "" {
+		return fallback
+	}
+	return v
+}
+
+func envBool(name string, fallback bool) bool {
+	v := os.Getenv(name)
+	if v == "" {
+		return fallback
+	}
+
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		log.Fatalf("Error parsing %s. Provide true or false\n", name)
+	}
+	return b
+}
+
+func envDuration(name string, fallback time.Duration) time.Duration {
+	v := os.Getenv(name)
+	if v == "" {
+		return fallback
+	}
+
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		log.Fatalf("Error parsing %s. Provide a positive duration like 30s\n", name)
+	}
+	return d
+}
+
 func logRoutes(router *mux.Router) {
 	fmt.Println("--- Routes ---")
 	err := router.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {